@@ -47,15 +47,29 @@ const (
 	XMPPNS_AVATAR_PEP_METADATA = "urn:xmpp:avatar:metadata"
 	// XMPPNS_BIND_0 used in bunding resource identifier to a session as described in https://xmpp.org/extensions/xep-0386.html
 	XMPPNS_BIND_0 = "urn:xmpp:bind:0"
+	// XMPPNS_CAPS namespace used in XEP-0115: Entity Capabilities, https://xmpp.org/extensions/xep-0115.html
+	XMPPNS_CAPS = "http://jabber.org/protocol/caps"
 	// XMPPNS_CLIENT namespace is a foundational XML namespace used in the Extensible Messaging and Presence Protocol
 	// (XMPP) to scope the core client-to-server (C2S) communication stanzas.
 	XMPPNS_CLIENT = "jabber:client"
+	// XMPPNS_COMPONENT_ACCEPT namespace used in XEP-0114: Jabber Component Protocol, https://xmpp.org/extensions/xep-0114.html
+	XMPPNS_COMPONENT_ACCEPT = "jabber:component:accept"
+	// XMPPNS_DELAY namespace used in XEP-0203: Delayed Delivery, https://xmpp.org/extensions/xep-0203.html
+	XMPPNS_DELAY = "urn:xmpp:delay"
 	// XMPPNS_DISCO_INFO namespace used in Service Discovery protocol, https://xmpp.org/extensions/xep-0030.html
 	XMPPNS_DISCO_INFO = "http://jabber.org/protocol/disco#info"
 	// XMPPNS_DISCO_ITEMS namespace used in item discover queries, described https://xmpp.org/extensions/xep-0030.html#items
 	XMPPNS_DISCO_ITEMS = "http://jabber.org/protocol/disco#items"
+	// XMPPNS_ECAPS2 namespace used in XEP-0390: Entity Capabilities 2.0, https://xmpp.org/extensions/xep-0390.html
+	XMPPNS_ECAPS2 = "urn:xmpp:caps"
 	// XMPPNS_FAST_0 namespace used in XEP-0484: Fast Authentication Streamlining Tokens, https://xmpp.org/extensions/xep-0484.html
 	XMPPNS_FAST_0 = "urn:xmpp:fast:0"
+	// XMPPNS_FRAMING namespace used in RFC 7395: An XMPP Subprotocol for WebSocket, https://www.rfc-editor.org/rfc/rfc7395.html
+	XMPPNS_FRAMING = "urn:ietf:params:xml:ns:xmpp-framing"
+	// XMPPNS_HASHES_2 namespace used in XEP-0300: Use of Cryptographic Hash Functions in XMPP, https://xmpp.org/extensions/xep-0300.html
+	XMPPNS_HASHES_2 = "urn:xmpp:hashes:2"
+	// XMPPNS_HTTPBIND namespace used in XEP-0124: Bidirectional-streams Over Synchronous HTTP (BOSH), https://xmpp.org/extensions/xep-0124.html
+	XMPPNS_HTTPBIND = "http://jabber.org/protocol/httpbind"
 	// XMPPNS_HTTP_UPLOAD_0 namespace used in XEP-0363: HTTP File Upload, https://xmpp.org/extensions/xep-0363.html
 	XMPPNS_HTTP_UPLOAD_0 = "urn:xmpp:http:upload:0"
 	// XMPPNS_IQ_VERSION namespace used in XEP-0092: Software Version, https://xmpp.org/extensions/xep-0092.html
@@ -64,12 +78,20 @@ const (
 	XMPPNS_MUC = "http://jabber.org/protocol/muc"
 	// XMPPNS_MUC_USER namespace used in XEP-0045: Multi-User Chat, https://xmpp.org/extensions/xep-0045.html
 	XMPPNS_MUC_USER = "http://jabber.org/protocol/muc#user"
+	// XMPPNS_OOB namespace used in XEP-0066: Out of Band Data, https://xmpp.org/extensions/xep-0066.html
+	XMPPNS_OOB = "jabber:x:oob"
 	// XMPPNS_PING namespace used in XEP-0199: XMPP Ping, https://xmpp.org/extensions/xep-0199.html
 	XMPPNS_PING = "urn:xmpp:ping"
 	// XMPPNS_PUBSUB_EVENT namespace used in XEP-0060: Publish-Subscribe, https://xmpp.org/extensions/xep-0060.html
 	XMPPNS_PUBSUB_EVENT = "http://jabber.org/protocol/pubsub#event"
 	// XMPPNS_PUBSUB namespace used in XEP-0060: Publish-Subscribe, https://xmpp.org/extensions/xep-0060.html
 	XMPPNS_PUBSUB = "http://jabber.org/protocol/pubsub"
+	// XMPPNS_RECEIPTS namespace used in XEP-0184: Message Delivery Receipts, https://xmpp.org/extensions/xep-0184.html
+	XMPPNS_RECEIPTS = "urn:xmpp:receipts"
+	// XMPPNS_ROSTER namespace used in roster management, as described in https://www.ietf.org/rfc/rfc6121.txt
+	XMPPNS_ROSTER = "jabber:iq:roster"
+	// XMPPNS_ROSTERVER stream feature namespace used in XEP-0237: Roster Versioning, https://xmpp.org/extensions/xep-0237.html
+	XMPPNS_ROSTERVER = "urn:xmpp:features:rosterver"
 	// XMPPNS_SASL_2 namespace used during SASL auth, as described in XEP-0388: Extensible SASL Profile, https://xmpp.org/extensions/xep-0388.html
 	XMPPNS_SASL_2 = "urn:xmpp:sasl:2"
 	// XMPPNS_SASL_CB_0 namespace used during SASL auth, as described in XEP-0388: Extensible SASL Profile, https://xmpp.org/extensions/xep-0388.html
@@ -86,6 +108,8 @@ const (
 	// XMPPNS_SID_0 namespace used in XEP-0359: Unique and Stable Stanza IDs, https://xmpp.org/extensions/xep-0359.html
 	// to implement unique and relible id.
 	XMPPNS_SID_0 = "urn:xmpp:sid:0"
+	// XMPPNS_SM_3 namespace used in XEP-0198: Stream Management, https://xmpp.org/extensions/xep-0198.html
+	XMPPNS_SM_3 = "urn:xmpp:sm:3"
 	// XMPPNS_STREAM namespace used in description of clients xml data stream as described in XEP-0044: Full Namespace
 	// Support for XML Streams, https://xmpp.org/extensions/xep-0044.html
 	XMPPNS_STREAM = "http://etherx.jabber.org/streams"
@@ -94,10 +118,16 @@ const (
 	XMPPNS_STREAM_LIMITS_0 = "urn:xmpp:stream-limits:0"
 	// XMPPNS_TIME namespace used in response to information query for client local time, as described in XEP-0202: Entity Time, https://xmpp.org/extensions/xep-0202.html
 	XMPPNS_TIME = "urn:xmpp:time"
+	// XMPPNS_XBOSH namespace used in XEP-0206: XMPP Over BOSH, https://xmpp.org/extensions/xep-0206.html
+	XMPPNS_XBOSH = "urn:xmpp:xbosh"
 	// XMPPNS_XMPP_TLS namespace used during session initialization to start tls session, as described in https://www.ietf.org/rfc/rfc6120.txt
 	XMPPNS_XMPP_TLS = "urn:ietf:params:xml:ns:xmpp-tls"
 	// XMPPNS_XMPP_BIND namespace used during session initialization to start tls session, as described in https://www.ietf.org/rfc/rfc6120.txt
 	XMPPNS_XMPP_BIND = "urn:ietf:params:xml:ns:xmpp-bind"
+	// XMPPNS_XMPP_STANZAS namespace used for defined stanza error conditions, as described in https://www.ietf.org/rfc/rfc6120.txt
+	XMPPNS_XMPP_STANZAS = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	// XMPPNS_XMPP_STREAMS namespace used for defined stream error conditions, as described in https://www.ietf.org/rfc/rfc6120.txt
+	XMPPNS_XMPP_STREAMS = "urn:ietf:params:xml:ns:xmpp-streams"
 	// XMPPNS_XMPP_SESSION namespace used during xmpp session establisment process, as described in https://www.ietf.org/rfc/rfc6121.txt
 	XMPPNS_XMPP_SESSION = "urn:ietf:params:xml:ns:xmpp-session"
 )
@@ -5,4 +5,5 @@ go 1.25.0
 require (
 	github.com/google/uuid v1.6.0
 	golang.org/x/net v0.56.0
+	golang.org/x/text v0.38.0
 )
@@ -0,0 +1,214 @@
+// Package jid implements XMPP addresses as described in RFC 7622: Extensible
+// Messaging and Presence Protocol (XMPP): Address Format.
+package jid
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/secure/precis"
+)
+
+// maxPartLen is the maximum length of each part of a JID in bytes, see RFC
+// 7622 section 3.
+const maxPartLen = 1023
+
+// JID is an XMPP address of the form localpart@domainpart/resourcepart. The
+// parts are stored normalized, so JIDs can also be compared with ==. The zero
+// value is the empty address.
+type JID struct {
+	local    string
+	domain   string
+	resource string
+}
+
+// Parse parses and normalizes s. The resourcepart starts at the first "/"
+// and may contain "@" and "/", the localpart ends at the first "@" before
+// it.
+func Parse(s string) (JID, error) {
+	rest, resource, hasResource := strings.Cut(s, "/")
+	local, domain, hasLocal := strings.Cut(rest, "@")
+	if !hasLocal {
+		local, domain = "", rest
+	}
+	if hasLocal && local == "" {
+		return JID{}, errors.New("jid: empty localpart in " + s)
+	}
+	if hasResource && resource == "" {
+		return JID{}, errors.New("jid: empty resourcepart in " + s)
+	}
+	return New(local, domain, resource)
+}
+
+// MustParse is like Parse but panics if s is not a valid JID. It is meant
+// for constants.
+func MustParse(s string) JID {
+	j, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return j
+}
+
+// New returns the JID with the given parts, which are normalized. local and
+// resource may be empty.
+func New(local, domain, resource string) (JID, error) {
+	var j JID
+	var err error
+	if j.domain, err = normalizeDomain(domain); err != nil {
+		return JID{}, err
+	}
+	if j.local, err = normalizeLocal(local); err != nil {
+		return JID{}, err
+	}
+	if j.resource, err = normalizeResource(resource); err != nil {
+		return JID{}, err
+	}
+	return j, nil
+}
+
+// normalizeDomain applies RFC 7622 section 3.2: IP literals are kept, domain
+// names are converted to their IDNA2008 U-label form.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return "", errors.New("jid: empty domainpart")
+	}
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		ip := net.ParseIP(domain[1 : len(domain)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", errors.New("jid: invalid IPv6 domainpart " + domain)
+		}
+		return "[" + ip.String() + "]", nil
+	}
+	if ip := net.ParseIP(domain); ip != nil && ip.To4() != nil {
+		return ip.String(), nil
+	}
+	d, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		return "", errors.New("jid: invalid domainpart " + domain + ": " + err.Error())
+	}
+	if len(d) > maxPartLen {
+		return "", errors.New("jid: domainpart too long")
+	}
+	return d, nil
+}
+
+// normalizeLocal applies the UsernameCaseMapped profile of RFC 8265 and the
+// additional restrictions of RFC 7622 section 3.3.1.
+func normalizeLocal(local string) (string, error) {
+	if local == "" {
+		return "", nil
+	}
+	l, err := precis.UsernameCaseMapped.String(local)
+	if err != nil {
+		return "", errors.New("jid: invalid localpart " + local + ": " + err.Error())
+	}
+	if strings.ContainsAny(l, "\"&'/:<>@") {
+		return "", errors.New("jid: localpart contains a disallowed character: " + local)
+	}
+	if len(l) > maxPartLen {
+		return "", errors.New("jid: localpart too long")
+	}
+	return l, nil
+}
+
+// normalizeResource applies the OpaqueString profile of RFC 8265 as
+// required by RFC 7622 section 3.4.
+func normalizeResource(resource string) (string, error) {
+	if resource == "" {
+		return "", nil
+	}
+	if !utf8.ValidString(resource) {
+		return "", errors.New("jid: resourcepart is not valid UTF-8")
+	}
+	r, err := precis.OpaqueString.String(resource)
+	if err != nil {
+		return "", errors.New("jid: invalid resourcepart " + resource + ": " + err.Error())
+	}
+	if len(r) > maxPartLen {
+		return "", errors.New("jid: resourcepart too long")
+	}
+	return r, nil
+}
+
+// Local returns the localpart, e.g. the user name.
+func (j JID) Local() string {
+	return j.local
+}
+
+// Domain returns the JID of the domain, without localpart and resourcepart.
+func (j JID) Domain() JID {
+	return JID{domain: j.domain}
+}
+
+// Resource returns the resourcepart.
+func (j JID) Resource() string {
+	return j.resource
+}
+
+// Bare returns the JID without its resourcepart.
+func (j JID) Bare() JID {
+	return JID{local: j.local, domain: j.domain}
+}
+
+// IsBare reports whether the JID has no resourcepart.
+func (j JID) IsBare() bool {
+	return j.resource == ""
+}
+
+// WithResource returns the JID with the resourcepart replaced by resource.
+// An empty resource returns the bare JID.
+func (j JID) WithResource(resource string) (JID, error) {
+	r, err := normalizeResource(resource)
+	if err != nil {
+		return JID{}, err
+	}
+	j.resource = r
+	return j, nil
+}
+
+// Equal reports whether j and o are the same address.
+func (j JID) Equal(o JID) bool {
+	return j == o
+}
+
+// IsZero reports whether j is the empty address.
+func (j JID) IsZero() bool {
+	return j == JID{}
+}
+
+// String returns the address as localpart@domainpart/resourcepart.
+func (j JID) String() string {
+	s := j.domain
+	if j.local != "" {
+		s = j.local + "@" + s
+	}
+	if j.resource != "" {
+		s += "/" + j.resource
+	}
+	return s
+}
+
+// MarshalText implements encoding.TextMarshaler, e.g. for XML attributes.
+func (j JID) MarshalText() ([]byte, error) {
+	return []byte(j.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Empty text is the zero
+// JID.
+func (j *JID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*j = JID{}
+		return nil
+	}
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*j = v
+	return nil
+}
@@ -0,0 +1,96 @@
+package jid
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		in                      string
+		local, domain, resource string
+		want                    string
+	}{
+		{in: "example.com", domain: "example.com", want: "example.com"},
+		{in: "example.com.", domain: "example.com", want: "example.com"},
+		{in: "Juliet@Example.COM", local: "juliet", domain: "example.com", want: "juliet@example.com"},
+		{in: "juliet@example.com/Balcony", local: "juliet", domain: "example.com", resource: "Balcony",
+			want: "juliet@example.com/Balcony"},
+		{in: "juliet@example.com/a@b/c", local: "juliet", domain: "example.com", resource: "a@b/c",
+			want: "juliet@example.com/a@b/c"},
+		{in: "example.com/foo@bar", domain: "example.com", resource: "foo@bar", want: "example.com/foo@bar"},
+		{in: "ÄLICE@Ελλάδα.gr", local: "älice", domain: "ελλάδα.gr", want: "älice@ελλάδα.gr"},
+		{in: "user@xn--bcher-kva.example", local: "user", domain: "bücher.example", want: "user@bücher.example"},
+		{in: "user@192.0.2.1/r", local: "user", domain: "192.0.2.1", resource: "r", want: "user@192.0.2.1/r"},
+		{in: "user@[2001:DB8::1]", local: "user", domain: "[2001:db8::1]", want: "user@[2001:db8::1]"},
+	} {
+		j, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if j.Local() != tt.local || j.Domain().String() != tt.domain || j.Resource() != tt.resource {
+			t.Errorf("Parse(%q) = %q, %q, %q, want %q, %q, %q", tt.in,
+				j.Local(), j.Domain(), j.Resource(), tt.local, tt.domain, tt.resource)
+		}
+		if j.String() != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.in, j.String(), tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"@example.com",
+		"juliet@",
+		"juliet@example.com/",
+		"jul<iet@example.com",
+		"juliet@exa mple.com",
+		"a@b@example.com",
+		"user@[192.0.2.1]",
+		strings.Repeat("a", 1024) + "@example.com",
+	} {
+		if j, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %q, want error", in, j)
+		}
+	}
+}
+
+func TestJID(t *testing.T) {
+	j := MustParse("romeo@example.net/orchard")
+	if got := j.Bare(); got.String() != "romeo@example.net" || !got.IsBare() {
+		t.Errorf("Bare() = %q", got)
+	}
+	if !j.Equal(MustParse("Romeo@EXAMPLE.net/orchard")) {
+		t.Error("JIDs differing in case of localpart and domainpart are not equal")
+	}
+	if j.Equal(MustParse("romeo@example.net/Orchard")) {
+		t.Error("JIDs differing in case of the resourcepart are equal")
+	}
+	other, err := j.WithResource("garden")
+	if err != nil || other.String() != "romeo@example.net/garden" {
+		t.Errorf("WithResource = %q, %v", other, err)
+	}
+	if bare, _ := j.WithResource(""); bare != j.Bare() {
+		t.Errorf("WithResource(\"\") = %q", bare)
+	}
+	if !(JID{}).IsZero() || j.IsZero() {
+		t.Error("IsZero")
+	}
+
+	var v struct {
+		From JID `xml:"from,attr"`
+		To   JID `xml:"to,attr"`
+	}
+	if err := xml.Unmarshal([]byte("<message from='Juliet@Example.com/balcony'/>"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.From.String() != "juliet@example.com/balcony" || !v.To.IsZero() {
+		t.Errorf("unmarshaled %q, %q", v.From, v.To)
+	}
+	if err := xml.Unmarshal([]byte("<message from='@example.com'/>"), &v); err == nil {
+		t.Error("unmarshaling an invalid JID succeeded")
+	}
+}
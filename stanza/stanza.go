@@ -0,0 +1,90 @@
+// Package stanza implements the message, presence and iq stanzas of RFC 6120
+// section 8 for sending with encoding/xml. Attribute values and character
+// data are escaped by the encoder, extension elements are added as Payload.
+package stanza
+
+import (
+	"encoding/xml"
+)
+
+// Message types, see RFC 6121 section 5.2.2.
+const (
+	MessageChat      = "chat"
+	MessageError     = "error"
+	MessageGroupchat = "groupchat"
+	MessageHeadline  = "headline"
+	MessageNormal    = "normal"
+)
+
+// Presence types, see RFC 6121 section 4.7.1. Available presence has no
+// type.
+const (
+	PresenceError        = "error"
+	PresenceProbe        = "probe"
+	PresenceSubscribe    = "subscribe"
+	PresenceSubscribed   = "subscribed"
+	PresenceUnavailable  = "unavailable"
+	PresenceUnsubscribe  = "unsubscribe"
+	PresenceUnsubscribed = "unsubscribed"
+)
+
+// IQ types, see RFC 6120 section 8.2.3.
+const (
+	IQGet    = "get"
+	IQSet    = "set"
+	IQResult = "result"
+	IQError  = "error"
+)
+
+// Message is a message stanza.
+type Message struct {
+	XMLName xml.Name `xml:"message"`
+	ID      string   `xml:"id,attr,omitempty"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Subject string   `xml:"subject,omitempty"`
+	Body    string   `xml:"body,omitempty"`
+	Thread  string   `xml:"thread,omitempty"`
+
+	// Payload holds extension elements, values with an XMLName field
+	// including the namespace of the extension.
+	Payload []any `xml:",any"`
+
+	// InnerXML is written verbatim after the payload. It is meant for
+	// callers passing on XML they built themselves and is not escaped.
+	InnerXML string `xml:",innerxml"`
+}
+
+// Presence is a presence stanza.
+type Presence struct {
+	XMLName  xml.Name `xml:"presence"`
+	ID       string   `xml:"id,attr,omitempty"`
+	From     string   `xml:"from,attr,omitempty"`
+	To       string   `xml:"to,attr,omitempty"`
+	Type     string   `xml:"type,attr,omitempty"`
+	Lang     string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Show     string   `xml:"show,omitempty"`
+	Status   string   `xml:"status,omitempty"`
+	Priority int8     `xml:"priority,omitempty"`
+
+	// Payload and InnerXML are written like those of Message.
+	Payload  []any  `xml:",any"`
+	InnerXML string `xml:",innerxml"`
+}
+
+// IQ is an iq stanza. Requests carry exactly one payload element, results
+// zero or one.
+type IQ struct {
+	XMLName xml.Name `xml:"iq"`
+	ID      string   `xml:"id,attr"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	Type    string   `xml:"type,attr"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+
+	// Payload and InnerXML are written like those of Message.
+	Payload  []any  `xml:",any"`
+	InnerXML string `xml:",innerxml"`
+}
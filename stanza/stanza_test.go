@@ -0,0 +1,38 @@
+package stanza
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+type ping struct {
+	XMLName xml.Name `xml:"urn:xmpp:ping ping"`
+}
+
+func TestMarshal(t *testing.T) {
+	for _, tt := range []struct {
+		v    any
+		want string
+	}{
+		{&Message{To: "romeo@example.net", Type: MessageChat, Lang: "en", Body: "a < b & 'c'"},
+			`<message to="romeo@example.net" type="chat" xml:lang="en"><body>a &lt; b &amp; &#39;c&#39;</body></message>`},
+		{&Message{ID: `x"/><iq>`, Thread: "t1", InnerXML: "<active xmlns='http://jabber.org/protocol/chatstates'/>"},
+			`<message id="x&#34;/&gt;&lt;iq&gt;"><thread>t1</thread><active xmlns='http://jabber.org/protocol/chatstates'/></message>`},
+		{&Presence{Type: PresenceUnavailable, Status: "</status>"},
+			`<presence type="unavailable"><status>&lt;/status&gt;</status></presence>`},
+		{&Presence{Show: "dnd", Priority: -1},
+			`<presence><show>dnd</show><priority>-1</priority></presence>`},
+		{&IQ{ID: "p1", To: "example.com", Type: IQGet, Payload: []any{&ping{}}},
+			`<iq id="p1" to="example.com" type="get"><ping xmlns="urn:xmpp:ping"></ping></iq>`},
+		{&IQ{ID: "r1", Type: IQResult},
+			`<iq id="r1" type="result"></iq>`},
+	} {
+		b, err := xml.Marshal(tt.v)
+		if err != nil {
+			t.Fatalf("Marshal(%+v): %v", tt.v, err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("Marshal(%+v) = %s; want %s", tt.v, b, tt.want)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// boshWait is the longest time in seconds the connection manager may
+	// hold a request before answering it.
+	boshWait = 60
+	// boshHold is the number of requests the connection manager may hold.
+	boshHold = 1
+)
+
+type boshBody struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+	SID       string   `xml:"sid,attr"`
+	Requests  string   `xml:"requests,attr"`
+	Type      string   `xml:"type,attr"`
+	Condition string   `xml:"condition,attr"`
+	From      string   `xml:"from,attr"`
+	Payload   []byte   `xml:",innerxml"`
+}
+
+// boshRequest is a queued request to the connection manager.
+type boshRequest struct {
+	rid     uint64
+	payload []byte
+	restart bool // Stream header, creates or restarts the session.
+	end     bool // Stream footer, terminates the session.
+}
+
+type boshAddr string
+
+func (a boshAddr) Network() string { return "bosh" }
+func (a boshAddr) String() string  { return string(a) }
+
+// boshConn adapts a XEP-0124 BOSH session to the stream oriented interface
+// used by the rest of the client as described in XEP-0206. Data written by
+// the client is sent in <body/> wrappers, stream headers create or restart
+// the session and the stream footer terminates it. The payload of the
+// responses is delivered in request order, a stream header is inserted for
+// session creation and restart responses. While idle, a request is always
+// held by the connection manager so it can push stanzas.
+type boshConn struct {
+	url    string
+	http   *http.Client
+	secure bool
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	changed      chan struct{} // Closed and replaced when the state changes.
+	sid          string
+	to           string
+	rid          uint64 // Last rid used.
+	next         uint64 // Rid of the next response to deliver.
+	requests     int    // Maximum number of concurrent requests.
+	outstanding  int
+	queue        []boshRequest
+	responses    map[uint64][]byte
+	buf          []byte
+	err          error
+	terminated   bool
+	readDeadline time.Time
+}
+
+// dialBOSH prepares a BOSH session with the connection manager at o.BOSHURL.
+// The session is created once the client sends the stream header.
+func dialBOSH(o *Options) (net.Conn, error) {
+	u, err := url.Parse(o.BOSHURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("bosh: unsupported URL scheme %q", u.Scheme)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: o.DialTimeout}).DialContext
+	if o.Dialer != nil {
+		// Like for TCP connections the proxy of the environment is only
+		// used without Dialer.
+		transport.DialContext = o.Dialer.DialContext
+		transport.Proxy = nil
+	}
+	if o.Proxy != nil {
+		transport.Proxy = http.ProxyURL(o.Proxy)
+	}
+	if o.TLSConfig != nil {
+		transport.TLSClientConfig = o.TLSConfig
+	} else {
+		transport.TLSClientConfig = DefaultConfig.Clone()
+		transport.TLSClientConfig.ServerName = u.Hostname()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &boshConn{
+		url:     u.String(),
+		http:    &http.Client{Transport: transport, Timeout: (boshWait + 30) * time.Second},
+		secure:  u.Scheme == "https",
+		ctx:     ctx,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		// The rid starts at a random value and is incremented by one for
+		// every request.
+		rid: uint64(rand.Uint32()),
+		// Without a requests attribute in the session creation response
+		// one request more than held is allowed, as XEP-0124 recommends.
+		requests:  boshHold + 1,
+		responses: make(map[uint64][]byte),
+	}, nil
+}
+
+// notify wakes up waiting readers. The caller must hold the lock.
+func (b *boshConn) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// fail stops the session with err. The caller must hold the lock.
+func (b *boshConn) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+	b.notify()
+}
+
+func (b *boshConn) Write(p []byte) (int, error) {
+	data := trimStreamData(p)
+	if len(data) == 0 {
+		// Whitespace keepalives are not needed as requests are held
+		// by the connection manager.
+		return len(p), nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	switch {
+	case isStreamHeader(data):
+		if b.to == "" {
+			var header struct {
+				To string `xml:"to,attr"`
+			}
+			xml.NewDecoder(bytes.NewReader(append(data, []byte("</stream:stream>")...))).Decode(&header)
+			b.to = header.To
+		}
+		b.queue = append(b.queue, boshRequest{restart: true})
+	case isStreamFooter(data):
+		b.queue = append(b.queue, boshRequest{end: true})
+	default:
+		// Stanzas written while a request is waiting are sent together.
+		if n := len(b.queue); n > 0 && !b.queue[n-1].restart && !b.queue[n-1].end {
+			b.queue[n-1].payload = append(b.queue[n-1].payload, qualifyStanza(data)...)
+		} else {
+			b.queue = append(b.queue, boshRequest{payload: qualifyStanza(data)})
+		}
+	}
+	b.send()
+	return len(p), nil
+}
+
+// send starts queued requests as long as the connection manager allows more
+// concurrent requests and starts an empty request if none is pending. The
+// caller must hold the lock.
+func (b *boshConn) send() {
+	for b.err == nil && !b.terminated {
+		var r boshRequest
+		switch {
+		case b.sid == "" && b.outstanding > 0:
+			// Wait for the session creation response.
+			return
+		case len(b.queue) > 0 && b.outstanding < b.requests:
+			r = b.queue[0]
+			b.queue = b.queue[1:]
+		case len(b.queue) == 0 && b.outstanding == 0 && b.sid != "":
+			// Poll so that the connection manager can push stanzas.
+		default:
+			return
+		}
+		b.rid++
+		r.rid = b.rid
+		if b.next == 0 {
+			b.next = r.rid
+		}
+		b.outstanding++
+		go b.do(r, b.body(r))
+		if r.end {
+			b.terminated = true
+		}
+	}
+}
+
+// body returns the <body/> wrapper for r. The caller must hold the lock.
+func (b *boshConn) body(r boshRequest) []byte {
+	switch {
+	case b.sid == "":
+		return fmt.Appendf(nil, "<body content='text/xml; charset=utf-8' hold='%d' rid='%d' to='%s' ver='1.11' wait='%d'"+
+			" xml:lang='en' xmpp:version='1.0' xmlns='%s' xmlns:xmpp='%s'/>",
+			boshHold, r.rid, xmlEscape(b.to), boshWait, XMPPNS_HTTPBIND, XMPPNS_XBOSH)
+	case r.restart:
+		return fmt.Appendf(nil, "<body rid='%d' sid='%s' to='%s' xml:lang='en' xmpp:restart='true' xmlns='%s' xmlns:xmpp='%s'/>",
+			r.rid, xmlEscape(b.sid), xmlEscape(b.to), XMPPNS_HTTPBIND, XMPPNS_XBOSH)
+	case r.end:
+		return fmt.Appendf(nil, "<body rid='%d' sid='%s' type='terminate' xmlns='%s'>%s</body>",
+			r.rid, xmlEscape(b.sid), XMPPNS_HTTPBIND, r.payload)
+	}
+	return fmt.Appendf(nil, "<body rid='%d' sid='%s' xmlns='%s'>%s</body>", r.rid, xmlEscape(b.sid), XMPPNS_HTTPBIND, r.payload)
+}
+
+// do sends a single request and queues the response for delivery.
+func (b *boshConn) do(r boshRequest, body []byte) {
+	resp, err := b.post(body)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outstanding--
+	if err != nil {
+		b.fail(err)
+		return
+	}
+	var data []byte
+	switch {
+	case resp.Type == "terminate" && !r.end && resp.Condition != "":
+		b.fail(errors.New("bosh: session terminated: " + resp.Condition))
+		return
+	case r.restart:
+		if b.sid == "" {
+			b.sid = resp.SID
+			if n, err := strconv.Atoi(resp.Requests); err == nil && n > 0 {
+				b.requests = n
+			}
+		}
+		data = fmt.Appendf(nil, "<stream:stream xmlns='%s' xmlns:stream='%s' from='%s' id='%s' version='1.0'>",
+			XMPPNS_CLIENT, XMPPNS_STREAM, xmlEscape(resp.From), xmlEscape(b.sid))
+	}
+	data = append(data, resp.Payload...)
+	if resp.Type == "terminate" || r.end {
+		b.terminated = true
+		data = append(data, "</stream:stream>"...)
+	}
+	b.responses[r.rid] = data
+	for {
+		data, ok := b.responses[b.next]
+		if !ok {
+			break
+		}
+		delete(b.responses, b.next)
+		b.buf = append(b.buf, data...)
+		b.next++
+	}
+	if b.terminated && b.outstanding == 0 && b.err == nil {
+		b.err = io.EOF
+	}
+	b.notify()
+	b.send()
+}
+
+func (b *boshConn) post(body []byte) (*boshBody, error) {
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bosh: unexpected HTTP status %s", resp.Status)
+	}
+	v := new(boshBody)
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, errors.New("bosh: unmarshal <body>: " + err.Error())
+	}
+	return v, nil
+}
+
+func (b *boshConn) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if len(b.buf) > 0 {
+			n := copy(p, b.buf)
+			b.buf = b.buf[n:]
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.err != nil {
+			err := b.err
+			b.mu.Unlock()
+			return 0, err
+		}
+		changed := b.changed
+		deadline := b.readDeadline
+		b.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-changed:
+			t.Stop()
+		case <-t.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Close aborts all pending requests. The session should be terminated by
+// writing the stream footer first.
+func (b *boshConn) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cancel()
+	b.terminated = true
+	if b.err == nil {
+		b.err = net.ErrClosed
+	}
+	b.notify()
+	return nil
+}
+
+func (b *boshConn) LocalAddr() net.Addr  { return boshAddr("") }
+func (b *boshConn) RemoteAddr() net.Addr { return boshAddr(b.url) }
+
+func (b *boshConn) SetDeadline(t time.Time) error {
+	return b.SetReadDeadline(t)
+}
+
+func (b *boshConn) SetReadDeadline(t time.Time) error {
+	b.mu.Lock()
+	b.readDeadline = t
+	b.notify()
+	b.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline has no effect, writes only queue requests.
+func (b *boshConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
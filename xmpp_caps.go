@@ -0,0 +1,397 @@
+package xmpp
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"hash"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmppo/go-xmpp/stanza"
+)
+
+// DefaultCapsNode identifies go-xmpp in the XEP-0115 caps of clients that
+// do not set Options.CapsNode.
+const DefaultCapsNode = "https://github.com/xmppo/go-xmpp"
+
+// capsTimeout limits the disco#info query resolving unknown caps.
+const capsTimeout = 30 * time.Second
+
+func init() {
+	RegisterExtension(xml.Name{Space: XMPPNS_CAPS, Local: "c"}, func() any { return new(Caps) })
+	RegisterExtension(xml.Name{Space: XMPPNS_ECAPS2, Local: "c"}, func() any { return new(Caps2) })
+	capsOn := func(o *Options) bool { return !o.NoCaps }
+	registerFeature(XMPPNS_CAPS, capsOn)
+	registerFeature(XMPPNS_ECAPS2, capsOn)
+}
+
+// Caps is the XEP-0115: Entity Capabilities element of a presence. Ver is
+// the base64 encoded hash of the disco#info of the entity computed with
+// the algorithm Hash, e.g. "sha-1".
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+// Caps2 is the XEP-0390: Entity Capabilities 2.0 element of a presence.
+type Caps2 struct {
+	XMLName xml.Name   `xml:"urn:xmpp:caps c"`
+	Hashes  []CapsHash `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// CapsHash is a base64 encoded hash of the disco#info of an entity, see
+// XEP-0300 for the names of the algorithms.
+type CapsHash struct {
+	Algo  string `xml:"algo,attr"`
+	Value string `xml:",chardata"`
+}
+
+// capsHashes are the hash algorithms supported for verification.
+var capsHashes = map[string]func() hash.Hash{
+	"sha-1":    sha1.New,
+	"sha-256":  sha256.New,
+	"sha-512":  sha512.New,
+	"sha3-256": func() hash.Hash { return sha3.New256() },
+	"sha3-512": func() hash.Hash { return sha3.New512() },
+}
+
+// CapsCache keeps the disco#info of entities by their caps, see
+// Options.CapsCache. The key is the name of the hash algorithm and the
+// base64 encoded hash separated by a dot, e.g. "sha-256.kzBZbkqJ...".
+// Only verified information is stored. A CapsCache may be shared by
+// several clients and must be safe for concurrent use.
+type CapsCache interface {
+	Get(key string) (DiscoInfo, bool)
+	Put(key string, info DiscoInfo)
+}
+
+// MemoryCapsCache is a CapsCache keeping the information in memory. The
+// zero value is ready to use.
+type MemoryCapsCache struct {
+	mu sync.Mutex
+	m  map[string]DiscoInfo
+}
+
+func (c *MemoryCapsCache) Get(key string) (DiscoInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, ok := c.m[key]
+	return info, ok
+}
+
+func (c *MemoryCapsCache) Put(key string, info DiscoInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]DiscoInfo)
+	}
+	c.m[key] = info
+}
+
+// capsState tracks the caps of the entities seen by a client.
+type capsState struct {
+	sync.Mutex
+	entities map[string]string // Cache keys by full JID.
+	pending  map[string]bool   // Cache keys being resolved.
+	cache    MemoryCapsCache   // Used if Options.CapsCache is not set.
+}
+
+// CapsVer returns the XEP-0115 verification string of info computed with
+// the hash h, e.g. sha1.New.
+func CapsVer(info DiscoInfo, h func() hash.Hash) string {
+	var b strings.Builder
+	identities := slices.Clone(info.Identities)
+	slices.SortFunc(identities, func(a, b DiscoIdentity) int {
+		return cmp.Or(strings.Compare(a.Category, b.Category), strings.Compare(a.Type, b.Type),
+			strings.Compare(a.Lang, b.Lang), strings.Compare(a.Name, b.Name))
+	})
+	for _, id := range identities {
+		b.WriteString(id.Category + "/" + id.Type + "/" + id.Lang + "/" + id.Name + "<")
+	}
+	features := slices.Clone(info.Features)
+	slices.Sort(features)
+	for _, f := range features {
+		b.WriteString(f + "<")
+	}
+	forms := slices.Clone(info.Forms)
+	slices.SortFunc(forms, func(a, b DiscoX) int { return strings.Compare(formType(a), formType(b)) })
+	for _, form := range forms {
+		if formType(form) == "" {
+			continue
+		}
+		b.WriteString(formType(form) + "<")
+		fields := slices.Clone(form.Field)
+		slices.SortFunc(fields, func(a, b DiscoXField) int { return strings.Compare(a.Var, b.Var) })
+		for _, f := range fields {
+			if f.Var == "FORM_TYPE" {
+				continue
+			}
+			b.WriteString(f.Var + "<")
+			values := slices.Clone(f.Value)
+			slices.Sort(values)
+			for _, v := range values {
+				b.WriteString(v + "<")
+			}
+		}
+	}
+	return hashString(h, b.String())
+}
+
+// Caps2Hash returns the XEP-0390 hash of info computed with h, e.g.
+// sha256.New.
+func Caps2Hash(info DiscoInfo, h func() hash.Hash) string {
+	var b strings.Builder
+	features := slices.Clone(info.Features)
+	slices.Sort(features)
+	for _, f := range features {
+		b.WriteString(f + "\x1f")
+	}
+	b.WriteString("\x1c")
+	var identities []string
+	for _, id := range info.Identities {
+		identities = append(identities, id.Category+"\x1f"+id.Type+"\x1f"+id.Lang+"\x1f"+id.Name+"\x1f\x1e")
+	}
+	slices.Sort(identities)
+	b.WriteString(strings.Join(identities, "") + "\x1c")
+	var forms []string
+	for _, form := range info.Forms {
+		var fields []string
+		for _, f := range form.Field {
+			values := slices.Clone(f.Value)
+			slices.Sort(values)
+			field := f.Var + "\x1f"
+			for _, v := range values {
+				field += v + "\x1f"
+			}
+			fields = append(fields, field+"\x1e")
+		}
+		slices.Sort(fields)
+		forms = append(forms, strings.Join(fields, "")+"\x1d")
+	}
+	slices.Sort(forms)
+	b.WriteString(strings.Join(forms, "") + "\x1c")
+	return hashString(h, b.String())
+}
+
+func hashString(h func() hash.Hash, s string) string {
+	d := h()
+	d.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(d.Sum(nil))
+}
+
+// formType returns the value of the hidden FORM_TYPE field of form.
+func formType(form DiscoX) string {
+	for _, f := range form.Field {
+		if f.Var == "FORM_TYPE" && f.Type == "hidden" && len(f.Value) > 0 {
+			return f.Value[0]
+		}
+	}
+	return ""
+}
+
+// capsValid reports whether info can be trusted for caps. XEP-0115
+// section 5.4 rejects duplicate identities and features and forms with
+// the same FORM_TYPE, which could be used to forge a verification string.
+func capsValid(info DiscoInfo) bool {
+	seen := make(map[DiscoIdentity]bool)
+	for _, id := range info.Identities {
+		if seen[id] {
+			return false
+		}
+		seen[id] = true
+	}
+	features := slices.Clone(info.Features)
+	slices.Sort(features)
+	if len(slices.Compact(features)) != len(info.Features) {
+		return false
+	}
+	types := make(map[string]bool)
+	for _, form := range info.Forms {
+		t := formType(form)
+		if t != "" && types[t] {
+			return false
+		}
+		types[t] = true
+	}
+	return true
+}
+
+// capsKey returns the cache key of a hash, see CapsCache.
+func capsKey(algo, value string) string {
+	return algo + "." + value
+}
+
+// capsOf returns the cache key of the caps of a presence and the node to
+// query to resolve them. XEP-0390 caps are preferred. Legacy XEP-0115
+// caps without hash attribute cannot be verified and are ignored.
+func capsOf(p Presence) (key, node string) {
+	var caps2 Caps2
+	if p.Extension(&caps2) {
+		for _, h := range caps2.Hashes {
+			if _, ok := capsHashes[h.Algo]; ok && h.Algo != "sha-1" {
+				return capsKey(h.Algo, h.Value), XMPPNS_ECAPS2 + "#" + h.Algo + "." + h.Value
+			}
+		}
+	}
+	var caps Caps
+	if p.Extension(&caps) {
+		if _, ok := capsHashes[caps.Hash]; ok {
+			return capsKey(caps.Hash, caps.Ver), caps.Node + "#" + caps.Ver
+		}
+	}
+	return "", ""
+}
+
+// verifyCaps reports whether info matches the cache key.
+func verifyCaps(key string, info DiscoInfo, ecaps2 bool) bool {
+	algo, value, _ := strings.Cut(key, ".")
+	h, ok := capsHashes[algo]
+	if !ok || !capsValid(info) {
+		return false
+	}
+	if ecaps2 {
+		return Caps2Hash(info, h) == value
+	}
+	return CapsVer(info, h) == value
+}
+
+// capsCache returns Options.CapsCache or the cache of the client.
+func (c *Client) capsCache() CapsCache {
+	if c.Options != nil && c.Options.CapsCache != nil {
+		return c.Options.CapsCache
+	}
+	return &c.caps.cache
+}
+
+// capsEnabled reports whether the client sends and processes caps.
+func (c *Client) capsEnabled() bool {
+	return c.Options == nil || !c.Options.NoCaps
+}
+
+// capsNode returns the XEP-0115 node of the client.
+func (c *Client) capsNode() string {
+	if c.Options != nil && c.Options.CapsNode != "" {
+		return c.Options.CapsNode
+	}
+	return DefaultCapsNode
+}
+
+// discoInfo returns the root node of the disco registry, which is
+// announced with caps.
+func (c *Client) discoInfo() DiscoInfo {
+	info, _ := c.Disco().Info("")
+	return info
+}
+
+// capsPayload returns the caps elements of available presence sent by the
+// client.
+func (c *Client) capsPayload() []any {
+	if !c.capsEnabled() {
+		return nil
+	}
+	info := c.discoInfo()
+	return []any{
+		&Caps{Hash: "sha-1", Node: c.capsNode(), Ver: CapsVer(info, sha1.New)},
+		&Caps2{Hashes: []CapsHash{{Algo: "sha-256", Value: Caps2Hash(info, sha256.New)}}},
+	}
+}
+
+// isCapsNode reports whether node is one of the disco#info nodes of the
+// caps sent by the client.
+func (c *Client) isCapsNode(node string) bool {
+	if !c.capsEnabled() {
+		return false
+	}
+	info := c.discoInfo()
+	return node == c.capsNode()+"#"+CapsVer(info, sha1.New) ||
+		node == XMPPNS_ECAPS2+"#sha-256."+Caps2Hash(info, sha256.New)
+}
+
+// handleCaps records the caps of a received presence and resolves unknown
+// caps in the background. The disco#info reply is received by Recv like
+// the replies of SendIQ, so resolving only makes progress while the
+// application keeps calling Recv.
+func (c *Client) handleCaps(p Presence) {
+	if !c.capsEnabled() || p.From == "" {
+		return
+	}
+	from := parseJID(p.From).String()
+	var key, node string
+	switch p.Type {
+	case "":
+		key, node = capsOf(p)
+	case "unavailable", "error":
+	default:
+		return
+	}
+	c.caps.Lock()
+	if key == "" {
+		delete(c.caps.entities, from)
+		c.caps.Unlock()
+		return
+	}
+	if c.caps.entities == nil {
+		c.caps.entities = make(map[string]string)
+		c.caps.pending = make(map[string]bool)
+	}
+	c.caps.entities[from] = key
+	if c.caps.pending[key] {
+		c.caps.Unlock()
+		return
+	}
+	if _, ok := c.capsCache().Get(key); ok {
+		c.caps.Unlock()
+		return
+	}
+	c.caps.pending[key] = true
+	c.caps.Unlock()
+	go c.resolveCaps(p.From, node, key)
+}
+
+// resolveCaps queries the disco#info of the caps key from the entity and
+// caches it if it matches the hash.
+func (c *Client) resolveCaps(from, node, key string) {
+	defer func() {
+		c.caps.Lock()
+		delete(c.caps.pending, key)
+		c.caps.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), capsTimeout)
+	defer cancel()
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: from, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_INFO, Local: "query"}, Node: node}}})
+	if err != nil {
+		c.logger().Debug("resolving caps failed", "from", from, "node", node, "err", err)
+		return
+	}
+	info, err := discoInfoFromIQ(v)
+	if err != nil || !verifyCaps(key, info, strings.HasPrefix(node, XMPPNS_ECAPS2+"#")) {
+		c.logger().Warn("caps verification failed", "from", from, "node", node)
+		return
+	}
+	c.capsCache().Put(key, info)
+}
+
+// Capabilities returns the disco#info of the entity addr, a full JID, if
+// its last available presence carried caps that are cached. Unknown caps
+// are resolved in the background when the presence is received, so the
+// information may not be available right away.
+func (c *Client) Capabilities(addr string) (DiscoInfo, bool) {
+	c.caps.Lock()
+	key, ok := c.caps.entities[parseJID(addr).String()]
+	c.caps.Unlock()
+	if !ok {
+		return DiscoInfo{}, false
+	}
+	return c.capsCache().Get(key)
+}
@@ -0,0 +1,191 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type componentHandshake struct {
+	XMLName xml.Name `xml:"jabber:component:accept handshake"`
+}
+
+// ComponentOptions are used to connect to a server as an external component
+// as described in XEP-0114: Jabber Component Protocol.
+type ComponentOptions struct {
+	// Host is the component listener of the server as "hostname:port".
+	Host string
+
+	// Domain is the JID of the component, e.g. "gateway.example.com".
+	Domain string
+
+	// Secret is the shared secret configured on the server for Domain.
+	Secret string
+
+	// DialTimeout is the time limit for establishing a connection. A
+	// DialTimeout of zero means no timeout.
+	DialTimeout time.Duration
+
+	// Dialer opens the TCP connection to the server. Defaults to a
+	// net.Dialer using DialTimeout.
+	Dialer ContextDialer
+
+	// WriteTimeout limits the time a single write may take, see
+	// Options.WriteTimeout.
+	WriteTimeout time.Duration
+
+	// SendQueueSize enables asynchronous sending, see Options.SendQueueSize.
+	SendQueueSize int
+
+	// Logger receives lifecycle events and stanzas, see Options.Logger.
+	Logger *slog.Logger
+
+	// Debug output
+	Debug bool
+
+	// DebugWriter specifies where the debug output is written to
+	DebugWriter io.Writer
+}
+
+// NewComponent connects to the server and authenticates as a component. The
+// returned Client is used like a c2s client, its JID is the component domain.
+// As a component has no bound JID, message, presence and iq stanzas
+// without a from attribute are sent from the component domain.
+func (co ComponentOptions) NewComponent() (*Client, error) {
+	return co.NewComponentContext(context.Background())
+}
+
+// NewComponentContext is like NewComponent, but aborts the connection setup
+// if ctx is done first.
+func (co ComponentOptions) NewComponentContext(ctx context.Context) (*Client, error) {
+	if co.Host == "" || co.Domain == "" {
+		return nil, errors.New("component: Host and Domain are required")
+	}
+	o := Options{
+		Host:          co.Host,
+		NoTLS:         true,
+		DialTimeout:   co.DialTimeout,
+		Dialer:        co.Dialer,
+		WriteTimeout:  co.WriteTimeout,
+		SendQueueSize: co.SendQueueSize,
+		Logger:        co.Logger,
+		Debug:         co.Debug,
+		DebugWriter:   co.DebugWriter,
+	}
+	conn, err := o.connect(ctx, co.Host)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Client)
+	c.conn = conn
+	c.Options = &o
+	c.component = true
+	c.log = o.logger()
+	c.jid = co.Domain
+	c.domain = co.Domain
+
+	c.setup = &connSetup{ctx: ctx}
+	c.setup.watch(conn)
+	stop := context.AfterFunc(ctx, c.setup.abort)
+	err = c.componentHandshake(co.Secret)
+	aborted := !stop()
+	c.setup.watch(nil)
+	c.setup = nil
+	if aborted {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if o.SendQueueSize > 0 {
+		c.startWriter(o.SendQueueSize)
+	}
+	o.SoftwareName = "go-xmpp"
+	o.SoftwareVersion = Version
+	return c, nil
+}
+
+// componentHandshake opens a jabber:component:accept stream and
+// authenticates with the shared secret.
+func (c *Client) componentHandshake(secret string) error {
+	c.resetStream(c.Options)
+	_, err := c.writef("<?xml version='1.0'?>"+
+		"<stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>\n",
+		XMPPNS_COMPONENT_ACCEPT, XMPPNS_STREAM, xmlEscape(c.domain))
+	if err != nil {
+		return err
+	}
+	se, err := c.nextStart()
+	if err != nil {
+		return err
+	}
+	if se.Name.Space != XMPPNS_STREAM || se.Name.Local != "stream" {
+		return fmt.Errorf("expected <stream> but got <%v> in %v", se.Name.Local, se.Name.Space)
+	}
+	var id string
+	for _, a := range se.Attr {
+		if a.Name.Space == "" && a.Name.Local == "id" {
+			id = a.Value
+		}
+	}
+	if id == "" {
+		return errors.New("component: stream has no id")
+	}
+	if _, err := c.writef("<handshake>%x</handshake>\n", sha1.Sum([]byte(id+secret))); err != nil {
+		return err
+	}
+	name, val, err := c.next()
+	if err != nil {
+		return err
+	}
+	switch v := val.(type) {
+	case *componentHandshake:
+		return nil
+	case *streamError:
+		return fmt.Errorf("component: handshake failed: %w", v.streamError())
+	default:
+		return errors.New("component: expected <handshake>, got <" + name.Local + "> in " + name.Space)
+	}
+}
+
+// messageFrom returns the from address of an outgoing message: Chat.From
+// for components, otherwise none.
+func (c *Client) messageFrom(chat Chat) string {
+	if !c.component {
+		return ""
+	}
+	return chat.From
+}
+
+// componentFrom adds a from attribute with the component domain to message,
+// presence and iq stanzas that do not have one.
+func (c *Client) componentFrom(stanza string) string {
+	trimmed := strings.TrimLeft(stanza, " \t\r\n")
+	for _, name := range []string{"<message", "<presence", "<iq"} {
+		rest, ok := strings.CutPrefix(trimmed, name)
+		if !ok || rest == "" || !strings.ContainsRune(" \t\r\n/>", rune(rest[0])) {
+			continue
+		}
+		t, err := xml.NewDecoder(strings.NewReader(trimmed)).RawToken()
+		if err != nil {
+			return stanza
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			for _, a := range se.Attr {
+				if a.Name.Space == "" && a.Name.Local == "from" {
+					return stanza
+				}
+			}
+		}
+		return fmt.Sprintf("%s from='%s'%s", name, xmlEscape(c.jid), rest)
+	}
+	return stanza
+}
@@ -0,0 +1,87 @@
+package xmpp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// connSetup aborts blocked reads and writes during the connection setup by
+// expiring the deadline of the connection when its context is done.
+type connSetup struct {
+	ctx     context.Context
+	mu      sync.Mutex
+	conn    net.Conn
+	aborted bool
+}
+
+// watch makes conn the connection to abort. A nil conn ends the setup and
+// clears the deadline again if the setup was aborted.
+func (s *connSetup) watch(conn net.Conn) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted && s.conn != nil {
+		s.conn.SetDeadline(time.Time{})
+	}
+	s.conn = conn
+	if s.aborted && conn != nil {
+		conn.SetDeadline(time.Now())
+	}
+}
+
+func (s *connSetup) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	if s.conn != nil {
+		s.conn.SetDeadline(time.Now())
+	}
+}
+
+// setupContext returns the context of the connection setup in progress.
+func (c *Client) setupContext() context.Context {
+	if c.setup == nil {
+		return context.Background()
+	}
+	return c.setup.ctx
+}
+
+// recvResult is the outcome of a Recv.
+type recvResult struct {
+	stanza interface{}
+	err    error
+}
+
+// RecvContext waits to receive the next XMPP stanza like Recv. If ctx is done
+// first it returns ctx.Err(). The interrupted read continues in the
+// background, so the state of the XML decoder stays consistent, and its
+// result is returned by the next call to Recv or RecvContext.
+func (c *Client) RecvContext(ctx context.Context) (stanza interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return Chat{}, err
+	}
+	c.recvMutex.Lock()
+	pending := c.recvPending
+	if pending == nil {
+		pending = make(chan recvResult, 1)
+		c.recvPending = pending
+		go func() {
+			stanza, err := c.recv()
+			pending <- recvResult{stanza, err}
+		}()
+	}
+	c.recvMutex.Unlock()
+	select {
+	case r := <-pending:
+		c.recvMutex.Lock()
+		c.recvPending = nil
+		c.recvMutex.Unlock()
+		return r.stanza, r.err
+	case <-ctx.Done():
+		return Chat{}, ctx.Err()
+	}
+}
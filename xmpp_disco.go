@@ -2,6 +2,9 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"slices"
+
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
 type clientDiscoFeature struct {
@@ -13,6 +16,7 @@ type clientDiscoIdentity struct {
 	XMLName  xml.Name `xml:"identity"`
 	Category string   `xml:"category,attr"`
 	Type     string   `xml:"type,attr"`
+	Lang     string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
 	Name     string   `xml:"name,attr"`
 }
 
@@ -39,6 +43,7 @@ type DiscoIdentity struct {
 	Category string
 	Type     string
 	Name     string
+	Lang     string // xml:lang of Name.
 }
 
 type DiscoItem struct {
@@ -91,6 +96,7 @@ func clientIdentitiesToReturn(identities []clientDiscoIdentity) []DiscoIdentity
 			Category: id.Category,
 			Type:     id.Type,
 			Name:     id.Name,
+			Lang:     id.Lang,
 		})
 	}
 
@@ -109,3 +115,149 @@ func clientDiscoItemsToReturn(items []clientDiscoItem) []DiscoItem {
 
 	return ret
 }
+
+func discoItemsFromIQ(v *clientIQ) (DiscoItems, error) {
+	var itemsQuery clientDiscoItemsQuery
+	err := xml.Unmarshal(v.InnerXML, &itemsQuery)
+	if err != nil {
+		return DiscoItems{}, err
+	}
+
+	return DiscoItems{
+		ID:    v.ID,
+		Jid:   v.From,
+		Items: clientDiscoItemsToReturn(itemsQuery.Items),
+	}, nil
+}
+
+func discoResultFromIQ(v *clientIQ) (DiscoResult, error) {
+	var disco clientDiscoQuery
+	err := xml.Unmarshal(v.InnerXML, &disco)
+	if err != nil {
+		return DiscoResult{}, err
+	}
+
+	return DiscoResult{
+		ID:         v.ID,
+		From:       v.From,
+		To:         v.To,
+		Features:   clientFeaturesToReturn(disco.Features),
+		Identities: clientIdentitiesToReturn(disco.Identities),
+		X:          disco.X,
+	}, nil
+}
+
+// DiscoInfo is the information about an entity returned for disco#info
+// queries: its identities, features and XEP-0128 extended information
+// forms.
+type DiscoInfo struct {
+	Identities []DiscoIdentity
+	Features   []string
+	Forms      []DiscoX
+}
+
+// HasFeature reports whether feature is among the features.
+func (i DiscoInfo) HasFeature(feature string) bool {
+	return slices.Contains(i.Features, feature)
+}
+
+// discoInfoFromIQ returns the information of a disco#info result.
+func discoInfoFromIQ(v *clientIQ) (DiscoInfo, error) {
+	r, err := discoResultFromIQ(v)
+	if err != nil {
+		return DiscoInfo{}, err
+	}
+	return DiscoInfo{Identities: r.Identities, Features: r.Features, Forms: r.X}, nil
+}
+
+// queryNode returns the node attribute of the query of an IQ.
+func queryNode(v *clientIQ) string {
+	for _, a := range v.Query.Attr {
+		if a.Name.Space == "" && a.Name.Local == "node" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// discoInfoQuery is a disco#info result to send.
+type discoInfoQuery struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string          `xml:"node,attr,omitempty"`
+	Identities []discoIdentity `xml:"identity"`
+	Features   []discoFeature  `xml:"feature"`
+	Forms      []dataForm      `xml:"jabber:x:data x"`
+}
+
+type discoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Name     string `xml:"name,attr,omitempty"`
+}
+
+type discoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+// dataForm is a XEP-0004 data form of type result.
+type dataForm struct {
+	Type   string          `xml:"type,attr"`
+	Fields []dataFormField `xml:"field"`
+}
+
+type dataFormField struct {
+	Var    string   `xml:"var,attr"`
+	Type   string   `xml:"type,attr,omitempty"`
+	Values []string `xml:"value"`
+}
+
+// discoInfoQuery returns the disco#info result for node with the
+// information i.
+func (i DiscoInfo) discoInfoQuery(node string) *discoInfoQuery {
+	q := &discoInfoQuery{Node: node}
+	for _, id := range i.Identities {
+		q.Identities = append(q.Identities, discoIdentity{Category: id.Category, Type: id.Type, Lang: id.Lang, Name: id.Name})
+	}
+	for _, f := range i.Features {
+		q.Features = append(q.Features, discoFeature{Var: f})
+	}
+	for _, x := range i.Forms {
+		form := dataForm{Type: "result"}
+		for _, f := range x.Field {
+			form.Fields = append(form.Fields, dataFormField{Var: f.Var, Type: f.Type, Values: f.Value})
+		}
+		q.Forms = append(q.Forms, form)
+	}
+	return q
+}
+
+// discoItemsQuery is a disco#items result to send.
+type discoItemsQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Items   []discoItem `xml:"item"`
+}
+
+type discoItem struct {
+	Jid  string `xml:"jid,attr"`
+	Node string `xml:"node,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+// sendDiscoItems answers the disco#items query v with items.
+func (c *Client) sendDiscoItems(v *clientIQ, items []DiscoItem) error {
+	q := &discoItemsQuery{Node: queryNode(v)}
+	for _, item := range items {
+		q.Items = append(q.Items, discoItem{Jid: item.Jid, Node: item.Node, Name: item.Name})
+	}
+	_, err := c.encode(&stanza.IQ{To: v.From, ID: v.ID, Type: IQTypeResult, Payload: []any{q}})
+	return err
+}
+
+// sendDiscoInfo answers the disco#info query v with info.
+func (c *Client) sendDiscoInfo(v *clientIQ, info DiscoInfo) error {
+	_, err := c.encode(&stanza.IQ{To: v.From, ID: v.ID, Type: IQTypeResult,
+		Payload: []any{info.discoInfoQuery(queryNode(v))}})
+	return err
+}
@@ -0,0 +1,215 @@
+package xmpp
+
+import (
+	"slices"
+	"sync"
+)
+
+// DiscoRegistry holds the XEP-0030 service discovery information of the
+// client per node, see Client.Disco. Recv answers disco#info and
+// disco#items queries from it. The root node is "". It is safe for
+// concurrent use. The zero value is ready to use.
+type DiscoRegistry struct {
+	mu    sync.RWMutex
+	info  map[string]*DiscoInfo
+	items map[string][]DiscoItem
+}
+
+// libraryFeature is a feature implemented by the library, announced at
+// the root node if enabled returns true for the options of the client.
+type libraryFeature struct {
+	feature string
+	enabled func(o *Options) bool
+}
+
+var libraryFeatures []libraryFeature
+
+// registerFeature is called by init functions of the files implementing
+// feature. A nil enabled announces it for every client.
+func registerFeature(feature string, enabled func(o *Options) bool) {
+	libraryFeatures = append(libraryFeatures, libraryFeature{feature: feature, enabled: enabled})
+}
+
+func init() {
+	registerFeature(XMPPNS_DISCO_INFO, nil)
+	registerFeature(XMPPNS_DISCO_ITEMS, nil)
+}
+
+// node returns the information of node, creating it if needed. r.mu must
+// be held.
+func (r *DiscoRegistry) node(node string) *DiscoInfo {
+	if r.info == nil {
+		r.info = make(map[string]*DiscoInfo)
+	}
+	if r.info[node] == nil {
+		r.info[node] = &DiscoInfo{}
+	}
+	return r.info[node]
+}
+
+// SetInfo replaces the information of node.
+func (r *DiscoRegistry) SetInfo(node string, info DiscoInfo) {
+	info = cloneDiscoInfo(info)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.node(node) = info
+}
+
+// Info returns the information of node and whether the node exists.
+func (r *DiscoRegistry) Info(node string) (DiscoInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	info, ok := r.info[node]
+	if !ok {
+		return DiscoInfo{}, false
+	}
+	return cloneDiscoInfo(*info), true
+}
+
+// AddIdentity adds an identity to node unless it is already there.
+func (r *DiscoRegistry) AddIdentity(node string, identity DiscoIdentity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.node(node)
+	if !slices.Contains(info.Identities, identity) {
+		info.Identities = append(info.Identities, identity)
+	}
+}
+
+// AddFeatures adds features to node. The features are kept sorted and
+// without duplicates.
+func (r *DiscoRegistry) AddFeatures(node string, features ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.node(node)
+	info.Features = append(info.Features, features...)
+	slices.Sort(info.Features)
+	info.Features = slices.Compact(info.Features)
+}
+
+// RemoveFeatures removes features from node.
+func (r *DiscoRegistry) RemoveFeatures(node string, features ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.info[node]; ok {
+		info.Features = slices.DeleteFunc(info.Features, func(f string) bool {
+			return slices.Contains(features, f)
+		})
+	}
+}
+
+// SetForm adds a XEP-0128 extended information form to node, replacing
+// the form with the same FORM_TYPE.
+func (r *DiscoRegistry) SetForm(node string, form DiscoX) {
+	form = cloneDiscoX(form)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.node(node)
+	typ := formType(form)
+	for i, x := range info.Forms {
+		if formType(x) == typ {
+			info.Forms[i] = form
+			return
+		}
+	}
+	info.Forms = append(info.Forms, form)
+}
+
+// SetItems replaces the disco#items of node.
+func (r *DiscoRegistry) SetItems(node string, items []DiscoItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.items == nil {
+		r.items = make(map[string][]DiscoItem)
+	}
+	r.items[node] = slices.Clone(items)
+}
+
+// Items returns the disco#items of node and whether the node exists. A
+// node with information but without items exists with no items.
+func (r *DiscoRegistry) Items(node string) ([]DiscoItem, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	items, ok := r.items[node]
+	if !ok {
+		_, ok = r.info[node]
+	}
+	return slices.Clone(items), ok
+}
+
+// RemoveNode removes the information and the items of node.
+func (r *DiscoRegistry) RemoveNode(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.info, node)
+	delete(r.items, node)
+}
+
+func cloneDiscoInfo(info DiscoInfo) DiscoInfo {
+	info.Identities = slices.Clone(info.Identities)
+	info.Features = slices.Clone(info.Features)
+	forms := info.Forms
+	info.Forms = nil
+	for _, x := range forms {
+		info.Forms = append(info.Forms, cloneDiscoX(x))
+	}
+	return info
+}
+
+func cloneDiscoX(x DiscoX) DiscoX {
+	x.Field = slices.Clone(x.Field)
+	for i := range x.Field {
+		x.Field[i].Value = slices.Clone(x.Field[i].Value)
+	}
+	return x
+}
+
+// Disco returns the service discovery information of the client. The
+// root node initially has the identity of Options.Identity, the features
+// implemented by the library that are enabled in the options and
+// Options.Features. Changes to the root node are announced with the caps
+// of the next presence sent.
+func (c *Client) Disco() *DiscoRegistry {
+	c.discoOnce.Do(func() {
+		o := c.Options
+		if o == nil {
+			o = &Options{}
+		}
+		identity := DiscoIdentity{Category: "client", Type: "bot", Name: "go-xmpp"}
+		if o.Identity.Category != "" {
+			identity = o.Identity
+		} else if o.SoftwareName != "" {
+			identity.Name = o.SoftwareName
+		}
+		c.disco.AddIdentity("", identity)
+		for _, f := range libraryFeatures {
+			if f.enabled == nil || f.enabled(o) {
+				c.disco.AddFeatures("", f.feature)
+			}
+		}
+		c.disco.AddFeatures("", o.Features...)
+	})
+	return &c.disco
+}
+
+// answerDisco answers the disco#info or disco#items get v from the
+// registry, or with item-not-found for an unknown node.
+func (c *Client) answerDisco(v *clientIQ) error {
+	node := queryNode(v)
+	if v.Query.XMLName.Space == XMPPNS_DISCO_ITEMS {
+		items, ok := c.Disco().Items(node)
+		if !ok {
+			return c.sendIQError(v, &StanzaError{Type: "cancel", Condition: ErrItemNotFound.Condition})
+		}
+		return c.sendDiscoItems(v, items)
+	}
+	lookup := node
+	if c.isCapsNode(node) {
+		lookup = ""
+	}
+	info, ok := c.Disco().Info(lookup)
+	if !ok {
+		return c.sendIQError(v, &StanzaError{Type: "cancel", Condition: ErrItemNotFound.Condition})
+	}
+	return c.sendDiscoInfo(v, info)
+}
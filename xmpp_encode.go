@@ -0,0 +1,51 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Encode sends a stanza marshalled with encoding/xml, usually a
+// *stanza.Message, *stanza.Presence or *stanza.IQ. Stanzas larger than
+// LimitMaxBytes are refused.
+func (c *Client) Encode(v interface{}) error {
+	_, err := c.encode(v)
+	return err
+}
+
+func (c *Client) encode(v interface{}) (n int, err error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+	if c.LimitMaxBytes != 0 && len(b) > c.LimitMaxBytes {
+		return 0, fmt.Errorf("stanza size (%v bytes) exceeds server limit (%v bytes)",
+			len(b), c.LimitMaxBytes)
+	}
+	return c.sendStanza(string(b))
+}
+
+// oobX is the XEP-0066 out-of-band data of a sent message.
+type oobX struct {
+	XMLName xml.Name `xml:"jabber:x:oob x"`
+	Url     string   `xml:"url"`
+	Desc    string   `xml:"desc,omitempty"`
+}
+
+// xhtmlIM is the XEP-0071 HTML body of a sent message. The body is sent
+// as is.
+type xhtmlIM struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/xhtml-im html"`
+	Body    struct {
+		XMLName  xml.Name `xml:"http://www.w3.org/1999/xhtml body"`
+		InnerXML string   `xml:",innerxml"`
+	}
+}
+
+// emptyElement is a payload element without content, e.g. a ping or a
+// disco#info request.
+type emptyElement struct {
+	XMLName xml.Name
+	Node    string `xml:"node,attr,omitempty"`
+}
@@ -1,9 +1,301 @@
 package xmpp
 
 import (
+	"encoding/xml"
 	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
+// StanzaError is the error of a message, presence or IQ of type error as
+// described in RFC 6120 section 8.3. It is returned by SendIQ and set in the
+// StanzaError field of the values returned by Recv.
+//
+// Errors can be compared with the sentinel conditions using errors.Is:
+//
+//	if errors.Is(err, xmpp.ErrItemNotFound) { ... }
+type StanzaError struct {
+	// Type is one of auth, cancel, continue, modify or wait.
+	Type string
+	// Condition is the defined condition, e.g. "item-not-found".
+	Condition string
+	// AppCondition is the application-specific condition element, if any.
+	AppCondition *XMLElement
+	// Text is the human readable description of the error.
+	Text string
+	// By is the entity that generated the error.
+	By string
+	// Code is the legacy error code of XEP-0086: Error Condition Mappings.
+	Code string
+}
+
+// Sentinel errors for the defined conditions of RFC 6120 section 8.3.3.
+var (
+	ErrBadRequest            = &StanzaError{Condition: "bad-request"}
+	ErrConflict              = &StanzaError{Condition: "conflict"}
+	ErrFeatureNotImplemented = &StanzaError{Condition: "feature-not-implemented"}
+	ErrForbidden             = &StanzaError{Condition: "forbidden"}
+	ErrGone                  = &StanzaError{Condition: "gone"}
+	ErrInternalServerError   = &StanzaError{Condition: "internal-server-error"}
+	ErrItemNotFound          = &StanzaError{Condition: "item-not-found"}
+	ErrJIDMalformed          = &StanzaError{Condition: "jid-malformed"}
+	ErrNotAcceptable         = &StanzaError{Condition: "not-acceptable"}
+	ErrNotAllowed            = &StanzaError{Condition: "not-allowed"}
+	ErrNotAuthorized         = &StanzaError{Condition: "not-authorized"}
+	ErrPolicyViolation       = &StanzaError{Condition: "policy-violation"}
+	ErrRecipientUnavailable  = &StanzaError{Condition: "recipient-unavailable"}
+	ErrRedirect              = &StanzaError{Condition: "redirect"}
+	ErrRegistrationRequired  = &StanzaError{Condition: "registration-required"}
+	ErrRemoteServerNotFound  = &StanzaError{Condition: "remote-server-not-found"}
+	ErrRemoteServerTimeout   = &StanzaError{Condition: "remote-server-timeout"}
+	ErrResourceConstraint    = &StanzaError{Condition: "resource-constraint"}
+	ErrServiceUnavailable    = &StanzaError{Condition: "service-unavailable"}
+	ErrSubscriptionRequired  = &StanzaError{Condition: "subscription-required"}
+	ErrUndefinedCondition    = &StanzaError{Condition: "undefined-condition"}
+	ErrUnexpectedRequest     = &StanzaError{Condition: "unexpected-request"}
+)
+
+func (e *StanzaError) Error() string {
+	if e.Text != "" {
+		return "stanza error: " + e.Condition + ": " + e.Text
+	}
+	return "stanza error: " + e.Condition
+}
+
+// Is reports whether target is a StanzaError with the same condition. The
+// type and application-specific condition are compared as well if target
+// has them.
+func (e *StanzaError) Is(target error) bool {
+	t, ok := target.(*StanzaError)
+	if !ok || t.Condition != e.Condition {
+		return false
+	}
+	if t.Type != "" && t.Type != e.Type {
+		return false
+	}
+	if t.AppCondition != nil &&
+		(e.AppCondition == nil || e.AppCondition.XMLName != t.AppCondition.XMLName) {
+		return false
+	}
+	return true
+}
+
+// XML returns the error element to send in a stanza of type error. A
+// Condition that is not a valid element name is sent as
+// undefined-condition. The AppCondition is left out if its name is not
+// valid, its InnerXML is left out if it is not well-formed.
+func (e *StanzaError) XML() string {
+	condition := e.Condition
+	if !isNCName(condition) {
+		condition = ErrUndefinedCondition.Condition
+	}
+	v := errorElement{
+		Type:      e.Type,
+		By:        e.By,
+		Code:      e.Code,
+		Condition: emptyElement{XMLName: xml.Name{Space: XMPPNS_XMPP_STANZAS, Local: condition}},
+	}
+	if e.Text != "" {
+		v.Text = &errorText{Text: e.Text}
+	}
+	if a := e.AppCondition; a != nil && isNCName(a.XMLName.Local) {
+		app := &errorAppCondition{XMLName: xml.Name{Space: a.XMLName.Space, Local: a.XMLName.Local}}
+		for _, attr := range a.Attr {
+			if attr.Name.Space == "" && attr.Name.Local != "xmlns" && isNCName(attr.Name.Local) {
+				app.Attr = append(app.Attr, xml.Attr{Name: xml.Name{Local: attr.Name.Local}, Value: attr.Value})
+			}
+		}
+		if wellFormed(a.InnerXML) {
+			app.InnerXML = a.InnerXML
+		}
+		v.AppCondition = app
+	}
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// errorElement is the error element of a sent stanza.
+type errorElement struct {
+	XMLName      xml.Name `xml:"error"`
+	Type         string   `xml:"type,attr,omitempty"`
+	By           string   `xml:"by,attr,omitempty"`
+	Code         string   `xml:"code,attr,omitempty"`
+	Condition    emptyElement
+	Text         *errorText
+	AppCondition *errorAppCondition
+}
+
+type errorText struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+	Text    string   `xml:",chardata"`
+}
+
+type errorAppCondition struct {
+	XMLName  xml.Name
+	Attr     []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
+}
+
+// isNCName reports whether s is a valid element or attribute name without
+// prefix.
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// wellFormed reports whether s is a sequence of complete elements and
+// text, so it can not close the element it is put into.
+func wellFormed(s string) bool {
+	d := xml.NewDecoder(strings.NewReader("<x>" + s + "</x>"))
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return false
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				_, err := d.Token()
+				return err == io.EOF
+			}
+		case xml.ProcInst, xml.Directive:
+			return false
+		}
+	}
+}
+
+// stanzaError converts a received error element. It returns nil if there
+// is none.
+func (e *clientError) stanzaError() *StanzaError {
+	if e.XMLName.Local == "" {
+		return nil
+	}
+	se := &StanzaError{Type: e.Type, By: e.By, Code: e.Code}
+	var cond clientErrorCondition
+	_ = xml.Unmarshal(fmt.Appendf(nil, "<error>%s</error>", e.InnerXML), &cond)
+	for _, c := range cond.Conditions {
+		switch {
+		case c.XMLName.Space == XMPPNS_XMPP_STANZAS && c.XMLName.Local == "text":
+			var text struct {
+				Text string `xml:",chardata"`
+			}
+			_ = xml.Unmarshal(fmt.Appendf(nil, "<text>%s</text>", c.InnerXML), &text)
+			se.Text = text.Text
+		case c.XMLName.Space == XMPPNS_XMPP_STANZAS:
+			if se.Condition == "" {
+				se.Condition = c.XMLName.Local
+			}
+		case se.AppCondition == nil:
+			app := c
+			se.AppCondition = &app
+		}
+	}
+	if se.Condition == "" {
+		se.Condition = ErrUndefinedCondition.Condition
+	}
+	return se
+}
+
+// messageError returns the error of a message of type error. The error
+// element is kept in Other for compatibility, so it is looked up there.
+func messageError(v *clientMessage) *StanzaError {
+	for _, e := range v.Other {
+		if e.XMLName.Local != "error" ||
+			(e.XMLName.Space != XMPPNS_CLIENT && e.XMLName.Space != XMPPNS_COMPONENT_ACCEPT) {
+			continue
+		}
+		ce := clientError{XMLName: e.XMLName, InnerXML: []byte(e.InnerXML)}
+		for _, a := range e.Attr {
+			switch a.Name.Local {
+			case "code":
+				ce.Code = a.Value
+			case "type":
+				ce.Type = a.Value
+			case "by":
+				ce.By = a.Value
+			}
+		}
+		return ce.stanzaError()
+	}
+	return &StanzaError{Condition: ErrUndefinedCondition.Condition}
+}
+
+// StreamError is a stream error as described in RFC 6120 section 4.9. The
+// server closes the stream after sending it. It is returned by Recv and when
+// establishing a connection, and can be inspected using errors.As:
+//
+//	var se *xmpp.StreamError
+//	if errors.As(err, &se) && se.Condition == "conflict" { ... }
+type StreamError struct {
+	// Condition is the defined condition, e.g. "conflict" or
+	// "see-other-host".
+	Condition string
+	// Text is the human readable description of the error.
+	Text string
+	// Host is the target of a see-other-host error as "hostname" or
+	// "hostname:port", see Client.Redirect.
+	Host string
+	// AppCondition is the application-specific condition element, if any.
+	AppCondition *XMLElement
+}
+
+func (e *StreamError) Error() string {
+	if e.Text != "" {
+		return "stream error: " + e.Condition + ": " + e.Text
+	}
+	return "stream error: " + e.Condition
+}
+
+// Is reports whether target is a StreamError with the same condition.
+func (e *StreamError) Is(target error) bool {
+	t, ok := target.(*StreamError)
+	return ok && t.Condition == e.Condition
+}
+
+// streamError converts a received stream error.
+func (e *streamError) streamError() *StreamError {
+	se := &StreamError{Text: strings.TrimSpace(e.Text.Text)}
+	if e.SeeOtherHost.XMLName.Local != "" {
+		se.Condition = e.SeeOtherHost.XMLName.Local
+		se.Host = strings.TrimSpace(e.SeeOtherHost.Text)
+	}
+	for _, c := range e.Any {
+		switch {
+		case c.XMLName.Space == XMPPNS_XMPP_STREAMS:
+			if se.Condition == "" {
+				se.Condition = c.XMLName.Local
+			}
+		case se.AppCondition == nil:
+			app := c
+			se.AppCondition = &app
+		}
+	}
+	if se.Condition == "" {
+		se.Condition = "undefined-condition"
+	}
+	return se
+}
+
 // ErrorServiceUnavailable implements error response about a feature that is not available. Currently implemented for
 // xep-0030.
 // QueryXmlns is about incoming xmlns attribute in query tag.
@@ -11,25 +303,16 @@ import (
 //
 // If queried feature is not here on purpose, standards suggest to answer with this stanza.
 func (c *Client) ErrorServiceUnavailable(v IQ, queryXmlns, node string) (string, error) {
-	query := fmt.Sprintf("<query xmlns='%s' ", queryXmlns)
+	_, err := c.encode(&stanza.IQ{
+		From:     v.To,
+		To:       v.From,
+		ID:       v.ID,
+		Type:     IQTypeError,
+		Payload:  []any{&emptyElement{XMLName: xml.Name{Space: queryXmlns, Local: "query"}, Node: node}},
+		InnerXML: (&StanzaError{Type: "cancel", Condition: ErrServiceUnavailable.Condition}).XML(),
+	})
 
-	if node != "" {
-		query += fmt.Sprintf("node='%s' />", node)
-	} else {
-		query += "/>"
-	}
-
-	query += "<error type='cancel'>"
-	query += "<service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas' />"
-	query += "</error>"
-
-	return c.RawInformation(
-		v.To,
-		v.From,
-		v.ID,
-		IQTypeError,
-		query,
-	)
+	return v.ID, err
 }
 
 // ErrorNotImplemented implements error response about a feature that is not (yet?) implemented.
@@ -38,14 +321,14 @@ func (c *Client) ErrorServiceUnavailable(v IQ, queryXmlns, node string) (string,
 // If queried feature is not here because of it under development or for similar reasons, standards suggest to answer with
 // this stanza.
 func (c *Client) ErrorNotImplemented(v IQ, xmlns, feature string) (string, error) {
-	query := "<error type='cancel'>"
-	query += "<feature-not-implemented xmlns='urn:ietf:params:xml:ns:xmpp-stanzas' />"
-	query += fmt.Sprintf(
-		"<unsupported xmlns='%s' feature='%s' />",
-		xmlns,
-		feature,
-	)
-	query += "</error>"
+	query := (&StanzaError{
+		Type:      "cancel",
+		Condition: ErrFeatureNotImplemented.Condition,
+		AppCondition: &XMLElement{
+			XMLName: xml.Name{Space: xmlns, Local: "unsupported"},
+			Attr:    []xml.Attr{{Name: xml.Name{Local: "feature"}, Value: feature}},
+		},
+	}).XML()
 
 	return c.RawInformation(
 		v.To,
@@ -55,3 +338,9 @@ func (c *Client) ErrorNotImplemented(v IQ, xmlns, feature string) (string, error
 		query,
 	)
 }
+
+// sendIQError answers the IQ request v with the error e.
+func (c *Client) sendIQError(v *clientIQ, e *StanzaError) error {
+	_, err := c.encode(&stanza.IQ{To: v.From, ID: v.ID, Type: IQTypeError, InnerXML: e.XML()})
+	return err
+}
@@ -0,0 +1,130 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sync"
+)
+
+// extensions maps payload element names to the factories registered with
+// RegisterExtension, and the types they return to the first name registered
+// for them.
+var extensions = struct {
+	sync.RWMutex
+	m     map[xml.Name]func() any
+	names map[reflect.Type]xml.Name
+}{m: make(map[xml.Name]func() any), names: make(map[reflect.Type]xml.Name)}
+
+// builtinExtensions are the payload elements of messages decoded into fields
+// of Chat or returned as PubsubEvent. They are left out of Chat.Other and
+// Chat.OtherElem.
+var builtinExtensions = map[xml.Name]func() any{
+	{Space: XMPPNS_OOB, Local: "x"}:              func() any { return new(Oob) },
+	{Space: XMPPNS_DELAY, Local: "delay"}:        func() any { return new(Delay) },
+	{Space: XMPPNS_SID_0, Local: "stanza-id"}:    func() any { return new(StanzaID) },
+	{Space: XMPPNS_PUBSUB_EVENT, Local: "event"}: func() any { return new(PubsubEvent) },
+}
+
+func init() {
+	for name, factory := range builtinExtensions {
+		RegisterExtension(name, factory)
+	}
+}
+
+// RegisterExtension registers a payload element of received messages,
+// presences and IQs. Elements named name are unmarshalled with encoding/xml
+// into the pointer returned by factory and made available through
+// Extensions. An empty name.Local matches every element of the namespace
+// name.Space not registered by its full name.
+//
+// RegisterExtension is meant to be called from init functions. It panics if
+// factory is nil or name is already registered.
+func RegisterExtension(name xml.Name, factory func() any) {
+	if factory == nil {
+		panic("xmpp: RegisterExtension factory is nil")
+	}
+	extensions.Lock()
+	defer extensions.Unlock()
+	if _, ok := extensions.m[name]; ok {
+		panic("xmpp: RegisterExtension called twice for {" + name.Space + "}" + name.Local)
+	}
+	extensions.m[name] = factory
+	if t := reflect.TypeOf(factory()); t != nil {
+		if _, ok := extensions.names[t]; !ok {
+			extensions.names[t] = name
+		}
+	}
+}
+
+// extensionFactory returns the factory registered for name, if any.
+func extensionFactory(name xml.Name) func() any {
+	extensions.RLock()
+	defer extensions.RUnlock()
+	if f, ok := extensions.m[name]; ok {
+		return f
+	}
+	return extensions.m[xml.Name{Space: name.Space}]
+}
+
+// extensionName returns the name registered for the type of the payload v.
+func extensionName(v any) (xml.Name, bool) {
+	extensions.RLock()
+	defer extensions.RUnlock()
+	name, ok := extensions.names[reflect.TypeOf(v)]
+	return name, ok
+}
+
+// Extensions holds the payloads of a received stanza decoded by the
+// factories registered with RegisterExtension, in document order. Payloads
+// that failed to decode are left out.
+type Extensions []any
+
+// Extension sets *v to the first payload of the same type as v, which must
+// be a pointer like the values returned by the factory, e.g.
+//
+//	var delay Delay
+//	if chat.Extension(&delay) { ... }
+//
+// It reports whether such a payload was found.
+func (e Extensions) Extension(v any) bool {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Pointer {
+		return false
+	}
+	for _, ext := range e {
+		if reflect.TypeOf(ext) == t {
+			reflect.ValueOf(v).Elem().Set(reflect.ValueOf(ext).Elem())
+			return true
+		}
+	}
+	return false
+}
+
+// decodeExtensions decodes the registered elements among elems.
+func decodeExtensions(elems []XMLElement) Extensions {
+	var exts Extensions
+	for _, e := range elems {
+		f := extensionFactory(e.XMLName)
+		if f == nil {
+			continue
+		}
+		v := f()
+		if err := xml.Unmarshal([]byte(elementString(e.XMLName, e.Attr, e.InnerXML)), v); err != nil {
+			continue
+		}
+		exts = append(exts, v)
+	}
+	return exts
+}
+
+// withoutBuiltinExtensions returns the elements among elems that are not
+// built-in extensions.
+func withoutBuiltinExtensions(elems []XMLElement) []XMLElement {
+	var other []XMLElement
+	for _, e := range elems {
+		if _, ok := builtinExtensions[e.XMLName]; !ok {
+			other = append(other, e)
+		}
+	}
+	return other
+}
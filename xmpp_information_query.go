@@ -1,11 +1,33 @@
 package xmpp
 
 import (
-	"fmt"
+	"encoding/xml"
 	"time"
+
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
-// Discovery discovers items information according https://xmpp.org/extensions/xep-0030.html#items (Discovering the
+// versionQuery is the XEP-0092 software version of a reply.
+type versionQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name"`
+	Version string   `xml:"version"`
+	OS      string   `xml:"os,omitempty"`
+}
+
+// timeReply is the XEP-0202 entity time of a reply.
+type timeReply struct {
+	XMLName xml.Name `xml:"urn:xmpp:time time"`
+	Tzo     string   `xml:"tzo"`
+	UTC     string   `xml:"utc"`
+}
+
+func init() {
+	registerFeature(XMPPNS_IQ_VERSION, func(o *Options) bool { return o.ReportSoftwareVersion })
+	registerFeature(XMPPNS_TIME, func(o *Options) bool { return o.ReportTime })
+}
+
+// Discovery discovers items according https://xmpp.org/extensions/xep-0030.html#items (Discovering the
 // Items Associated with a Jabber Entity).
 func (c *Client) Discovery() (string, error) {
 	return c.RawInformationQuery(c.jid, c.domain, getUUID(), IQTypeGet, XMPPNS_DISCO_ITEMS, "")
@@ -15,13 +37,8 @@ func (c *Client) Discovery() (string, error) {
 // Discovery query performed according to https://xmpp.org/extensions/xep-0030.html#info (Discovering Information About
 // a Jabber Entity).
 func (c *Client) DiscoverNodeInfo(node string) (string, error) {
-	return c.RawInformation(
-		c.jid,
-		c.domain,
-		getUUID(),
-		IQTypeGet,
-		fmt.Sprintf("<query xmlns=%q node=%q/>", XMPPNS_DISCO_INFO, node),
-	)
+	return c.informationQuery(c.jid, c.domain, getUUID(), IQTypeGet,
+		&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_INFO, Local: "query"}, Node: node})
 }
 
 // DiscoverInfo discovers information about given item from given jid.
@@ -30,9 +47,8 @@ func (c *Client) DiscoverNodeInfo(node string) (string, error) {
 // The only difference between DiscoverInfo() and DiscoverNodeInfo() is that DiscoverInfo() does not supply From field,
 // which is useful in very limited amount use cases.
 func (c *Client) DiscoverInfo(to string) (string, error) {
-	query := fmt.Sprintf("<query xmlns=%q/>", XMPPNS_DISCO_INFO)
-
-	return c.RawInformation(c.jid, to, getUUID(), IQTypeGet, query)
+	return c.informationQuery(c.jid, to, getUUID(), IQTypeGet,
+		&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_INFO, Local: "query"}})
 }
 
 // DiscoverServerItems discovers items that the server exposes. It is actually thin wrapper for DiscoverEntityItems().
@@ -42,38 +58,36 @@ func (c *Client) DiscoverServerItems() (string, error) {
 
 // DiscoverEntityItems discovers items that an entity exposes.
 func (c *Client) DiscoverEntityItems(jid string) (string, error) {
-	query := fmt.Sprintf("<query xmlns=%q/>", XMPPNS_DISCO_ITEMS)
-
-	return c.RawInformation(c.jid, jid, getUUID(), IQTypeGet, query)
+	return c.informationQuery(c.jid, jid, getUUID(), IQTypeGet,
+		&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_ITEMS, Local: "query"}})
 }
 
-// RawInformationQuery sends an information query request to the server.
+// RawInformationQuery sends an information query request to the server. The body of the query element is sent as is.
 func (c *Client) RawInformationQuery(from, to, id, iqType, requestNamespace, body string) (string, error) {
-	_, err := fmt.Fprintf(
-		c.stanzaWriter,
-		"<iq from=%q to=%q id=%q type=%q><query xmlns=%q>%s</query></iq>\n",
-		xmlEscape(from),
-		xmlEscape(to),
-		id,
-		iqType,
-		requestNamespace,
-		body,
-	)
+	return c.informationQuery(from, to, id, iqType, rawQuery(requestNamespace, body))
+}
 
-	return id, err
+// rawQueryElement is a query element with verbatim content.
+type rawQueryElement struct {
+	XMLName  xml.Name
+	InnerXML string `xml:",innerxml"`
 }
 
-// RawInformation send a IQ request with the payload body to the server.
+// rawQuery returns a query element in namespace with the content body.
+func rawQuery(namespace, body string) *rawQueryElement {
+	return &rawQueryElement{XMLName: xml.Name{Space: namespace, Local: "query"}, InnerXML: body}
+}
+
+// RawInformation send a IQ request with the payload body to the server. The body is sent as is.
 func (c *Client) RawInformation(from, to, id, iqType, body string) (string, error) {
-	_, err := fmt.Fprintf(
-		c.stanzaWriter,
-		"<iq from=%q to=%q id=%q type=%q>%s</iq>\n",
-		xmlEscape(from),
-		xmlEscape(to),
-		id,
-		iqType,
-		body,
-	)
+	_, err := c.encode(&stanza.IQ{From: from, To: to, ID: id, Type: iqType, InnerXML: body})
+
+	return id, err
+}
+
+// informationQuery sends an IQ with a single payload element.
+func (c *Client) informationQuery(from, to, id, iqType string, payload any) (string, error) {
+	_, err := c.encode(&stanza.IQ{From: from, To: to, ID: id, Type: iqType, Payload: []any{payload}})
 
 	return id, err
 }
@@ -81,19 +95,12 @@ func (c *Client) RawInformation(from, to, id, iqType, body string) (string, erro
 // UrnXMPPTimeResponse implements response to query entity's current time accodring to
 // https://xmpp.org/extensions/xep-0202.html#example-2 (A Response to the Query).
 func (c *Client) UrnXMPPTimeResponse(v IQ, timezoneOffset string) (string, error) {
-	query := fmt.Sprintf(
-		"<time xmlns=%q><tzo>%s</tzo><utc>%s</utc></time>",
-		XMPPNS_TIME,
-		timezoneOffset,
-		time.Now().UTC().Format(time.RFC3339),
-	)
-
-	return c.RawInformation(
+	return c.informationQuery(
 		v.To,
 		v.From,
 		v.ID,
 		IQTypeResult,
-		query,
+		&timeReply{Tzo: timezoneOffset, UTC: time.Now().UTC().Format(time.RFC3339)},
 	)
 }
 
@@ -109,22 +116,11 @@ func (c *Client) IqVersionResponse(v IQ, name string, version string, os string)
 		version = "undefined"
 	}
 
-	query := fmt.Sprintf("<query xmlns=%q>", XMPPNS_IQ_VERSION)
-
-	query += fmt.Sprintf("<name>%s</name>", name)
-	query += fmt.Sprintf("<version>%s</version>", version)
-
-	if os != "" {
-		query += fmt.Sprintf("<os>%s</os>", os)
-	}
-
-	query += "</query>"
-
-	return c.RawInformation(
+	return c.informationQuery(
 		v.To,
 		v.From,
 		v.ID,
 		IQTypeResult,
-		query,
+		&versionQuery{Name: name, Version: version, OS: os},
 	)
 }
@@ -0,0 +1,280 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Stanza is a message, presence or iq element as seen by interceptors. The
+// attributes of the top-level element are in Attr, the payload is kept
+// verbatim in InnerXML.
+type Stanza struct {
+	XMLName  xml.Name
+	Attr     []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
+}
+
+// ParseStanza parses a single message, presence or iq element, e.g. to
+// inject a stanza from an interceptor.
+func ParseStanza(s string) (*Stanza, error) {
+	d := xml.NewDecoder(strings.NewReader(s))
+	st := new(Stanza)
+	if err := d.Decode(st); err != nil {
+		return nil, err
+	}
+	switch st.XMLName.Local {
+	case "message", "presence", "iq":
+	default:
+		return nil, errors.New("stanza: <" + st.XMLName.Local + "/> is not a stanza")
+	}
+	// Only whitespace may follow the element.
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return st, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := t.(xml.CharData); !ok || strings.TrimSpace(string(cd)) != "" {
+			return nil, errors.New("stanza: data after the stanza")
+		}
+	}
+}
+
+// Name returns "message", "presence" or "iq".
+func (st *Stanza) Name() string {
+	return st.XMLName.Local
+}
+
+// GetAttr returns the value of the unqualified attribute name, e.g. "id".
+func (st *Stanza) GetAttr(name string) string {
+	for _, a := range st.Attr {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// SetAttr sets the unqualified attribute name. An empty value removes it.
+func (st *Stanza) SetAttr(name, value string) {
+	i := slices.IndexFunc(st.Attr, func(a xml.Attr) bool {
+		return a.Name.Space == "" && a.Name.Local == name
+	})
+	switch {
+	case i >= 0 && value == "":
+		st.Attr = slices.Delete(st.Attr, i, i+1)
+	case i >= 0:
+		st.Attr[i].Value = value
+	case value != "":
+		st.Attr = append(st.Attr, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	}
+}
+
+// ID returns the id attribute.
+func (st *Stanza) ID() string {
+	return st.GetAttr("id")
+}
+
+// Type returns the type attribute.
+func (st *Stanza) Type() string {
+	return st.GetAttr("type")
+}
+
+// From returns the from attribute.
+func (st *Stanza) From() string {
+	return st.GetAttr("from")
+}
+
+// To returns the to attribute.
+func (st *Stanza) To() string {
+	return st.GetAttr("to")
+}
+
+// String returns the stanza as XML.
+func (st *Stanza) String() string {
+	return elementString(st.XMLName, st.Attr, st.InnerXML)
+}
+
+// elementString returns the XML of an element decoded with its attributes
+// and inner XML.
+func elementString(name xml.Name, attr []xml.Attr, inner string) string {
+	var b strings.Builder
+	b.WriteString("<" + name.Local)
+	hasXmlns := slices.ContainsFunc(attr, func(a xml.Attr) bool {
+		return a.Name.Space == "" && a.Name.Local == "xmlns"
+	})
+	if name.Space != "" && !hasXmlns {
+		fmt.Fprintf(&b, " xmlns='%s'", xmlEscape(name.Space))
+	}
+	prefixes := 0
+	for _, a := range attr {
+		switch a.Name.Space {
+		case "":
+			fmt.Fprintf(&b, " %s='%s'", a.Name.Local, xmlEscape(a.Value))
+		case "xmlns":
+			fmt.Fprintf(&b, " xmlns:%s='%s'", a.Name.Local, xmlEscape(a.Value))
+		case "http://www.w3.org/XML/1998/namespace":
+			fmt.Fprintf(&b, " xml:%s='%s'", a.Name.Local, xmlEscape(a.Value))
+		default:
+			prefixes++
+			fmt.Fprintf(&b, " xmlns:a%d='%s' a%d:%s='%s'", prefixes, xmlEscape(a.Name.Space),
+				prefixes, a.Name.Local, xmlEscape(a.Value))
+		}
+	}
+	b.WriteString(">" + inner + "</" + name.Local + ">")
+	return b.String()
+}
+
+// StanzaHandler handles a stanza passed on by an Interceptor.
+type StanzaHandler func(st *Stanza) error
+
+// Interceptor wraps the handling of stanzas. It receives the next handler of
+// the chain and returns a handler that may modify the stanza before passing
+// it to next, drop it by not calling next, or inject stanzas by calling next
+// several times. Inbound stanzas must be passed on before the handler
+// returns.
+type Interceptor func(next StanzaHandler) StanzaHandler
+
+// interceptors holds the interceptor chains of a client, see
+// Options.InboundInterceptors and Options.OutboundInterceptors.
+type interceptors struct {
+	sync.RWMutex
+	inbound  []Interceptor
+	outbound []Interceptor
+	queue    []*Stanza // Inbound stanzas passed on by the chain, read by Recv.
+}
+
+// UseInbound adds interceptors for the message, presence and iq stanzas
+// received from the server, see Options.InboundInterceptors. They are also
+// added to the options of the client, so the clients created by Resume,
+// Redirect and a ManagedClient keep them.
+func (c *Client) UseInbound(i ...Interceptor) {
+	c.ic.Lock()
+	defer c.ic.Unlock()
+	if c.Options == nil {
+		c.Options = &Options{}
+	}
+	c.Options.InboundInterceptors = append(slices.Clip(c.Options.InboundInterceptors), i...)
+	c.ic.inbound = c.Options.InboundInterceptors
+}
+
+// UseOutbound adds interceptors for the message, presence and iq stanzas
+// sent by the client, see Options.OutboundInterceptors. They are also added
+// to the options of the client, so the clients created by Resume, Redirect
+// and a ManagedClient keep them.
+func (c *Client) UseOutbound(i ...Interceptor) {
+	c.ic.Lock()
+	defer c.ic.Unlock()
+	if c.Options == nil {
+		c.Options = &Options{}
+	}
+	c.Options.OutboundInterceptors = append(slices.Clip(c.Options.OutboundInterceptors), i...)
+	c.ic.outbound = c.Options.OutboundInterceptors
+}
+
+// options returns a copy of the options of the client, including the
+// interceptors added with UseInbound and UseOutbound.
+func (c *Client) options() Options {
+	c.ic.RLock()
+	defer c.ic.RUnlock()
+	return *c.Options
+}
+
+// chain wraps last in the interceptors, the first one being the outermost.
+func chain(is []Interceptor, last StanzaHandler) StanzaHandler {
+	h := last
+	for i := len(is) - 1; i >= 0; i-- {
+		h = is[i](h)
+	}
+	return h
+}
+
+// interceptsInbound reports whether received stanzas are passed through
+// inbound interceptors.
+func (c *Client) interceptsInbound() bool {
+	c.ic.RLock()
+	defer c.ic.RUnlock()
+	return len(c.ic.inbound) > 0
+}
+
+// interceptInbound passes a received stanza through the inbound chain and
+// queues the stanzas it passes on.
+func (c *Client) interceptInbound(st *Stanza) {
+	c.ic.RLock()
+	is := c.ic.inbound
+	c.ic.RUnlock()
+	h := chain(is, func(st *Stanza) error {
+		// Copy the stanza, interceptors may change it after passing it on.
+		queued := *st
+		queued.Attr = slices.Clone(st.Attr)
+		c.ic.queue = append(c.ic.queue, &queued)
+		return nil
+	})
+	if err := h(st); err != nil {
+		c.logger().Warn("inbound interceptor dropped stanza", "kind", st.Name(), "id", st.ID(), "err", err)
+	}
+}
+
+// nextInbound returns the next stanza passed on by the inbound chain decoded
+// like a stanza read from the stream, or nil if there is none.
+func (c *Client) nextInbound() interface{} {
+	for len(c.ic.queue) > 0 {
+		st := c.ic.queue[0]
+		c.ic.queue = c.ic.queue[1:]
+		// Stanzas injected without namespace are in the default
+		// namespace of the stream.
+		if st.XMLName.Space == "" || st.XMLName.Space == XMPPNS_COMPONENT_ACCEPT {
+			st.XMLName.Space = XMPPNS_CLIENT
+			st.Attr = slices.DeleteFunc(st.Attr, func(a xml.Attr) bool {
+				return a.Name.Space == "" && a.Name.Local == "xmlns"
+			})
+		}
+		var v interface{}
+		switch st.XMLName.Local {
+		case "message":
+			v = &clientMessage{}
+		case "presence":
+			v = &clientPresence{}
+		case "iq":
+			v = &clientIQ{}
+		default:
+			continue
+		}
+		if err := xml.Unmarshal([]byte(st.String()), v); err != nil {
+			c.logger().Warn("invalid stanza passed on by inbound interceptor", "err", err)
+			continue
+		}
+		return v
+	}
+	return nil
+}
+
+// interceptOutbound passes stanza through the outbound chain and writes the
+// stanzas it passes on. Strings that are not a single stanza, like raw XML
+// sent with SendOrg, are written unchanged.
+func (c *Client) interceptOutbound(stanza string, write func(string) (int, error)) (int, error) {
+	c.ic.RLock()
+	is := c.ic.outbound
+	c.ic.RUnlock()
+	if len(is) == 0 {
+		return write(stanza)
+	}
+	st, err := ParseStanza(stanza)
+	if err != nil {
+		return write(stanza)
+	}
+	var n int
+	err = chain(is, func(st *Stanza) error {
+		m, err := write(st.String() + "\n")
+		n += m
+		return err
+	})(st)
+	return n, err
+}
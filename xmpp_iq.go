@@ -0,0 +1,393 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmppo/go-xmpp/jid"
+	"github.com/xmppo/go-xmpp/stanza"
+)
+
+// iqReply is handed from Recv to a waiting SendIQ call.
+type iqReply struct {
+	iq  *clientIQ
+	err error
+}
+
+type pendingIQ struct {
+	to    string
+	reply chan iqReply
+}
+
+// iqTracker keeps the IQ requests that wait for a reply, keyed by id.
+type iqTracker struct {
+	sync.Mutex
+	pending map[string]pendingIQ
+}
+
+// SendIQ sends an IQ request of type get or set and waits for the matching
+// result or error reply. The payload is taken verbatim from iq.Query; an empty
+// iq.ID is replaced by a random one.
+//
+// The reply is read by Recv, so another goroutine has to keep calling Recv
+// while SendIQ waits. Replies matched by SendIQ are not returned by Recv.
+// If the reply is of type error, it is returned with StanzaError set together
+// with a non-nil error. Like for IQs returned by Recv, the registered
+// extensions of the payload are decoded into Extensions.
+func (c *Client) SendIQ(ctx context.Context, iq IQ) (*IQ, error) {
+	return c.sendIQReply(ctx, &stanza.IQ{ID: iq.ID, From: iq.From, To: iq.To, Type: iq.Type,
+		InnerXML: string(iq.Query)})
+}
+
+// sendIQReply is sendIQ returning the reply as IQ like SendIQ.
+func (c *Client) sendIQReply(ctx context.Context, iq *stanza.IQ) (*IQ, error) {
+	v, err := c.sendIQ(ctx, iq)
+	if v == nil {
+		return nil, err
+	}
+	res, merr := xml.Marshal(v.Query)
+	if merr != nil {
+		return nil, merr
+	}
+	reply := &IQ{ID: v.ID, From: v.From, To: v.To, Type: v.Type, Query: res,
+		Extensions: decodeExtensions([]XMLElement{v.Query})}
+	if v.Type == IQTypeError {
+		reply.StanzaError = iqError(v)
+	}
+	return reply, err
+}
+
+// sendIQ is SendIQ taking the request as a stanza.IQ and returning the raw
+// reply for the typed helpers.
+func (c *Client) sendIQ(ctx context.Context, iq *stanza.IQ) (*clientIQ, error) {
+	if iq.Type != IQTypeGet && iq.Type != IQTypeSet {
+		return nil, fmt.Errorf("iq: request type must be get or set, got %q", iq.Type)
+	}
+	if iq.ID == "" {
+		iq.ID = getUUID()
+	}
+	reply := make(chan iqReply, 1)
+	c.iqs.Lock()
+	if c.iqs.pending == nil {
+		c.iqs.pending = make(map[string]pendingIQ)
+	}
+	if _, ok := c.iqs.pending[iq.ID]; ok {
+		c.iqs.Unlock()
+		return nil, fmt.Errorf("iq: a request with id %q is already pending", iq.ID)
+	}
+	c.iqs.pending[iq.ID] = pendingIQ{to: iq.To, reply: reply}
+	c.iqs.Unlock()
+	defer func() {
+		c.iqs.Lock()
+		delete(c.iqs.pending, iq.ID)
+		c.iqs.Unlock()
+	}()
+
+	sent := time.Now()
+	_, err := c.encode(iq)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-reply:
+		if r.err != nil {
+			return nil, r.err
+		}
+		c.metrics().IQRoundTrip(time.Since(sent))
+		if r.iq.Type == IQTypeError {
+			return r.iq, iqError(r.iq)
+		}
+		return r.iq, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deliverIQ hands a result or error IQ to the SendIQ call waiting for it.
+// It returns false if nobody waits for the IQ.
+func (c *Client) deliverIQ(v *clientIQ) bool {
+	if v.Type != IQTypeResult && v.Type != IQTypeError {
+		return false
+	}
+	c.iqs.Lock()
+	defer c.iqs.Unlock()
+	p, ok := c.iqs.pending[v.ID]
+	if !ok || !c.isIQReplyFrom(p.to, v.From) {
+		return false
+	}
+	delete(c.iqs.pending, v.ID)
+	p.reply <- iqReply{iq: v}
+	return true
+}
+
+// failPendingIQs aborts all waiting SendIQ calls, e.g. if the stream broke.
+func (c *Client) failPendingIQs(err error) {
+	c.iqs.Lock()
+	defer c.iqs.Unlock()
+	for id, p := range c.iqs.pending {
+		delete(c.iqs.pending, id)
+		p.reply <- iqReply{err: err}
+	}
+}
+
+// isIQReplyFrom checks that a reply comes from the entity the request was
+// sent to, as described in RFC 6120 8.1.2.1. Requests without a to address
+// are handled by the server on behalf of the account, and so are requests
+// to the bare JID of the account, which the server may answer without from
+// as described in RFC 6120 10.3.3.
+func (c *Client) isIQReplyFrom(to, from string) bool {
+	if sameJID(to, from) {
+		return true
+	}
+	own, err := jid.Parse(c.jid)
+	if from == "" {
+		return to == "" || err == nil && sameJID(to, own.Bare().String())
+	}
+	if to != "" {
+		return false
+	}
+	if err != nil {
+		return sameJID(from, c.jid) || sameJID(from, c.domain)
+	}
+	return sameJID(from, own.Bare().String()) || sameJID(from, own.String()) ||
+		sameJID(from, c.domain)
+}
+
+// sameJID reports whether a and b are the same address after normalization.
+// Addresses that are not valid JIDs are compared case-insensitively.
+func sameJID(a, b string) bool {
+	ja, erra := jid.Parse(a)
+	jb, errb := jid.Parse(b)
+	if erra != nil || errb != nil {
+		return strings.EqualFold(a, b)
+	}
+	return ja.Equal(jb)
+}
+
+type clientErrorCondition struct {
+	Conditions []XMLElement `xml:",any"`
+}
+
+// iqError returns the error of an IQ of type error.
+func iqError(v *clientIQ) *StanzaError {
+	if e := v.Error.stanzaError(); e != nil {
+		return e
+	}
+	return &StanzaError{Condition: ErrUndefinedCondition.Condition}
+}
+
+// RawInformationContext sends an IQ request with the payload body and waits
+// for the reply, see SendIQ.
+func (c *Client) RawInformationContext(ctx context.Context, to, iqType, body string) (*IQ, error) {
+	return c.SendIQ(ctx, IQ{From: c.jid, To: to, Type: iqType, Query: []byte(body)})
+}
+
+// RawInformationQueryContext is the blocking counterpart of
+// RawInformationQuery. The request is sent from the account with a random
+// id.
+func (c *Client) RawInformationQueryContext(ctx context.Context, to, iqType, requestNamespace, body string) (*IQ, error) {
+	return c.sendIQReply(ctx, &stanza.IQ{From: c.jid, To: to, Type: iqType,
+		Payload: []any{rawQuery(requestNamespace, body)}})
+}
+
+// DiscoverInfoContext is the blocking counterpart of DiscoverInfo.
+func (c *Client) DiscoverInfoContext(ctx context.Context, to string) (DiscoResult, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: to, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_INFO, Local: "query"}}}})
+	if err != nil {
+		return DiscoResult{}, err
+	}
+	return discoResultFromIQ(v)
+}
+
+// DiscoverNodeInfoContext is the blocking counterpart of DiscoverNodeInfo.
+func (c *Client) DiscoverNodeInfoContext(ctx context.Context, node string) (DiscoResult, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: c.domain, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_INFO, Local: "query"}, Node: node}}})
+	if err != nil {
+		return DiscoResult{}, err
+	}
+	return discoResultFromIQ(v)
+}
+
+// DiscoverEntityItemsContext is the blocking counterpart of DiscoverEntityItems.
+func (c *Client) DiscoverEntityItemsContext(ctx context.Context, jid string) (DiscoItems, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: jid, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_DISCO_ITEMS, Local: "query"}}}})
+	if err != nil {
+		return DiscoItems{}, err
+	}
+	return discoItemsFromIQ(v)
+}
+
+// DiscoverServerItemsContext is the blocking counterpart of DiscoverServerItems.
+func (c *Client) DiscoverServerItemsContext(ctx context.Context) (DiscoItems, error) {
+	return c.DiscoverEntityItemsContext(ctx, c.domain)
+}
+
+// DiscoveryContext is the blocking counterpart of Discovery.
+func (c *Client) DiscoveryContext(ctx context.Context) (DiscoItems, error) {
+	return c.DiscoverEntityItemsContext(ctx, c.domain)
+}
+
+// PingC2SContext is the blocking counterpart of PingC2S. It returns nil once
+// the server answered the ping.
+func (c *Client) PingC2SContext(ctx context.Context, jid, server string) error {
+	if jid == "" {
+		jid = c.jid
+	}
+	if server == "" {
+		server = c.domain
+	}
+	_, err := c.sendIQ(ctx, &stanza.IQ{From: jid, To: server, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_PING, Local: "ping"}}}})
+	return err
+}
+
+// PingS2SContext is the blocking counterpart of PingS2S.
+func (c *Client) PingS2SContext(ctx context.Context, fromServer, toServer string) error {
+	_, err := c.sendIQ(ctx, &stanza.IQ{From: fromServer, To: toServer, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_PING, Local: "ping"}}}})
+	return err
+}
+
+// RosterContext requests the roster and waits for it.
+func (c *Client) RosterContext(ctx context.Context) (Roster, error) {
+	items, err := c.RosterItemsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var r Roster
+	for _, item := range items {
+		r = append(r, Contact{item.JID, item.Name, item.Groups})
+	}
+	return r, nil
+}
+
+// RosterItemsContext requests the roster and waits for it. Unlike
+// RosterContext it returns the subscription states.
+func (c *Client) RosterItemsContext(ctx context.Context) ([]RosterItem, error) {
+	v, err := c.sendIQ(ctx, c.rosterRequest(""))
+	if err != nil {
+		return nil, err
+	}
+	event, err := c.rosterResult(v.InnerXML)
+	return event.Items, err
+}
+
+// RosterAddContext is the blocking counterpart of RosterAdd. If the server
+// refuses the change the *StanzaError of the reply is returned.
+func (c *Client) RosterAddContext(ctx context.Context, item RosterItem) error {
+	item.Subscription = ""
+	_, err := c.sendIQ(ctx, rosterSet(item))
+	return err
+}
+
+// RosterUpdateContext is the blocking counterpart of RosterUpdate.
+func (c *Client) RosterUpdateContext(ctx context.Context, item RosterItem) error {
+	return c.RosterAddContext(ctx, item)
+}
+
+// RosterRemoveContext is the blocking counterpart of RosterRemove.
+func (c *Client) RosterRemoveContext(ctx context.Context, jid string) error {
+	_, err := c.sendIQ(ctx, rosterSet(RosterItem{JID: jid, Subscription: SubscriptionRemove}))
+	return err
+}
+
+// PubsubSubscribeNodeContext is the blocking counterpart of PubsubSubscribeNode.
+func (c *Client) PubsubSubscribeNodeContext(ctx context.Context, node, jid string) (PubsubSubscription, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: jid, Type: IQTypeSet,
+		Payload: []any{pubsubSubscribe(node, c.jid)}})
+	if err != nil {
+		if v != nil {
+			sub, _ := pubsubSubscriptionErrors(v)
+			return sub, err
+		}
+		return PubsubSubscription{}, err
+	}
+	return pubsubSubscriptionFromIQ(v)
+}
+
+// PubsubUnsubscribeNodeContext is the blocking counterpart of PubsubUnsubscribeNode.
+func (c *Client) PubsubUnsubscribeNodeContext(ctx context.Context, node, jid string) (PubsubUnsubscription, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: jid, Type: IQTypeSet,
+		Payload: []any{pubsubUnsubscribe(node, c.jid)}})
+	if err != nil {
+		return PubsubUnsubscription{}, err
+	}
+	return pubsubUnsubscriptionFromIQ(v)
+}
+
+// PubsubRequestLastItemsContext is the blocking counterpart of PubsubRequestLastItems.
+func (c *Client) PubsubRequestLastItemsContext(ctx context.Context, node, jid string) (PubsubItems, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: jid, Type: IQTypeGet,
+		Payload: []any{pubsubItems(node, "")}})
+	if err != nil {
+		return PubsubItems{}, err
+	}
+	return pubsubItemsFromIQ(v)
+}
+
+// PubsubRequestItemContext is the blocking counterpart of PubsubRequestItem.
+func (c *Client) PubsubRequestItemContext(ctx context.Context, node, jid, id string) (PubsubItems, error) {
+	v, err := c.sendIQ(ctx, &stanza.IQ{From: c.jid, To: jid, Type: IQTypeGet,
+		Payload: []any{pubsubItems(node, id)}})
+	if err != nil {
+		return PubsubItems{}, err
+	}
+	return pubsubItemsFromIQ(v)
+}
+
+// AvatarSubscribeMetadataContext is the blocking counterpart of
+// AvatarSubscribeMetadata.
+func (c *Client) AvatarSubscribeMetadataContext(ctx context.Context, jid string) (PubsubSubscription, error) {
+	return c.PubsubSubscribeNodeContext(ctx, XMPPNS_AVATAR_PEP_METADATA, jid)
+}
+
+// AvatarUnsubscribeMetadataContext is the blocking counterpart of
+// AvatarUnsubscribeMetadata.
+func (c *Client) AvatarUnsubscribeMetadataContext(ctx context.Context, jid string) (PubsubUnsubscription, error) {
+	return c.PubsubUnsubscribeNodeContext(ctx, XMPPNS_AVATAR_PEP_METADATA, jid)
+}
+
+// AvatarRequestDataContext is the blocking counterpart of AvatarRequestData.
+func (c *Client) AvatarRequestDataContext(ctx context.Context, jid string) (AvatarData, error) {
+	items, err := c.PubsubRequestLastItemsContext(ctx, XMPPNS_AVATAR_PEP_DATA, jid)
+	if err != nil {
+		return AvatarData{}, err
+	}
+	if len(items.Items) == 0 {
+		return AvatarData{}, errors.New("no avatar data items available")
+	}
+	return handleAvatarData(items.Items[0].InnerXML, jid, items.Items[0].ID)
+}
+
+// AvatarRequestDataByIDContext is the blocking counterpart of AvatarRequestDataByID.
+func (c *Client) AvatarRequestDataByIDContext(ctx context.Context, jid, id string) (AvatarData, error) {
+	items, err := c.PubsubRequestItemContext(ctx, XMPPNS_AVATAR_PEP_DATA, jid, id)
+	if err != nil {
+		return AvatarData{}, err
+	}
+	if len(items.Items) == 0 {
+		return AvatarData{}, errors.New("no avatar data items available")
+	}
+	return handleAvatarData(items.Items[0].InnerXML, jid, items.Items[0].ID)
+}
+
+// AvatarRequestMetadataContext is the blocking counterpart of AvatarRequestMetadata.
+func (c *Client) AvatarRequestMetadataContext(ctx context.Context, jid string) (AvatarMetadata, error) {
+	items, err := c.PubsubRequestLastItemsContext(ctx, XMPPNS_AVATAR_PEP_METADATA, jid)
+	if err != nil {
+		return AvatarMetadata{}, err
+	}
+	if len(items.Items) == 0 {
+		return AvatarMetadata{}, errors.New("no avatar metadata items available")
+	}
+	return handleAvatarMetadata(items.Items[0].InnerXML, jid)
+}
@@ -0,0 +1,184 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logger returns the logger configured by Options.Logger, or by Debug and
+// DebugWriter through debugHandler. Without either nothing is logged.
+func (o *Options) logger() *slog.Logger {
+	switch {
+	case o.Logger != nil:
+		return o.Logger
+	case o.Debug:
+		w := o.DebugWriter
+		if w == nil {
+			w = os.Stderr
+		}
+		return slog.New(&debugHandler{w: w, mu: new(sync.Mutex)})
+	}
+	return slog.New(slog.DiscardHandler)
+}
+
+// logger returns the logger of the client.
+func (c *Client) logger() *slog.Logger {
+	if c.log == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return c.log
+}
+
+// debugHandler keeps the output of Options.Debug: stanzas are written as
+// "SEND <stanza>" and "RECV <stanza>" lines, other records as
+// "xmpp: message key=value...".
+type debugHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	attrs []slog.Attr
+}
+
+func (h *debugHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *debugHandler) Handle(_ context.Context, r slog.Record) error {
+	var dir, stanza string
+	var b strings.Builder
+	b.WriteString("xmpp: " + r.Message)
+	for _, a := range h.attrs {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "dir":
+			dir = a.Value.String()
+		case "stanza":
+			stanza = a.Value.String()
+		}
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	line := b.String()
+	if r.Message == "stanza" && dir != "" {
+		line = strings.ToUpper(dir) + " " + stanza
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, strings.TrimRight(line, "\n")+"\n")
+	return err
+}
+
+func (h *debugHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &debugHandler{w: h.w, mu: h.mu, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *debugHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// logStanza logs a complete stanza or nonza sent or received. The content of
+// SASL elements is redacted as it contains credentials or tokens.
+func (c *Client) logStanza(dir string, se xml.StartElement, data string) {
+	attrs := []slog.Attr{slog.String("dir", dir), slog.String("kind", se.Name.Local)}
+	for _, name := range []string{"id", "type"} {
+		for _, a := range se.Attr {
+			if a.Name.Space == "" && a.Name.Local == name && a.Value != "" {
+				attrs = append(attrs, slog.String(name, a.Value))
+			}
+		}
+	}
+	attrs = append(attrs, slog.String("stanza", redact(se, data)))
+	c.logger().LogAttrs(context.Background(), slog.LevelDebug, "stanza", attrs...)
+}
+
+// logSend logs data written to the stream.
+func (c *Client) logSend(data string) {
+	log := c.logger()
+	if !log.Enabled(context.Background(), slog.LevelDebug) || strings.TrimSpace(data) == "" {
+		return
+	}
+	d := xml.NewDecoder(strings.NewReader(data))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			// The stream footer or data that is not XML.
+			c.logStanza("send", xml.StartElement{}, data)
+			return
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			c.logStanza("send", se, data)
+			return
+		}
+	}
+}
+
+// logRecv logs the element started by se, which was just decoded.
+func (c *Client) logRecv(se xml.StartElement) {
+	if c.rec == nil {
+		return
+	}
+	c.logStanza("recv", se, c.rec.take(c.recStart, c.p.InputOffset()))
+}
+
+// redact replaces the content of SASL elements, except the harmless
+// mechanism lists, failures and aborts, and of component handshakes.
+func redact(se xml.StartElement, data string) string {
+	switch se.Name.Space {
+	case XMPPNS_XMPP_SASL, XMPPNS_SASL_2:
+	case "", XMPPNS_COMPONENT_ACCEPT:
+		// Handshakes are sent in the default namespace of the stream.
+		if se.Name.Local != "handshake" {
+			return data
+		}
+	default:
+		return data
+	}
+	switch se.Name.Local {
+	case "mechanisms", "failure", "abort":
+		return data
+	}
+	var attrs string
+	if se.Name.Space != "" {
+		attrs = fmt.Sprintf(" xmlns='%s'", se.Name.Space)
+	}
+	for _, a := range se.Attr {
+		if a.Name.Local == "mechanism" {
+			attrs += fmt.Sprintf(" mechanism='%s'", xmlEscape(a.Value))
+		}
+	}
+	return fmt.Sprintf("<%s%s>[redacted]</%s>", se.Name.Local, attrs, se.Name.Local)
+}
+
+// recorder keeps the data read from the stream so received elements can be
+// logged as sent by the server.
+type recorder struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // Stream offset of buf[0].
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the data between the stream offsets start and end and
+// discards everything before end.
+func (r *recorder) take(start, end int64) string {
+	start = max(start, r.base)
+	if end < start || end-r.base > int64(len(r.buf)) {
+		return ""
+	}
+	s := string(r.buf[start-r.base : end-r.base])
+	r.buf = r.buf[end-r.base:]
+	r.base = end
+	return s
+}
@@ -0,0 +1,453 @@
+package xmpp
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrManagedClientClosed is returned by ManagedClient methods after Close was called.
+var ErrManagedClientClosed = errors.New("xmpp: managed client closed")
+
+// ErrNotConnected is returned when sending through a ManagedClient that is
+// currently reconnecting.
+var ErrNotConnected = errors.New("xmpp: not connected")
+
+// ConnState describes the connection state of a ManagedClient.
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateConnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// StateChange is reported to Policy.OnStateChange whenever the connection
+// state of a ManagedClient changes.
+type StateChange struct {
+	State ConnState
+	// Err is the error that caused a disconnect or a failed attempt.
+	Err error
+	// Attempt counts the connection attempts since the last successful one.
+	Attempt int
+	// Resumed is true if a XEP-0198 session was resumed on connect.
+	Resumed bool
+}
+
+// Policy controls how a ManagedClient reconnects.
+type Policy struct {
+	// InitialBackoff is the delay before the second connection attempt.
+	// Defaults to one second.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between connection attempts. Defaults to
+	// five minutes.
+	MaxBackoff time.Duration
+
+	// Multiplier is applied to the delay after each failed attempt.
+	// Defaults to 2.
+	Multiplier float64
+
+	// Jitter randomizes each delay by up to this fraction in either
+	// direction, e.g. 0.2 for ±20%. Defaults to 0.2, negative values
+	// disable jitter.
+	Jitter float64
+
+	// MaxAttempts limits the number of consecutive failed connection
+	// attempts. Zero means retry forever.
+	MaxAttempts int
+
+	// OnStateChange is called on every connection state transition. It is
+	// called synchronously and must not block.
+	OnStateChange func(StateChange)
+
+	// FollowRedirects reconnects to the host of a see-other-host stream
+	// error right away, see Client.Redirect. Otherwise the client reconnects
+	// to the configured host after the backoff.
+	FollowRedirects bool
+}
+
+// backoff returns the delay before connection attempt number attempt
+// (starting at 1 for the first retry).
+func (p *Policy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = time.Second
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Minute
+	}
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	jitter := p.Jitter
+	if jitter == 0 {
+		jitter = 0.2
+	}
+	d := float64(initial)
+	for i := 1; i < attempt && d < float64(maxBackoff); i++ {
+		d *= mult
+	}
+	if d > float64(maxBackoff) {
+		d = float64(maxBackoff)
+	}
+	if jitter > 0 {
+		d += d * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// ManagedClient supervises a Client. When the connection is lost it redials
+// with exponential backoff, resumes the XEP-0198 session if possible and
+// otherwise authenticates again and replays the registered post-connect
+// actions.
+type ManagedClient struct {
+	options Options
+	policy  Policy
+
+	mu         sync.Mutex
+	client     *Client
+	last       *Client
+	connecting *connectCall // Connection attempt in progress, if any.
+	actions    []func(*Client) error
+	closed     bool
+	done       chan struct{}
+}
+
+// connectCall is a connection attempt shared by concurrent callers of
+// Connect.
+type connectCall struct {
+	done   chan struct{}
+	client *Client
+	err    error
+}
+
+// NewManagedClient creates a supervised client. The connection is
+// established by the first call to Recv or Connect. If o.RosterStore is
+// nil, the clients share a MemoryRosterStore.
+func NewManagedClient(o Options, p Policy) *ManagedClient {
+	if o.RosterStore == nil {
+		o.RosterStore = &MemoryRosterStore{}
+	}
+	return &ManagedClient{
+		options: o,
+		policy:  p,
+		done:    make(chan struct{}),
+	}
+}
+
+// OnConnect registers an action that is run after every new session, e.g.
+// sending the initial presence or joining rooms. Actions are not run if a
+// XEP-0198 session was resumed, as the server kept the previous state.
+func (m *ManagedClient) OnConnect(action func(*Client) error) {
+	m.mu.Lock()
+	m.actions = append(m.actions, action)
+	m.mu.Unlock()
+}
+
+// SendPresenceOnConnect sends presence after every new session.
+func (m *ManagedClient) SendPresenceOnConnect(presence Presence) {
+	m.OnConnect(func(c *Client) error {
+		_, err := c.SendPresence(presence)
+		return err
+	})
+}
+
+// JoinMUCOnConnect joins the room jid after every new session, see Client.JoinMUC.
+func (m *ManagedClient) JoinMUCOnConnect(jid, nick string, history_type, history int, history_date *time.Time) {
+	m.OnConnect(func(c *Client) error {
+		_, err := c.JoinMUC(jid, nick, history_type, history, history_date)
+		return err
+	})
+}
+
+// PubsubSubscribeNodeOnConnect subscribes to a pubsub node after every new session.
+func (m *ManagedClient) PubsubSubscribeNodeOnConnect(node, jid string) {
+	m.OnConnect(func(c *Client) error {
+		return c.PubsubSubscribeNode(node, jid)
+	})
+}
+
+// RosterOnConnect requests the roster after every new session, see
+// Client.Roster. With roster versioning only the changes are transferred.
+func (m *ManagedClient) RosterOnConnect() {
+	m.OnConnect(func(c *Client) error {
+		return c.Roster()
+	})
+}
+
+// RosterSnapshot returns the roster from Options.RosterStore. It is
+// available while reconnecting.
+func (m *ManagedClient) RosterSnapshot() ([]RosterItem, error) {
+	_, items, err := m.options.RosterStore.Load()
+	return items, err
+}
+
+// Client returns the currently connected client or nil while disconnected.
+func (m *ManagedClient) Client() *Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.client
+}
+
+// Connect establishes the connection if it is not established yet, retrying
+// according to the policy. Concurrent calls share the same connection
+// attempts.
+func (m *ManagedClient) Connect() (*Client, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrManagedClientClosed
+	}
+	if m.client != nil {
+		c := m.client
+		m.mu.Unlock()
+		return c, nil
+	}
+	if call := m.connecting; call != nil {
+		m.mu.Unlock()
+		<-call.done
+		return call.client, call.err
+	}
+	call := &connectCall{done: make(chan struct{})}
+	m.connecting = call
+	m.mu.Unlock()
+
+	call.client, call.err = m.connect()
+	m.mu.Lock()
+	m.connecting = nil
+	m.mu.Unlock()
+	close(call.done)
+	return call.client, call.err
+}
+
+// connect dials until a connection is established, the policy gives up or
+// the client is closed.
+func (m *ManagedClient) connect() (*Client, error) {
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(m.policy.backoff(attempt - 1)):
+			case <-m.done:
+				return nil, ErrManagedClientClosed
+			}
+		}
+		m.notify(StateChange{State: StateConnecting, Attempt: attempt})
+		c, err := m.dial()
+		if err == nil {
+			m.mu.Lock()
+			if m.closed {
+				m.mu.Unlock()
+				c.Close()
+				return nil, ErrManagedClientClosed
+			}
+			m.client = c
+			reconnect := m.last != nil
+			m.mu.Unlock()
+			if reconnect {
+				c.metrics().Reconnected()
+			}
+			m.notify(StateChange{State: StateConnected, Attempt: attempt, Resumed: c.Resumed()})
+			return c, nil
+		}
+		if m.isClosed() {
+			return nil, ErrManagedClientClosed
+		}
+		m.notify(StateChange{State: StateDisconnected, Err: err, Attempt: attempt})
+		if m.policy.MaxAttempts > 0 && attempt >= m.policy.MaxAttempts {
+			return nil, err
+		}
+	}
+}
+
+// dial connects once, resuming the previous session if possible, and runs
+// the post-connect actions on new sessions.
+func (m *ManagedClient) dial() (*Client, error) {
+	m.mu.Lock()
+	last := m.last
+	actions := m.actions
+	m.mu.Unlock()
+
+	o := m.options
+	if last != nil {
+		// Keep the interceptors added to the previous client.
+		lo := last.options()
+		o.InboundInterceptors = lo.InboundInterceptors
+		o.OutboundInterceptors = lo.OutboundInterceptors
+	}
+	var c *Client
+	var err error
+	var unacked []string
+	if last != nil && last.StreamManagementEnabled() {
+		state := last.SMState()
+		if state.ID != "" {
+			c, err = o.Resume(state)
+		}
+		unacked = state.Unacked
+	}
+	if c == nil {
+		c, err = o.NewClient()
+		if err != nil {
+			return nil, err
+		}
+		// The previous session could not be resumed, so none of its
+		// unacknowledged stanzas is known to have arrived.
+		c.smLost = unacked
+	}
+	return c, m.prepare(c, actions)
+}
+
+// prepare runs the post-connect actions on new sessions and sends the
+// stanzas the server did not receive before the session was lost.
+func (m *ManagedClient) prepare(c *Client, actions []func(*Client) error) error {
+	if c.Resumed() {
+		return nil
+	}
+	for _, action := range actions {
+		if err := action(c); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	// Send the stanzas the server did not receive before the session was
+	// lost. They already passed the outbound interceptors.
+	for _, stanza := range c.LostStanzas() {
+		if _, err := c.writeStanza(stanza); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Recv waits for the next stanza like Client.Recv. Connection errors are not
+// returned, instead the client reconnects. An error is only returned after
+// Close or if the policy gives up reconnecting.
+func (m *ManagedClient) Recv() (stanza interface{}, err error) {
+	for {
+		c, err := m.Connect()
+		if err != nil {
+			return Chat{}, err
+		}
+		stanza, err := c.Recv()
+		if err == nil {
+			return stanza, nil
+		}
+		m.mu.Lock()
+		if m.client == c {
+			m.client = nil
+			m.last = c
+		}
+		closed := m.closed
+		m.mu.Unlock()
+		if closed {
+			return Chat{}, ErrManagedClientClosed
+		}
+		m.notify(StateChange{State: StateDisconnected, Err: err})
+		if m.redirect(c, err) {
+			continue
+		}
+		c.stopPeriodicPings()
+		c.conn.Close()
+		c.stopWriter()
+	}
+}
+
+// redirect follows a see-other-host stream error if the policy allows it and
+// reports whether the redirected client is connected.
+func (m *ManagedClient) redirect(c *Client, err error) bool {
+	var serr *StreamError
+	if !m.policy.FollowRedirects || !errors.As(err, &serr) || serr.Host == "" {
+		return false
+	}
+	m.notify(StateChange{State: StateConnecting, Attempt: 1})
+	next, err := c.Redirect(serr.Host)
+	if err == nil {
+		m.mu.Lock()
+		actions := m.actions
+		m.mu.Unlock()
+		err = m.prepare(next, actions)
+	}
+	if err != nil {
+		m.notify(StateChange{State: StateDisconnected, Err: err, Attempt: 1})
+		return false
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		next.Close()
+		return false
+	}
+	m.client = next
+	m.mu.Unlock()
+	m.notify(StateChange{State: StateConnected, Attempt: 1, Resumed: next.Resumed()})
+	return true
+}
+
+// Send sends a chat message through the current connection.
+func (m *ManagedClient) Send(chat Chat) (n int, err error) {
+	c := m.Client()
+	if c == nil {
+		return 0, ErrNotConnected
+	}
+	return c.Send(chat)
+}
+
+// SendPresence sends presence through the current connection.
+func (m *ManagedClient) SendPresence(presence Presence) (n int, err error) {
+	c := m.Client()
+	if c == nil {
+		return 0, ErrNotConnected
+	}
+	return c.SendPresence(presence)
+}
+
+// Close stops reconnecting and closes the current connection.
+func (m *ManagedClient) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	c := m.client
+	m.client = nil
+	m.mu.Unlock()
+	var err error
+	if c != nil {
+		err = c.Close()
+	}
+	m.notify(StateChange{State: StateClosed})
+	return err
+}
+
+func (m *ManagedClient) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *ManagedClient) notify(s StateChange) {
+	if m.policy.OnStateChange != nil {
+		m.policy.OnStateChange(s)
+	}
+}
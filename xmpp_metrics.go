@@ -0,0 +1,207 @@
+package xmpp
+
+import (
+	"expvar"
+	"io"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives statistics of a client, see Options.Metrics. The methods
+// are called synchronously from the reading and sending goroutines and must
+// not block. A Metrics may be shared by several clients.
+type Metrics interface {
+	// BytesReceived and BytesSent count the XML data read from and
+	// written to the stream, after TLS decryption.
+	BytesReceived(n int)
+	BytesSent(n int)
+
+	// StanzaReceived and StanzaSent count stanzas by kind: "message",
+	// "presence" or "iq".
+	StanzaReceived(kind string)
+	StanzaSent(kind string)
+
+	// IQRoundTrip is the time SendIQ waited for a reply.
+	IQRoundTrip(d time.Duration)
+
+	// PingRoundTrip is the time the server took to answer a periodic ping.
+	PingRoundTrip(d time.Duration)
+
+	// Reconnected is called when a ManagedClient reconnected or the client
+	// followed a see-other-host redirect.
+	Reconnected()
+
+	// Authenticated is called with the SASL mechanism used for a new
+	// connection, see Client.Mechanism.
+	Authenticated(mechanism string)
+
+	// StreamError is called with the condition of a received stream
+	// error.
+	StreamError(condition string)
+}
+
+// nopMetrics is used if Options.Metrics is not set.
+type nopMetrics struct{}
+
+func (nopMetrics) BytesReceived(int)           {}
+func (nopMetrics) BytesSent(int)               {}
+func (nopMetrics) StanzaReceived(string)       {}
+func (nopMetrics) StanzaSent(string)           {}
+func (nopMetrics) IQRoundTrip(time.Duration)   {}
+func (nopMetrics) PingRoundTrip(time.Duration) {}
+func (nopMetrics) Reconnected()                {}
+func (nopMetrics) Authenticated(string)        {}
+func (nopMetrics) StreamError(string)          {}
+
+// metrics returns Options.Metrics or a Metrics discarding everything.
+func (c *Client) metrics() Metrics {
+	if c.Options == nil || c.Options.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Options.Metrics
+}
+
+// meteredReader counts the data read from the stream.
+type meteredReader struct {
+	r io.Reader
+	m Metrics
+}
+
+func (r meteredReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.m.BytesReceived(n)
+	}
+	return n, err
+}
+
+// stanzaKind returns the name of the element at the start of stanza.
+func stanzaKind(stanza string) string {
+	s := strings.TrimLeft(stanza, " \t\r\n")
+	if !strings.HasPrefix(s, "<") {
+		return ""
+	}
+	s = s[1:]
+	if i := strings.IndexAny(s, " \t\r\n/>"); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// Latency summarizes round-trip times.
+type Latency struct {
+	Count int64
+	Total time.Duration
+	Min   time.Duration
+	Max   time.Duration
+}
+
+// Mean returns the average round-trip time.
+func (l Latency) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+func (l *Latency) add(d time.Duration) {
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	l.Max = max(l.Max, d)
+	l.Count++
+	l.Total += d
+}
+
+// MetricsSnapshot holds the statistics collected by MemoryMetrics.
+type MetricsSnapshot struct {
+	BytesReceived  int64
+	BytesSent      int64
+	StanzasIn      map[string]int64 // Received stanzas by kind.
+	StanzasOut     map[string]int64 // Sent stanzas by kind.
+	IQRoundTrips   Latency
+	PingRoundTrips Latency
+	Reconnects     int64
+	Mechanisms     map[string]int64 // Authentications by SASL mechanism.
+	StreamErrors   map[string]int64 // Stream errors by condition.
+}
+
+// MemoryMetrics is a Metrics keeping the statistics in memory. It is safe
+// for concurrent use, so one MemoryMetrics can collect the statistics of
+// many clients. The zero value is ready to use.
+type MemoryMetrics struct {
+	mu sync.Mutex
+	s  MetricsSnapshot
+}
+
+// Snapshot returns a copy of the statistics collected so far.
+func (m *MemoryMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.s
+	s.StanzasIn = maps.Clone(s.StanzasIn)
+	s.StanzasOut = maps.Clone(s.StanzasOut)
+	s.Mechanisms = maps.Clone(s.Mechanisms)
+	s.StreamErrors = maps.Clone(s.StreamErrors)
+	return s
+}
+
+// Var returns an expvar.Var exporting the snapshot as JSON, e.g. for
+// expvar.Publish("xmpp", m.Var()).
+func (m *MemoryMetrics) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return m.Snapshot()
+	})
+}
+
+func (m *MemoryMetrics) update(f func(s *MetricsSnapshot)) {
+	m.mu.Lock()
+	f(&m.s)
+	m.mu.Unlock()
+}
+
+// count increments key in the map *p, creating it if needed.
+func count(p *map[string]int64, key string) {
+	if *p == nil {
+		*p = make(map[string]int64)
+	}
+	(*p)[key]++
+}
+
+func (m *MemoryMetrics) BytesReceived(n int) {
+	m.update(func(s *MetricsSnapshot) { s.BytesReceived += int64(n) })
+}
+
+func (m *MemoryMetrics) BytesSent(n int) {
+	m.update(func(s *MetricsSnapshot) { s.BytesSent += int64(n) })
+}
+
+func (m *MemoryMetrics) StanzaReceived(kind string) {
+	m.update(func(s *MetricsSnapshot) { count(&s.StanzasIn, kind) })
+}
+
+func (m *MemoryMetrics) StanzaSent(kind string) {
+	m.update(func(s *MetricsSnapshot) { count(&s.StanzasOut, kind) })
+}
+
+func (m *MemoryMetrics) IQRoundTrip(d time.Duration) {
+	m.update(func(s *MetricsSnapshot) { s.IQRoundTrips.add(d) })
+}
+
+func (m *MemoryMetrics) PingRoundTrip(d time.Duration) {
+	m.update(func(s *MetricsSnapshot) { s.PingRoundTrips.add(d) })
+}
+
+func (m *MemoryMetrics) Reconnected() {
+	m.update(func(s *MetricsSnapshot) { s.Reconnects++ })
+}
+
+func (m *MemoryMetrics) Authenticated(mechanism string) {
+	m.update(func(s *MetricsSnapshot) { count(&s.Mechanisms, mechanism) })
+}
+
+func (m *MemoryMetrics) StreamError(condition string) {
+	m.update(func(s *MetricsSnapshot) { count(&s.StreamErrors, condition) })
+}
@@ -8,9 +8,11 @@
 package xmpp
 
 import (
+	"encoding/xml"
 	"errors"
-	"fmt"
 	"time"
+
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
 const (
@@ -21,62 +23,38 @@ const (
 	SinceHistory   = 4
 )
 
+// mucX is the XEP-0045 element of the presence joining a room.
+type mucX struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"password,omitempty"`
+	History  *mucHistory `xml:"history"`
+}
+
+// mucHistory limits the discussion history sent when joining a room.
+type mucHistory struct {
+	MaxChars   *int   `xml:"maxchars,attr,omitempty"`
+	MaxStanzas *int   `xml:"maxstanzas,attr,omitempty"`
+	Seconds    *int   `xml:"seconds,attr,omitempty"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
 // Send sends room topic wrapped inside an XMPP message stanza body.
 func (c *Client) SendTopic(chat Chat) (n int, err error) {
-	return fmt.Fprintf(c.stanzaWriter, "<message to='%s' type='%s' xml:lang='en'>"+"<subject>%s</subject></message>\n",
-		xmlEscape(chat.Remote), xmlEscape(chat.Type), xmlEscape(chat.Text))
+	return c.encode(&stanza.Message{To: chat.Remote, Type: chat.Type, Lang: "en", Subject: chat.Text})
 }
 
 func (c *Client) JoinMUCNoHistory(jid, nick string) (n int, err error) {
 	if nick == "" {
 		nick = c.jid
 	}
-	return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-		"<x xmlns='%s'>"+
-		"<history maxchars='0'/></x>"+
-		"</presence>\n",
-		xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC)
+	noHistory := 0
+	return c.encode(&stanza.Presence{To: jid + "/" + nick,
+		Payload: append([]any{&mucX{History: &mucHistory{MaxChars: &noHistory}}}, c.capsPayload()...)})
 }
 
 // xep-0045 7.2
 func (c *Client) JoinMUC(jid, nick string, history_type, history int, history_date *time.Time) (n int, err error) {
-	if nick == "" {
-		nick = c.jid
-	}
-	switch history_type {
-	case NoHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s' />"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC)
-	case CharHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<history maxchars='%d'/></x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, history)
-	case StanzaHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<history maxstanzas='%d'/></x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, history)
-	case SecondsHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<history seconds='%d'/></x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, history)
-	case SinceHistory:
-		if history_date != nil {
-			return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-				"<x xmlns='%s'>"+
-				"<history since='%s'/></x>"+
-				"</presence>\n",
-				xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, history_date.Format(time.RFC3339))
-		}
-	}
-	return 0, errors.New("unknown history option")
+	return c.JoinProtectedMUC(jid, nick, "", history_type, history, history_date)
 }
 
 // xep-0045 7.2.6
@@ -84,50 +62,27 @@ func (c *Client) JoinProtectedMUC(jid, nick string, password string, history_typ
 	if nick == "" {
 		nick = c.jid
 	}
+	x := &mucX{Password: password}
 	switch history_type {
 	case NoHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<password>%s</password>"+
-			"</x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, xmlEscape(password))
 	case CharHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<password>%s</password>"+
-			"<history maxchars='%d'/></x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, xmlEscape(password), history)
+		x.History = &mucHistory{MaxChars: &history}
 	case StanzaHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<password>%s</password>"+
-			"<history maxstanzas='%d'/></x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, xmlEscape(password), history)
+		x.History = &mucHistory{MaxStanzas: &history}
 	case SecondsHistory:
-		return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-			"<x xmlns='%s'>"+
-			"<password>%s</password>"+
-			"<history seconds='%d'/></x>"+
-			"</presence>\n",
-			xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, xmlEscape(password), history)
+		x.History = &mucHistory{Seconds: &history}
 	case SinceHistory:
-		if history_date != nil {
-			return fmt.Fprintf(c.stanzaWriter, "<presence to='%s/%s'>"+
-				"<x xmlns='%s'>"+
-				"<password>%s</password>"+
-				"<history since='%s'/></x>"+
-				"</presence>\n",
-				xmlEscape(jid), xmlEscape(nick), XMPPNS_MUC, xmlEscape(password), history_date.Format(time.RFC3339))
+		if history_date == nil {
+			return 0, errors.New("unknown history option")
 		}
+		x.History = &mucHistory{Since: history_date.Format(time.RFC3339)}
+	default:
+		return 0, errors.New("unknown history option")
 	}
-	return 0, errors.New("unknown history option")
+	return c.encode(&stanza.Presence{To: jid + "/" + nick, Payload: append([]any{x}, c.capsPayload()...)})
 }
 
 // xep-0045 7.14
 func (c *Client) LeaveMUC(jid string) (n int, err error) {
-	return fmt.Fprintf(c.stanzaWriter, "<presence from='%s' to='%s' type='unavailable' />\n",
-		c.jid, xmlEscape(jid))
+	return c.encode(&stanza.Presence{From: c.jid, To: jid, Type: stanza.PresenceUnavailable})
 }
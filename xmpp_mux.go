@@ -0,0 +1,204 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"sync"
+)
+
+// HandlerFunc handles a value returned by Client.Recv.
+type HandlerFunc func(c *Client, stanza interface{})
+
+// IQHandlerFunc handles an IQ. Handlers for IQs of type get or set are
+// responsible for sending the result or error reply.
+type IQHandlerFunc func(c *Client, iq IQ)
+
+// MessageHandlerFunc handles a message.
+type MessageHandlerFunc func(c *Client, chat Chat)
+
+// PresenceHandlerFunc handles a presence.
+type PresenceHandlerFunc func(c *Client, presence Presence)
+
+type iqRoute struct {
+	Type  string
+	Space string
+	Local string
+}
+
+// Mux dispatches the values returned by Client.Recv to registered handlers,
+// as an alternative to a type switch around Recv.
+//
+// IQs are matched by type and the namespace and local name of their payload,
+// messages by the namespaces of their extension elements and everything else
+// by its Go type. IQs of type get or set without a matching handler are
+// answered with service-unavailable as required by RFC 6120.
+//
+// Handlers run synchronously in the read loop and must not wait for
+// replies read by it, e.g. by calling SendIQ, without starting a goroutine.
+type Mux struct {
+	mu        sync.RWMutex
+	iqs       map[iqRoute]IQHandlerFunc
+	messages  map[string]MessageHandlerFunc
+	types     map[reflect.Type]HandlerFunc
+	fallback  HandlerFunc
+	presences PresenceHandlerFunc
+}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{
+		iqs:      make(map[iqRoute]IQHandlerFunc),
+		messages: make(map[string]MessageHandlerFunc),
+		types:    make(map[reflect.Type]HandlerFunc),
+	}
+}
+
+// Handle registers a handler for all values with the same type as stanza,
+// e.g. xmpp.PubsubEvent{} or xmpp.DiscoResult{}. Messages, presences and
+// IQs are only passed to it if no more specific handler matches.
+func (m *Mux) Handle(stanza interface{}, h HandlerFunc) {
+	m.mu.Lock()
+	m.types[reflect.TypeOf(stanza)] = h
+	m.mu.Unlock()
+}
+
+// HandleIQ registers a handler for IQs of iqType whose payload is the element
+// local in namespace space. Empty values match any type, namespace or local name.
+func (m *Mux) HandleIQ(iqType, space, local string, h IQHandlerFunc) {
+	m.mu.Lock()
+	m.iqs[iqRoute{iqType, space, local}] = h
+	m.mu.Unlock()
+}
+
+// HandleMessage registers a handler for messages without a handler for one of
+// their extensions.
+func (m *Mux) HandleMessage(h MessageHandlerFunc) {
+	m.HandleMessageExtension("", h)
+}
+
+// HandleMessageExtension registers a handler for messages carrying an
+// extension element in namespace space.
+func (m *Mux) HandleMessageExtension(space string, h MessageHandlerFunc) {
+	m.mu.Lock()
+	m.messages[space] = h
+	m.mu.Unlock()
+}
+
+// HandlePresence registers a handler for presences.
+func (m *Mux) HandlePresence(h PresenceHandlerFunc) {
+	m.mu.Lock()
+	m.presences = h
+	m.mu.Unlock()
+}
+
+// HandleFallback registers a handler for all values no other handler matches.
+func (m *Mux) HandleFallback(h HandlerFunc) {
+	m.mu.Lock()
+	m.fallback = h
+	m.mu.Unlock()
+}
+
+// Serve reads from c and dispatches until Recv returns an error, which is
+// returned.
+func (m *Mux) Serve(c *Client) error {
+	for {
+		stanza, err := c.Recv()
+		if err != nil {
+			return err
+		}
+		if err := m.Dispatch(c, stanza); err != nil {
+			return err
+		}
+	}
+}
+
+// Dispatch passes a single value returned by c.Recv to the matching handler.
+// The returned error is only about sending the service-unavailable reply.
+func (m *Mux) Dispatch(c *Client, stanza interface{}) error {
+	m.mu.RLock()
+	var h func()
+	switch v := stanza.(type) {
+	case IQ:
+		if iqh := m.iqHandler(v); iqh != nil {
+			h = func() { iqh(c, v) }
+		} else if th, ok := m.types[reflect.TypeOf(stanza)]; ok {
+			h = func() { th(c, stanza) }
+		} else if v.Type == IQTypeGet || v.Type == IQTypeSet {
+			m.mu.RUnlock()
+			_, err := c.RawInformation(v.To, v.From, v.ID, IQTypeError,
+				(&StanzaError{Type: "cancel", Condition: ErrServiceUnavailable.Condition}).XML())
+			return err
+		}
+	case Chat:
+		if mh := m.messageHandler(v); mh != nil {
+			h = func() { mh(c, v) }
+		}
+	case Presence:
+		if ph := m.presences; ph != nil {
+			h = func() { ph(c, v) }
+		}
+	}
+	if h == nil {
+		if th, ok := m.types[reflect.TypeOf(stanza)]; ok {
+			h = func() { th(c, stanza) }
+		} else if fb := m.fallback; fb != nil {
+			h = func() { fb(c, stanza) }
+		}
+	}
+	m.mu.RUnlock()
+	if h != nil {
+		h()
+	}
+	return nil
+}
+
+func (m *Mux) iqHandler(iq IQ) IQHandlerFunc {
+	name := iqPayloadName(iq.Query)
+	for _, r := range []iqRoute{
+		{iq.Type, name.Space, name.Local},
+		{iq.Type, name.Space, ""},
+		{"", name.Space, name.Local},
+		{"", name.Space, ""},
+		{iq.Type, "", ""},
+		{"", "", ""},
+	} {
+		if h, ok := m.iqs[r]; ok {
+			return h
+		}
+	}
+	return nil
+}
+
+func (m *Mux) messageHandler(chat Chat) MessageHandlerFunc {
+	for _, e := range chat.OtherElem {
+		if h, ok := m.messages[e.XMLName.Space]; ok {
+			return h
+		}
+	}
+	// The built-in extensions are not in OtherElem.
+	for _, ext := range chat.Extensions {
+		name, ok := extensionName(ext)
+		if !ok {
+			continue
+		}
+		if h, ok := m.messages[name.Space]; ok {
+			return h
+		}
+	}
+	return m.messages[""]
+}
+
+// iqPayloadName returns the name of the first element in an IQ payload.
+func iqPayloadName(payload []byte) xml.Name {
+	d := xml.NewDecoder(bytes.NewReader(payload))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name
+		}
+	}
+}
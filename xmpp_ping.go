@@ -1,10 +1,22 @@
 package xmpp
 
 import (
-	"fmt"
+	"encoding/xml"
 	"time"
+
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
+func init() {
+	registerFeature(XMPPNS_PING, nil)
+}
+
+// pingIQ returns a XEP-0199 ping request.
+func pingIQ(from, to, id string) *stanza.IQ {
+	return &stanza.IQ{From: from, To: to, ID: id, Type: IQTypeGet,
+		Payload: []any{&emptyElement{XMLName: xml.Name{Space: XMPPNS_PING, Local: "ping"}}}}
+}
+
 func (c *Client) PingC2S(jid, server string) error {
 	if jid == "" {
 		jid = c.jid
@@ -12,46 +24,78 @@ func (c *Client) PingC2S(jid, server string) error {
 	if server == "" {
 		server = c.domain
 	}
-	_, err := fmt.Fprintf(c.stanzaWriter, "<iq from='%s' to='%s' id='%s' type='get'>"+
-		"<ping xmlns='urn:xmpp:ping'/>"+
-		"</iq>\n",
-		xmlEscape(jid), xmlEscape(server), getUUID())
+	_, err := c.encode(pingIQ(jid, server, getUUID()))
 	return err
 }
 
 func (c *Client) PingS2S(fromServer, toServer string) error {
-	_, err := fmt.Fprintf(c.stanzaWriter, "<iq from='%s' to='%s' id='%s' type='get'>"+
-		"<ping xmlns='urn:xmpp:ping'/>"+
-		"</iq>\n",
-		xmlEscape(fromServer), xmlEscape(toServer), getUUID())
+	_, err := c.encode(pingIQ(fromServer, toServer, getUUID()))
 	return err
 }
 
 func (c *Client) SendResultPing(id, toServer string) error {
-	_, err := fmt.Fprintf(c.stanzaWriter, "<iq type='result' to='%s' id='%s'/>\n",
-		xmlEscape(toServer), xmlEscape(id))
+	_, err := c.encode(&stanza.IQ{To: toServer, ID: id, Type: IQTypeResult})
 	return err
 }
 
 func (c *Client) sendPeriodicPings() {
-	for range c.periodicPingTicker.C {
+	for {
+		select {
+		case <-c.periodicPingDone:
+			return
+		case <-c.periodicPingTicker.C:
+		}
 		// Reset ticker for periodic pings if configured.
 		if c.periodicPings {
 			c.periodicPingTicker.Reset(c.periodicPingPeriod)
 		}
-		c.periodicPingID = getUUID()
+		id := getUUID()
+		c.periodicPingMu.Lock()
+		c.periodicPingID = id
 		c.periodicPingReply = false
-		_, err := fmt.Fprintf(c.stanzaWriter, "<iq from='%s' to='%s' id='%s' type='get'>"+
-			"<ping xmlns='urn:xmpp:ping'/></iq>\n",
-			xmlEscape(c.jid), xmlEscape(c.domain), c.periodicPingID)
+		c.periodicPingSent = time.Now()
+		c.periodicPingMu.Unlock()
+		_, err := c.encode(pingIQ(c.jid, c.domain, id))
 		if err != nil {
 			c.Close()
 		}
-		time.Sleep(c.periodicPingTimeout)
-		if !c.periodicPingReply {
-			c.shutdown = true
-			fmt.Fprintf(c.stanzaWriter, "</stream:stream>\n")
+		select {
+		case <-c.periodicPingDone:
+			return
+		case <-time.After(c.periodicPingTimeout):
+		}
+		c.periodicPingMu.Lock()
+		reply := c.periodicPingReply
+		c.periodicPingMu.Unlock()
+		if !reply {
+			c.shutdown.Store(true)
+			c.writef("</stream:stream>\n")
+			c.stopWriter()
 			c.conn.Close()
 		}
 	}
 }
+
+// periodicPingAnswered reports whether id is the id of the current periodic
+// ping and records its reply.
+func (c *Client) periodicPingAnswered(id string) bool {
+	c.periodicPingMu.Lock()
+	defer c.periodicPingMu.Unlock()
+	if id != c.periodicPingID {
+		return false
+	}
+	if !c.periodicPingReply {
+		c.metrics().PingRoundTrip(time.Since(c.periodicPingSent))
+		c.periodicPingReply = true
+	}
+	return true
+}
+
+// stopPeriodicPings stops the goroutine sending periodic pings, if any.
+func (c *Client) stopPeriodicPings() {
+	if !c.periodicPings {
+		return
+	}
+	c.periodicPingTicker.Stop()
+	c.periodicPingStop.Do(func() { close(c.periodicPingDone) })
+}
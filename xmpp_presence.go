@@ -0,0 +1,192 @@
+package xmpp
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmppo/go-xmpp/jid"
+)
+
+// ResourcePresence is the presence of an available resource.
+type ResourcePresence struct {
+	JID      string // Full JID of the resource.
+	Show     string
+	Status   string
+	Priority int
+	Since    time.Time // When the presence was received.
+}
+
+// PresenceChange is passed to PresenceTracker.OnChange when a resource
+// becomes available, changes its presence or becomes unavailable.
+type PresenceChange struct {
+	JID string
+	// Current and Previous are the presence of the resource after and
+	// before the change, nil while it is unavailable.
+	Current  *ResourcePresence
+	Previous *ResourcePresence
+	// StanzaError is set if the resource became unavailable because of a
+	// presence of type error.
+	StanzaError *StanzaError
+}
+
+// PresenceTracker keeps the presence of the resources of the contacts from
+// the received presence stanzas, see Options.PresenceTracker. It is safe for
+// concurrent use. The zero value is ready to use.
+type PresenceTracker struct {
+	// OnChange is called for every change. It is called synchronously
+	// from Recv or Update and must not block.
+	OnChange func(PresenceChange)
+
+	mu        sync.Mutex
+	resources map[jid.JID]map[string]*ResourcePresence // By bare JID and resource.
+}
+
+// showOrder ranks the show values from most to least available.
+var showOrder = []string{"chat", "", "away", "xa", "dnd"}
+
+// compareResources orders resources by descending priority, then by show
+// and then by the most recent presence.
+func compareResources(a, b ResourcePresence) int {
+	if c := cmp.Compare(b.Priority, a.Priority); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(slices.Index(showOrder, a.Show), slices.Index(showOrder, b.Show)); c != 0 {
+		return c
+	}
+	return b.Since.Compare(a.Since)
+}
+
+// Update applies a received presence. Available and unavailable presence
+// and presence of type error are tracked, an unavailable or error presence
+// from a bare JID applies to all its resources. Other types are ignored.
+func (t *PresenceTracker) Update(p Presence) {
+	from, err := jid.Parse(p.From)
+	if err != nil || from.IsZero() {
+		return
+	}
+	var changes []PresenceChange
+	t.mu.Lock()
+	switch p.Type {
+	case "":
+		priority, _ := strconv.Atoi(strings.TrimSpace(p.Priority))
+		changes = append(changes, t.set(from, &ResourcePresence{
+			JID:      from.String(),
+			Show:     p.Show,
+			Status:   p.Status,
+			Priority: priority,
+			Since:    time.Now(),
+		}))
+	case "unavailable", "error":
+		resources := []string{from.Resource()}
+		if from.IsBare() {
+			resources = slices.Collect(maps.Keys(t.resources[from]))
+		}
+		for _, r := range resources {
+			full, err := from.WithResource(r)
+			if err != nil || t.resources[from.Bare()][r] == nil {
+				continue
+			}
+			change := t.set(full, nil)
+			change.StanzaError = p.StanzaError
+			changes = append(changes, change)
+		}
+	}
+	t.mu.Unlock()
+	t.notify(changes)
+}
+
+// set replaces the presence of the resource full and returns the change.
+// A nil presence removes it. t.mu must be held.
+func (t *PresenceTracker) set(full jid.JID, p *ResourcePresence) PresenceChange {
+	bare, resource := full.Bare(), full.Resource()
+	change := PresenceChange{JID: full.String(), Previous: t.resources[bare][resource]}
+	if p == nil {
+		delete(t.resources[bare], resource)
+		if len(t.resources[bare]) == 0 {
+			delete(t.resources, bare)
+		}
+		return change
+	}
+	if t.resources == nil {
+		t.resources = make(map[jid.JID]map[string]*ResourcePresence)
+	}
+	if t.resources[bare] == nil {
+		t.resources[bare] = make(map[string]*ResourcePresence)
+	}
+	t.resources[bare][resource] = p
+	current := *p
+	change.Current = &current
+	return change
+}
+
+func (t *PresenceTracker) notify(changes []PresenceChange) {
+	if t.OnChange == nil {
+		return
+	}
+	for _, change := range changes {
+		t.OnChange(change)
+	}
+}
+
+// Reset marks all resources unavailable, e.g. because the connection was
+// lost. The client calls it when a new session starts.
+func (t *PresenceTracker) Reset() {
+	var changes []PresenceChange
+	t.mu.Lock()
+	for _, resources := range t.resources {
+		for _, p := range resources {
+			changes = append(changes, PresenceChange{JID: p.JID, Previous: p})
+		}
+	}
+	t.resources = nil
+	t.mu.Unlock()
+	t.notify(changes)
+}
+
+// Resources returns the available resources of the bare JID of addr, the
+// best first: by descending priority, then by show ("chat", none, "away",
+// "xa", "dnd") and then by the most recent presence.
+func (t *PresenceTracker) Resources(addr string) []ResourcePresence {
+	j, err := jid.Parse(addr)
+	if err != nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var resources []ResourcePresence
+	for _, p := range t.resources[j.Bare()] {
+		resources = append(resources, *p)
+	}
+	slices.SortFunc(resources, compareResources)
+	return resources
+}
+
+// Best returns the best available resource of the bare JID of addr in the
+// order of Resources.
+func (t *PresenceTracker) Best(addr string) (ResourcePresence, bool) {
+	resources := t.Resources(addr)
+	if len(resources) == 0 {
+		return ResourcePresence{}, false
+	}
+	return resources[0], true
+}
+
+// Online reports whether addr is available. For a bare JID any resource
+// counts, a full JID must match the resource.
+func (t *PresenceTracker) Online(addr string) bool {
+	j, err := jid.Parse(addr)
+	if err != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if j.IsBare() {
+		return len(t.resources[j]) > 0
+	}
+	return t.resources[j.Bare()][j.Resource()] != nil
+}
@@ -0,0 +1,141 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ContextDialer opens network connections. *net.Dialer implements it, as do
+// most proxy and tunnel packages.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// forwardDialer adapts a ContextDialer to the proxy.Dialer interface.
+type forwardDialer struct {
+	ContextDialer
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// bufferedConn returns data already read into a bufio.Reader before reading
+// from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// proxyFromEnvironment returns the proxy set in HTTP_PROXY or http_proxy,
+// unless addr matches one of the comma separated substrings in NO_PROXY or
+// no_proxy.
+func proxyFromEnvironment(addr string) *url.URL {
+	httpProxy := os.Getenv("HTTP_PROXY")
+	if httpProxy == "" {
+		httpProxy = os.Getenv("http_proxy")
+	}
+	if httpProxy == "" {
+		return nil
+	}
+	noproxy := os.Getenv("NO_PROXY")
+	if noproxy == "" {
+		noproxy = os.Getenv("no_proxy")
+	}
+	if noproxy != "" {
+		for _, s := range strings.Split(noproxy, ",") {
+			if containsIgnoreCase(addr, s) {
+				return nil
+			}
+		}
+	}
+	if !strings.Contains(httpProxy, "://") {
+		httpProxy = "http://" + httpProxy
+	}
+	u, err := url.Parse(httpProxy)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// dialProxy connects to addr through the HTTP CONNECT or SOCKS5 proxy at
+// proxyURL, which is reached using dialer.
+func dialProxy(ctx context.Context, dialer ContextDialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var user, password string
+	if proxyURL.User != nil {
+		user = proxyURL.User.Username()
+		password, _ = proxyURL.User.Password()
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			auth = &proxy.Auth{User: user, Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forwardDialer{dialer})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http":
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme %q", proxyURL.Scheme)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	c, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, errors.New("proxy: " + resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
@@ -2,7 +2,8 @@ package xmpp
 
 import (
 	"encoding/xml"
-	"fmt"
+
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
 type clientPubsubItem struct {
@@ -39,6 +40,17 @@ type PubsubEvent struct {
 	Items []PubsubItem
 }
 
+// UnmarshalXML decodes a XEP-0060 event element, it is registered as
+// extension of received messages.
+func (e *PubsubEvent) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var ev clientPubsubEvent
+	if err := d.DecodeElement(&ev, &start); err != nil {
+		return err
+	}
+	*e = pubsubClientToReturn(ev)
+	return nil
+}
+
 type PubsubSubscription struct {
 	SubID  string
 	JID    string
@@ -77,59 +89,145 @@ func pubsubClientToReturn(event clientPubsubEvent) PubsubEvent {
 	}
 }
 
-func pubsubStanza(body string) string {
-	return fmt.Sprintf("<pubsub xmlns='%s'>%s</pubsub>",
-		XMPPNS_PUBSUB, body)
+func pubsubSubscriptionErrors(v *clientIQ) (PubsubSubscription, error) {
+	var errs []clientPubsubError
+	err := xml.Unmarshal([]byte(v.Error.InnerXML), &errs)
+	if err != nil {
+		return PubsubSubscription{}, err
+	}
+
+	var errsStr []string
+	for _, e := range errs {
+		errsStr = append(errsStr, e.XMLName.Local)
+	}
+
+	return PubsubSubscription{
+		Errors: errsStr,
+	}, nil
+}
+
+func pubsubSubscriptionFromIQ(v *clientIQ) (PubsubSubscription, error) {
+	var sub clientPubsubSubscription
+	err := xml.Unmarshal([]byte(v.Query.InnerXML), &sub)
+	if err != nil {
+		return PubsubSubscription{}, err
+	}
+
+	return PubsubSubscription{
+		SubID:  sub.SubID,
+		JID:    sub.JID,
+		Node:   sub.Node,
+		Errors: nil,
+	}, nil
+}
+
+func pubsubUnsubscriptionFromIQ(v *clientIQ) (PubsubUnsubscription, error) {
+	if v.Query.XMLName.Local != "pubsub" {
+		// Unsubscribing MAY contain a pubsub element. But it does
+		// not have to
+		return PubsubUnsubscription{
+			SubID:  "",
+			JID:    v.From,
+			Node:   "",
+			Errors: nil,
+		}, nil
+	}
+	var sub clientPubsubSubscription
+	err := xml.Unmarshal([]byte(v.Query.InnerXML), &sub)
+	if err != nil {
+		return PubsubUnsubscription{}, err
+	}
+
+	return PubsubUnsubscription{
+		SubID:  sub.SubID,
+		JID:    v.From,
+		Node:   sub.Node,
+		Errors: nil,
+	}, nil
+}
+
+func pubsubItemsFromIQ(v *clientIQ) (PubsubItems, error) {
+	var p clientPubsubItems
+	err := xml.Unmarshal([]byte(v.Query.InnerXML), &p)
+	if err != nil {
+		return PubsubItems{}, err
+	}
+
+	return PubsubItems{
+		p.Node,
+		pubsubItemsToReturn(p.Items),
+	}, nil
+}
+
+// pubsubRequest is the pubsub element of a request, carrying one of the
+// subscribe, unsubscribe or items elements.
+type pubsubRequest struct {
+	XMLName     xml.Name            `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Subscribe   *pubsubSubscription `xml:"subscribe"`
+	Unsubscribe *pubsubSubscription `xml:"unsubscribe"`
+	Items       *pubsubItemsRequest `xml:"items"`
+}
+
+type pubsubSubscription struct {
+	Node string `xml:"node,attr"`
+	JID  string `xml:"jid,attr"`
 }
 
-func pubsubSubscriptionStanza(node, jid string) string {
-	body := fmt.Sprintf("<subscribe node='%s' jid='%s'/>",
-		xmlEscape(node),
-		xmlEscape(jid))
-	return pubsubStanza(body)
+type pubsubItemsRequest struct {
+	Node string             `xml:"node,attr"`
+	Item *pubsubItemRequest `xml:"item"`
 }
 
-func pubsubUnsubscriptionStanza(node, jid string) string {
-	body := fmt.Sprintf("<unsubscribe node='%s' jid='%s'/>",
-		xmlEscape(node),
-		xmlEscape(jid))
-	return pubsubStanza(body)
+type pubsubItemRequest struct {
+	ID string `xml:"id,attr"`
+}
+
+func pubsubSubscribe(node, jid string) *pubsubRequest {
+	return &pubsubRequest{Subscribe: &pubsubSubscription{Node: node, JID: jid}}
+}
+
+func pubsubUnsubscribe(node, jid string) *pubsubRequest {
+	return &pubsubRequest{Unsubscribe: &pubsubSubscription{Node: node, JID: jid}}
+}
+
+// pubsubItems requests the item id of node, or the last items if id is
+// empty.
+func pubsubItems(node, id string) *pubsubRequest {
+	items := &pubsubItemsRequest{Node: node}
+	if id != "" {
+		items.Item = &pubsubItemRequest{ID: id}
+	}
+	return &pubsubRequest{Items: items}
 }
 
 func (c *Client) PubsubSubscribeNode(node, jid string) error {
 	id := getUUID()
 	c.subIDs = append(c.subIDs, id)
-	_, err := c.RawInformation(c.jid,
-		jid,
-		id,
-		"set",
-		pubsubSubscriptionStanza(node, c.jid))
+	_, err := c.encode(&stanza.IQ{From: c.jid, To: jid, ID: id, Type: IQTypeSet,
+		Payload: []any{pubsubSubscribe(node, c.jid)}})
 	return err
 }
 
 func (c *Client) PubsubUnsubscribeNode(node, jid string) error {
 	id := getUUID()
 	c.unsubIDs = append(c.unsubIDs, id)
-	_, err := c.RawInformation(c.jid,
-		jid,
-		id,
-		"set",
-		pubsubUnsubscriptionStanza(node, c.jid))
+	_, err := c.encode(&stanza.IQ{From: c.jid, To: jid, ID: id, Type: IQTypeSet,
+		Payload: []any{pubsubUnsubscribe(node, c.jid)}})
 	return err
 }
 
 func (c *Client) PubsubRequestLastItems(node, jid string) error {
 	id := getUUID()
 	c.itemsIDs = append(c.itemsIDs, id)
-	body := fmt.Sprintf("<items node='%s'/>", node)
-	_, err := c.RawInformation(c.jid, jid, id, "get", pubsubStanza(body))
+	_, err := c.encode(&stanza.IQ{From: c.jid, To: jid, ID: id, Type: IQTypeGet,
+		Payload: []any{pubsubItems(node, "")}})
 	return err
 }
 
 func (c *Client) PubsubRequestItem(node, jid, id string) error {
 	stanzaID := getUUID()
 	c.itemsIDs = append(c.itemsIDs, stanzaID)
-	body := fmt.Sprintf("<items node='%s'><item id='%s'/></items>", node, id)
-	_, err := c.RawInformation(c.jid, jid, stanzaID, "get", pubsubStanza(body))
+	_, err := c.encode(&stanza.IQ{From: c.jid, To: jid, ID: stanzaID, Type: IQTypeGet,
+		Payload: []any{pubsubItems(node, id)}})
 	return err
 }
@@ -0,0 +1,36 @@
+package xmpp
+
+import (
+	"encoding/xml"
+
+	"github.com/xmppo/go-xmpp/stanza"
+)
+
+func init() {
+	registerFeature(XMPPNS_RECEIPTS, func(o *Options) bool { return o.SendReceipts })
+}
+
+// receiptReceived is the XEP-0184 receipt of the message with ID.
+type receiptReceived struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+	ID      string   `xml:"id,attr"`
+}
+
+// sendReceipt acknowledges the message v if it requests a XEP-0184
+// receipt and Options.SendReceipts is set. Following XEP-0184 section 5.3
+// groupchat messages are not acknowledged, otherwise every occupant would
+// reply to the room.
+func (c *Client) sendReceipt(v *clientMessage) error {
+	if c.Options == nil || !c.Options.SendReceipts || v.Type == "error" || v.Type == "groupchat" ||
+		v.ID == "" || v.From == "" {
+		return nil
+	}
+	for _, e := range v.Other {
+		if e.XMLName == (xml.Name{Space: XMPPNS_RECEIPTS, Local: "request"}) {
+			_, err := c.encode(&stanza.Message{To: v.From, ID: getUUID(),
+				Payload: []any{&receiptReceived{ID: v.ID}}})
+			return err
+		}
+	}
+	return nil
+}
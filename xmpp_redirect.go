@@ -0,0 +1,68 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// maxRedirects limits the number of see-other-host redirects followed in a
+// session.
+const maxRedirects = 5
+
+// addRedirect records a redirect to host. It fails if the session was
+// already redirected to host or too many redirects were followed.
+func (c *Client) addRedirect(host string) error {
+	if slices.Contains(c.redirects, host) {
+		return errors.New("see-other-host: redirect loop at " + host)
+	}
+	if len(c.redirects) >= maxRedirects {
+		return errors.New("see-other-host: too many redirects")
+	}
+	c.redirects = append(c.redirects, host)
+	return nil
+}
+
+// Redirect follows a see-other-host stream error received after login: it
+// connects to host, usually StreamError.Host, and logs in again with the
+// clients options. Like Resume, the XEP-0198 session is resumed if possible.
+// The old client must not be used afterwards.
+//
+// Redirects are only followed from encrypted TCP connections, so a forged
+// redirect can not divert the session. Redirect fails if the session was
+// already redirected to host or after too many redirects.
+func (c *Client) Redirect(host string) (*Client, error) {
+	if !c.IsEncrypted() || c.Options.WebSocketURL != "" || c.Options.BOSHURL != "" {
+		return nil, errors.New("see-other-host: redirects are only followed from encrypted TCP connections")
+	}
+	if err := c.addRedirect(host); err != nil {
+		return nil, err
+	}
+	c.logger().Info("redirected", "host", host)
+	var resume *SMState
+	if c.StreamManagementEnabled() {
+		if state := c.SMState(); state.ID != "" {
+			resume = &state
+		}
+	}
+	c.shutdown.Store(true)
+	c.stopPeriodicPings()
+	c.conn.Close()
+	c.stopWriter()
+
+	o := c.options()
+	if resume != nil {
+		o.StreamManagement = true
+	}
+	ctx := context.Background()
+	conn, err := o.connect(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	next, err := o.newClientConn(ctx, conn, resume, c.redirects)
+	if err != nil {
+		return nil, err
+	}
+	next.metrics().Reconnected()
+	return next, nil
+}
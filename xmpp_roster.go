@@ -0,0 +1,234 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"slices"
+	"sync"
+
+	"github.com/xmppo/go-xmpp/jid"
+	"github.com/xmppo/go-xmpp/stanza"
+)
+
+// Subscription states of roster items, see RFC 6121 section 2.1.2.5.
+// SubscriptionRemove is only used to remove items.
+const (
+	SubscriptionNone   = "none"
+	SubscriptionTo     = "to"
+	SubscriptionFrom   = "from"
+	SubscriptionBoth   = "both"
+	SubscriptionRemove = "remove"
+)
+
+// RosterItem is a contact in the roster as described in RFC 6121 section
+// 2.1.2.
+type RosterItem struct {
+	JID  string
+	Name string
+	// Subscription is one of the Subscription constants.
+	Subscription string
+	// Ask is "subscribe" while a subscription request sent to the contact
+	// is pending.
+	Ask string
+	// Approved is set if the contact's subscription request was
+	// pre-approved.
+	Approved bool
+	Groups   []string
+}
+
+// RosterEvent is returned by Recv for the roster requested with Roster and
+// for roster pushes, which the client acknowledges and applies to the
+// RosterStore before returning them.
+type RosterEvent struct {
+	// Push is set for roster pushes. They carry the changed item, removed
+	// items have the subscription "remove". Otherwise Items is the complete
+	// roster.
+	Push  bool
+	Items []RosterItem
+	// Ver is the roster version, if the server supports XEP-0237.
+	Ver string
+}
+
+// rosterState tracks the roster requests of a client.
+type rosterState struct {
+	sync.Mutex
+	ids        []string          // IDs of Roster requests waiting for the result.
+	versioning bool              // Server supports XEP-0237: Roster Versioning.
+	mem        MemoryRosterStore // Used if Options.RosterStore is not set.
+}
+
+// take reports whether id is a pending roster request and forgets it.
+func (r *rosterState) take(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	i := slices.Index(r.ids, id)
+	if i < 0 {
+		return false
+	}
+	r.ids = slices.Delete(r.ids, i, i+1)
+	return true
+}
+
+// rosterQuery is the query element of roster requests.
+type rosterQuery struct {
+	XMLName xml.Name        `xml:"jabber:iq:roster query"`
+	Ver     *string         `xml:"ver,attr"`
+	Items   []rosterSetItem `xml:"item"`
+}
+
+// rosterSetItem is an item of a roster set. Clients must not send the ask
+// and approved attributes.
+type rosterSetItem struct {
+	JID          string   `xml:"jid,attr"`
+	Name         string   `xml:"name,attr,omitempty"`
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Groups       []string `xml:"group"`
+}
+
+func (q *clientQuery) rosterItems() []RosterItem {
+	var items []RosterItem
+	for _, item := range q.Item {
+		items = append(items, RosterItem{
+			JID:          item.Jid,
+			Name:         item.Name,
+			Subscription: item.Subscription,
+			Ask:          item.Ask,
+			Approved:     item.Approved == "true" || item.Approved == "1",
+			Groups:       item.Group,
+		})
+	}
+	return items
+}
+
+// rosterSet returns the IQ adding, updating or removing item.
+func rosterSet(item RosterItem) *stanza.IQ {
+	set := rosterSetItem{JID: item.JID, Name: item.Name, Groups: item.Groups}
+	if item.Subscription == SubscriptionRemove {
+		set = rosterSetItem{JID: item.JID, Subscription: SubscriptionRemove}
+	}
+	return &stanza.IQ{ID: getUUID(), Type: IQTypeSet,
+		Payload: []any{&rosterQuery{Items: []rosterSetItem{set}}}}
+}
+
+// rosterStore returns Options.RosterStore or the store of the client.
+func (c *Client) rosterStore() RosterStore {
+	if c.Options != nil && c.Options.RosterStore != nil {
+		return c.Options.RosterStore
+	}
+	return &c.roster.mem
+}
+
+// rosterRequest returns the IQ requesting the roster. It carries the stored
+// version if the server supports roster versioning.
+func (c *Client) rosterRequest(id string) *stanza.IQ {
+	q := &rosterQuery{}
+	if c.roster.versioning {
+		ver, _, err := c.rosterStore().Load()
+		if err != nil {
+			c.logger().Warn("loading roster failed", "err", err)
+			ver = ""
+		}
+		q.Ver = &ver
+	}
+	return &stanza.IQ{From: c.jid, Type: IQTypeGet, ID: id, Payload: []any{q}}
+}
+
+// rosterResult returns the roster of the result of a roster request and
+// stores it. An empty result means the stored roster is up to date and
+// the pushes with the changes follow, see XEP-0237 section 2.4.
+func (c *Client) rosterResult(inner []byte) (RosterEvent, error) {
+	store := c.rosterStore()
+	if len(bytes.TrimSpace(inner)) == 0 {
+		ver, items, err := store.Load()
+		return RosterEvent{Items: items, Ver: ver}, err
+	}
+	var q clientQuery
+	if err := xml.Unmarshal(inner, &q); err != nil {
+		return RosterEvent{}, err
+	}
+	items := q.rosterItems()
+	if err := store.Replace(q.Ver, items); err != nil {
+		c.logger().Warn("storing roster failed", "err", err)
+	}
+	return RosterEvent{Items: items, Ver: q.Ver}, nil
+}
+
+// Roster asks for the roster. It is returned by Recv as RosterEvent.
+func (c *Client) Roster() error {
+	id := getUUID()
+	c.roster.Lock()
+	c.roster.ids = append(c.roster.ids, id)
+	c.roster.Unlock()
+	_, err := c.encode(c.rosterRequest(id))
+	return err
+}
+
+// RosterSnapshot returns the last roster received from the server with the
+// pushes received since then applied, or the roster loaded from
+// Options.RosterStore before it was requested. Recv returns a RosterEvent
+// for every change.
+func (c *Client) RosterSnapshot() ([]RosterItem, error) {
+	_, items, err := c.rosterStore().Load()
+	return items, err
+}
+
+// RosterAdd adds item to the roster and returns the id of the request. The
+// server pushes the new item to all clients of the account, so it is also
+// returned by Recv as RosterEvent. The reply to the request is returned by
+// Recv as IQ with the returned id, its StanzaError is set if the server
+// refused the change, e.g. with ErrNotAcceptable. RosterAddContext waits
+// for the reply instead.
+func (c *Client) RosterAdd(item RosterItem) (string, error) {
+	item.Subscription = ""
+	iq := rosterSet(item)
+	_, err := c.encode(iq)
+	return iq.ID, err
+}
+
+// RosterUpdate changes the name and groups of a contact in the roster like
+// RosterAdd. The name and the groups are replaced, not merged.
+func (c *Client) RosterUpdate(item RosterItem) (string, error) {
+	return c.RosterAdd(item)
+}
+
+// RosterRemove removes a contact from the roster like RosterAdd, which also
+// cancels the subscriptions in both directions.
+func (c *Client) RosterRemove(jid string) (string, error) {
+	iq := rosterSet(RosterItem{JID: jid, Subscription: SubscriptionRemove})
+	_, err := c.encode(iq)
+	return iq.ID, err
+}
+
+// isRosterPushFrom reports whether a roster push from the address from is
+// legitimate. RFC 6121 section 2.1.6 only allows pushes without from or from
+// the bare JID of the account.
+func (c *Client) isRosterPushFrom(from string) bool {
+	if from == "" {
+		return true
+	}
+	own, err := jid.Parse(c.jid)
+	if err != nil {
+		return false
+	}
+	return sameJID(from, own.Bare().String())
+}
+
+// handleRosterPush acknowledges a roster push and returns it as event.
+func (c *Client) handleRosterPush(v *clientIQ) (RosterEvent, bool, error) {
+	if !c.isRosterPushFrom(v.From) {
+		c.logger().Warn("ignoring roster push from foreign address", "from", v.From, "id", v.ID)
+		return RosterEvent{}, false, nil
+	}
+	var q clientQuery
+	if err := xml.Unmarshal(v.InnerXML, &q); err != nil {
+		return RosterEvent{}, false, err
+	}
+	items := q.rosterItems()
+	if err := c.rosterStore().Apply(q.Ver, items); err != nil {
+		c.logger().Warn("storing roster push failed", "err", err)
+	}
+	if _, err := c.encode(&stanza.IQ{To: v.From, ID: v.ID, Type: IQTypeResult}); err != nil {
+		return RosterEvent{}, false, err
+	}
+	return RosterEvent{Push: true, Items: items, Ver: q.Ver}, true, nil
+}
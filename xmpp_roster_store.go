@@ -0,0 +1,181 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// RosterStore keeps a roster and its XEP-0237 version, see
+// Options.RosterStore. A RosterStore may be shared by several clients of
+// the same account and must be safe for concurrent use.
+type RosterStore interface {
+	// Load returns the stored roster and its version. The version is
+	// empty if the roster was never stored or the server does not
+	// support roster versioning.
+	Load() (ver string, items []RosterItem, err error)
+
+	// Replace stores the complete roster received from the server.
+	Replace(ver string, items []RosterItem) error
+
+	// Apply stores the items of a roster push. Items with the
+	// subscription SubscriptionRemove are deleted, the others replace the
+	// item with the same JID or are added.
+	Apply(ver string, items []RosterItem) error
+}
+
+// applyRosterPush returns roster with the items of a roster push applied.
+func applyRosterPush(roster, push []RosterItem) []RosterItem {
+	for _, item := range push {
+		i := slices.IndexFunc(roster, func(r RosterItem) bool { return sameJID(r.JID, item.JID) })
+		switch {
+		case item.Subscription == SubscriptionRemove:
+			if i >= 0 {
+				roster = slices.Delete(roster, i, i+1)
+			}
+		case i >= 0:
+			roster[i] = item
+		default:
+			roster = append(roster, item)
+		}
+	}
+	return roster
+}
+
+// cloneRoster returns a deep copy of items.
+func cloneRoster(items []RosterItem) []RosterItem {
+	if items == nil {
+		return nil
+	}
+	c := make([]RosterItem, len(items))
+	for i, item := range items {
+		item.Groups = slices.Clone(item.Groups)
+		c[i] = item
+	}
+	return c
+}
+
+// MemoryRosterStore is a RosterStore keeping the roster in memory. It
+// survives reconnects if the clients share it, but not restarts of the
+// program. The zero value is ready to use.
+type MemoryRosterStore struct {
+	mu    sync.Mutex
+	ver   string
+	items []RosterItem
+}
+
+func (s *MemoryRosterStore) Load() (string, []RosterItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ver, cloneRoster(s.items), nil
+}
+
+func (s *MemoryRosterStore) Replace(ver string, items []RosterItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ver, s.items = ver, cloneRoster(items)
+	return nil
+}
+
+func (s *MemoryRosterStore) Apply(ver string, items []RosterItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ver, s.items = ver, applyRosterPush(s.items, cloneRoster(items))
+	return nil
+}
+
+// FileRosterStore is a RosterStore keeping the roster in a JSON file, so
+// that it survives restarts of the program. The file is read on first use
+// and replaced on every change. It must not be shared between processes.
+type FileRosterStore struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	roster fileRoster
+}
+
+// fileRoster is the content of the file of a FileRosterStore.
+type fileRoster struct {
+	Ver   string       `json:"ver"`
+	Items []RosterItem `json:"items"`
+}
+
+// NewFileRosterStore returns a FileRosterStore using the file path, which
+// is created when the roster is first stored.
+func NewFileRosterStore(path string) *FileRosterStore {
+	return &FileRosterStore{path: path}
+}
+
+// load reads the file unless it was read before. A missing file is an
+// empty roster.
+func (s *FileRosterStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &s.roster); err != nil {
+			return err
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// save replaces the file by r and keeps r if that succeeded.
+func (s *FileRosterStore) save(r fileRoster) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	s.roster, s.loaded = r, true
+	return nil
+}
+
+func (s *FileRosterStore) Load() (string, []RosterItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", nil, err
+	}
+	return s.roster.Ver, cloneRoster(s.roster.Items), nil
+}
+
+func (s *FileRosterStore) Replace(ver string, items []RosterItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(fileRoster{Ver: ver, Items: cloneRoster(items)})
+}
+
+func (s *FileRosterStore) Apply(ver string, items []RosterItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.save(fileRoster{Ver: ver, Items: applyRosterPush(cloneRoster(s.roster.Items), cloneRoster(items))})
+}
@@ -0,0 +1,105 @@
+package xmpp
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+)
+
+// Resolver looks up DNS SRV records. *net.Resolver implements it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// srvTarget is a host to connect to as found in the SRV records of a domain.
+type srvTarget struct {
+	Addr string
+	// DirectTLS is true for XEP-0368 _xmpps-client records, where TLS is
+	// negotiated right after connecting instead of using STARTTLS.
+	DirectTLS bool
+	priority  uint16
+	weight    uint16
+}
+
+// lookupTargets returns the connection targets for domain from its
+// _xmpps-client (XEP-0368) and _xmpp-client (RFC 6120) SRV records, ordered
+// as described in RFC 2782. Direct TLS records are skipped if directTLS is
+// false. The result is empty if the domain has no usable records.
+func lookupTargets(ctx context.Context, r Resolver, domain string, directTLS bool) []srvTarget {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	var targets []srvTarget
+	services := []string{"xmpp-client"}
+	if directTLS {
+		services = append(services, "xmpps-client")
+	}
+	for _, service := range services {
+		_, addrs, err := r.LookupSRV(ctx, service, "tcp", domain)
+		if err != nil {
+			continue
+		}
+		// A single record with target "." means the service is decidedly
+		// not available (RFC 2782).
+		if len(addrs) == 1 && (addrs[0].Target == "." || addrs[0].Target == "") {
+			continue
+		}
+		for _, a := range addrs {
+			targets = append(targets, srvTarget{
+				Addr:      net.JoinHostPort(trimDot(a.Target), strconv.Itoa(int(a.Port))),
+				DirectTLS: service == "xmpps-client",
+				priority:  a.Priority,
+				weight:    a.Weight,
+			})
+		}
+	}
+	orderTargets(targets)
+	return targets
+}
+
+// orderTargets sorts targets by priority and orders targets of the same
+// priority by the weighted random selection of RFC 2782.
+func orderTargets(targets []srvTarget) {
+	slices.SortStableFunc(targets, func(a, b srvTarget) int {
+		return int(a.priority) - int(b.priority)
+	})
+	for start := 0; start < len(targets); {
+		end := start + 1
+		for end < len(targets) && targets[end].priority == targets[start].priority {
+			end++
+		}
+		group := targets[start:end]
+		// Records with weight zero have a very small chance of being
+		// selected first, they are put at the beginning before selection.
+		slices.SortStableFunc(group, func(a, b srvTarget) int {
+			return int(a.weight) - int(b.weight)
+		})
+		for i := range group {
+			sum := 0
+			for _, t := range group[i:] {
+				sum += int(t.weight)
+			}
+			n := rand.IntN(sum + 1)
+			running := 0
+			for j := i; j < len(group); j++ {
+				running += int(group[j].weight)
+				if running >= n {
+					selected := group[j]
+					copy(group[i+1:j+1], group[i:j])
+					group[i] = selected
+					break
+				}
+			}
+		}
+		start = end
+	}
+}
+
+func trimDot(host string) string {
+	if len(host) > 1 && host[len(host)-1] == '.' {
+		return host[:len(host)-1]
+	}
+	return host
+}
@@ -0,0 +1,309 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+type smFeature struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 sm"`
+}
+
+type smEnabled struct {
+	XMLName  xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	ID       string   `xml:"id,attr"`
+	Location string   `xml:"location,attr"`
+	Max      string   `xml:"max,attr"`
+	Resume   string   `xml:"resume,attr"`
+}
+
+type smResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	H       uint32   `xml:"h,attr"`
+	PrevID  string   `xml:"previd,attr"`
+}
+
+type smFailed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	H       string   `xml:"h,attr"`
+	Any     xml.Name `xml:",any"`
+}
+
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type smAnswer struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
+
+// SMState is a snapshot of a XEP-0198 Stream Management session. It can
+// be passed to Options.Resume to continue the session on a new connection.
+type SMState struct {
+	// ID is the stream management id assigned by the server. It is
+	// empty if the server did not allow resumption.
+	ID string
+	// JID is the full JID bound to the session.
+	JID string
+	// Location is the preferred host:port to reconnect to, if the server
+	// provided one.
+	Location string
+	// Inbound is the number of stanzas received from the server.
+	Inbound uint32
+	// Outbound is the number of stanzas sent to the server.
+	Outbound uint32
+	// Unacked holds the sent stanzas that the server did not acknowledge
+	// yet, oldest first.
+	Unacked []string
+}
+
+// streamManagement holds the state of XEP-0198: Stream Management.
+type streamManagement struct {
+	sync.Mutex
+	enabled  bool
+	id       string
+	location string
+	inbound  uint32 // Stanzas handled by us.
+	outbound uint32 // Stanzas sent by us.
+	acked    uint32 // Last h value received from the server.
+	unacked  []string
+}
+
+// ack drops the stanzas acknowledged by h from the queue of unacknowledged
+// stanzas. The caller must hold the lock.
+func (sm *streamManagement) ack(h uint32) {
+	n := int(h - sm.acked)
+	if n > len(sm.unacked) {
+		n = len(sm.unacked)
+	}
+	sm.unacked = sm.unacked[n:]
+	sm.acked = h
+}
+
+// sendStanza passes a single stanza through the outbound interceptors and
+// writes it to the stream.
+func (c *Client) sendStanza(stanza string) (n int, err error) {
+	return c.interceptOutbound(stanza, c.writeStanza)
+}
+
+// writeStanza writes a single stanza to the stream. If XEP-0198 Stream
+// Management is enabled the stanza is counted and kept until the server
+// acknowledges it.
+func (c *Client) writeStanza(stanza string) (n int, err error) {
+	if c.component {
+		stanza = c.componentFrom(stanza)
+	}
+	// The writer lock keeps the unacknowledged stanzas in the order they
+	// are sent, the stream management lock is only held for counting.
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	n, err = c.write(stanza)
+	if errors.Is(err, ErrSendQueueFull) {
+		return n, err
+	}
+	c.metrics().StanzaSent(stanzaKind(stanza))
+	// Stanzas that failed to be written are kept as well, so they are
+	// sent again when the session is resumed.
+	c.sm.Lock()
+	if c.sm.enabled {
+		c.sm.outbound++
+		c.sm.unacked = append(c.sm.unacked, stanza)
+	}
+	c.sm.Unlock()
+	return n, err
+}
+
+// smHandled counts a received stanza if stream management is enabled.
+func (c *Client) smHandled() {
+	c.sm.Lock()
+	if c.sm.enabled {
+		c.sm.inbound++
+	}
+	c.sm.Unlock()
+}
+
+// smAnswerRequest answers a <r/> from the server with the number of handled stanzas.
+func (c *Client) smAnswerRequest() error {
+	c.sm.Lock()
+	h := c.sm.inbound
+	c.sm.Unlock()
+	_, err := c.writef("<a xmlns='%s' h='%d'/>\n", XMPPNS_SM_3, h)
+	return err
+}
+
+// smHandleAnswer processes a <a/> received from the server.
+func (c *Client) smHandleAnswer(h uint32) {
+	c.sm.Lock()
+	c.sm.ack(h)
+	c.sm.Unlock()
+}
+
+// RequestAck asks the server to acknowledge the stanzas it received so far
+// (XEP-0198). The server answer is processed by Recv.
+func (c *Client) RequestAck() error {
+	c.sm.Lock()
+	enabled := c.sm.enabled
+	c.sm.Unlock()
+	if !enabled {
+		return errors.New("stream management is not enabled")
+	}
+	_, err := c.writef("<r xmlns='%s'/>\n", XMPPNS_SM_3)
+	return err
+}
+
+// StreamManagementEnabled reports whether XEP-0198 Stream Management is active
+// on the current stream.
+func (c *Client) StreamManagementEnabled() bool {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	return c.sm.enabled
+}
+
+// SMState returns a snapshot of the XEP-0198 Stream Management session that
+// can be used to resume it later.
+func (c *Client) SMState() SMState {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	return SMState{
+		ID:       c.sm.id,
+		JID:      c.jid,
+		Location: c.sm.location,
+		Inbound:  c.sm.inbound,
+		Outbound: c.sm.outbound,
+		Unacked:  slices.Clone(c.sm.unacked),
+	}
+}
+
+// smEnable enables stream management after resource binding and waits for the
+// servers answer. A refusal by the server is not an error, the session just
+// continues without stream management.
+func (c *Client) smEnable() error {
+	_, err := c.writef("<enable xmlns='%s' resume='true'/>\n", XMPPNS_SM_3)
+	if err != nil {
+		return err
+	}
+	name, val, err := c.next()
+	if err != nil {
+		return err
+	}
+	switch v := val.(type) {
+	case *smEnabled:
+		c.sm.Lock()
+		c.sm.enabled = true
+		if v.Resume == "true" || v.Resume == "1" {
+			c.sm.id = v.ID
+			c.sm.location = v.Location
+		}
+		c.sm.Unlock()
+		return nil
+	case *smFailed:
+		return nil
+	default:
+		return errors.New("sm: expected <enabled> or <failed>, got <" + name.Local + "> in " + name.Space)
+	}
+}
+
+// smResume tries to resume the stream management session stored in
+// c.smPrevious instead of binding a new resource. It returns false if the
+// server refused the resumption.
+func (c *Client) smResume() (bool, error) {
+	state := c.smPrevious
+	_, err := c.writef("<resume xmlns='%s' h='%d' previd='%s'/>\n",
+		XMPPNS_SM_3, state.Inbound, xmlEscape(state.ID))
+	if err != nil {
+		return false, err
+	}
+	name, val, err := c.next()
+	if err != nil {
+		return false, err
+	}
+	switch v := val.(type) {
+	case *smResumed:
+		c.jid = state.JID
+		c.smWasResumed = true
+		c.sm.Lock()
+		c.sm.enabled = true
+		c.sm.id = state.ID
+		c.sm.location = state.Location
+		c.sm.inbound = state.Inbound
+		c.sm.outbound = state.Outbound
+		c.sm.acked = state.Outbound - uint32(len(state.Unacked))
+		c.sm.unacked = slices.Clone(state.Unacked)
+		c.sm.ack(v.H)
+		resend := c.sm.unacked
+		// The server counts the resent stanzas again.
+		c.sm.outbound = v.H
+		c.sm.unacked = nil
+		c.sm.Unlock()
+		// The stanzas already passed the outbound interceptors.
+		for _, stanza := range resend {
+			if _, err := c.writeStanza(stanza); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	case *smFailed:
+		// Keep the stanzas the server did not receive before the session
+		// was lost available for the caller.
+		sm := streamManagement{
+			acked:   state.Outbound - uint32(len(state.Unacked)),
+			unacked: slices.Clone(state.Unacked),
+		}
+		if h, err := strconv.ParseUint(v.H, 10, 32); err == nil {
+			sm.ack(uint32(h))
+		}
+		c.smLost = sm.unacked
+		return false, nil
+	default:
+		return false, errors.New("sm: expected <resumed> or <failed>, got <" + name.Local + "> in " + name.Space)
+	}
+}
+
+// Resumed reports whether the client continued a previous XEP-0198 session
+// instead of starting a new one.
+func (c *Client) Resumed() bool {
+	return c.smWasResumed
+}
+
+// LostStanzas returns the stanzas of a previous XEP-0198 session that were not
+// acknowledged by the server and could not be delivered because the
+// resumption failed. The caller may send them again.
+func (c *Client) LostStanzas() []string {
+	return slices.Clone(c.smLost)
+}
+
+// Resume reconnects to the server and resumes the XEP-0198 Stream Management
+// session described by state. Authentication is done as usual, but instead of
+// binding a new resource the previous session is taken back and all stanzas
+// not acknowledged by the server are sent again. If the server refuses the
+// resumption a new session is established and the undelivered stanzas are
+// available from LostStanzas.
+func (o Options) Resume(state SMState) (*Client, error) {
+	if state.ID == "" {
+		return nil, errors.New("sm: session is not resumable")
+	}
+	o.StreamManagement = true
+	if state.Location != "" {
+		o.Host = state.Location
+	}
+	return o.newClient(context.Background(), &state)
+}
+
+// Resume reconnects using the clients options and resumes its XEP-0198 Stream
+// Management session, see Options.Resume. The old client must not be used
+// afterwards.
+func (c *Client) Resume() (*Client, error) {
+	state := c.SMState()
+	c.shutdown.Store(true)
+	c.stopPeriodicPings()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.stopWriter()
+	return c.options().Resume(state)
+}
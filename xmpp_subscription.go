@@ -1,17 +1,15 @@
 package xmpp
 
 import (
-	"fmt"
+	"github.com/xmppo/go-xmpp/stanza"
 )
 
 func (c *Client) ApproveSubscription(jid string) {
-	fmt.Fprintf(c.stanzaWriter, "<presence to='%s' type='subscribed'/>\n",
-		xmlEscape(jid))
+	c.encode(&stanza.Presence{To: jid, Type: stanza.PresenceSubscribed})
 }
 
 func (c *Client) RevokeSubscription(jid string) {
-	fmt.Fprintf(c.stanzaWriter, "<presence to='%s' type='unsubscribed'/>\n",
-		xmlEscape(jid))
+	c.encode(&stanza.Presence{To: jid, Type: stanza.PresenceUnsubscribed})
 }
 
 // Deprecated: Use RevertSubscription instead.
@@ -20,11 +18,9 @@ func (c *Client) RetrieveSubscription(jid string) {
 }
 
 func (c *Client) RevertSubscription(jid string) {
-	fmt.Fprintf(c.conn, "<presence to='%s' type='unsubscribe'/>\n",
-		xmlEscape(jid))
+	c.encode(&stanza.Presence{To: jid, Type: stanza.PresenceUnsubscribe})
 }
 
 func (c *Client) RequestSubscription(jid string) {
-	fmt.Fprintf(c.stanzaWriter, "<presence to='%s' type='subscribe'/>\n",
-		xmlEscape(jid))
+	c.encode(&stanza.Presence{To: jid, Type: stanza.PresenceSubscribe})
 }
@@ -1,14 +1,33 @@
 package xmpp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/xmppo/go-xmpp/stanza"
+	"golang.org/x/net/websocket"
 )
 
 type localAddr struct{}
@@ -101,12 +120,151 @@ func TestStanzaError(t *testing.T) {
 	`,
 			},
 		},
+		StanzaError: &StanzaError{
+			Type:      "modify",
+			Condition: "bad-request",
+			Text:      "\n\t\t\tInvalidJson: JSON_PARSING_ERROR : Missing Required Field: message_id\\n\n\t\t",
+			Code:      "400",
+		},
 	}
 	if !reflect.DeepEqual(v, chat) {
 		t.Errorf("Recv() = %#v; want %#v", v, chat)
 	}
 }
 
+func TestStanzaErrorRecv(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<presence xmlns='jabber:client' from='room@muc.example.com/nick' type='error'>` +
+		`<error type='cancel' by='muc.example.com'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>Nickname &amp; more</text></error></presence>` +
+		`<iq xmlns='jabber:client' from='pubsub.example.com' id='1' type='error'><error type='cancel'>` +
+		`<item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>` +
+		`<invalid-jid xmlns='http://jabber.org/protocol/pubsub#errors'/></error></iq>`)
+	c.p = xml.NewDecoder(c.conn)
+
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := v.(Presence)
+	if !ok || p.StanzaError == nil {
+		t.Fatalf("Recv() = %#v", v)
+	}
+	if p.Error != "conflict" || p.StanzaError.Type != "cancel" || p.StanzaError.By != "muc.example.com" ||
+		p.StanzaError.Text != "Nickname & more" {
+		t.Errorf("presence error = %q, %#v", p.Error, p.StanzaError)
+	}
+	if !errors.Is(p.StanzaError, ErrConflict) || errors.Is(p.StanzaError, ErrItemNotFound) {
+		t.Errorf("errors.Is(%v) mismatch", p.StanzaError)
+	}
+
+	v, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iq, ok := v.(IQ)
+	if !ok || iq.StanzaError == nil {
+		t.Fatalf("Recv() = %#v", v)
+	}
+	var serr error = iq.StanzaError
+	if !errors.Is(serr, ErrItemNotFound) || !errors.Is(serr, &StanzaError{Type: "cancel", Condition: "item-not-found"}) {
+		t.Errorf("errors.Is(%v, ErrItemNotFound) = false", serr)
+	}
+	if errors.Is(serr, &StanzaError{Type: "wait", Condition: "item-not-found"}) {
+		t.Errorf("errors.Is matched a different type")
+	}
+	app := iq.StanzaError.AppCondition
+	if app == nil || app.XMLName != (xml.Name{Space: "http://jabber.org/protocol/pubsub#errors", Local: "invalid-jid"}) {
+		t.Errorf("AppCondition = %#v", app)
+	}
+}
+
+func TestStanzaErrorXML(t *testing.T) {
+	e := &StanzaError{
+		Type:      "cancel",
+		Condition: "feature-not-implemented",
+		Text:      "<none>",
+		AppCondition: &XMLElement{
+			XMLName: xml.Name{Space: "http://jabber.org/protocol/pubsub#errors", Local: "unsupported"},
+			Attr:    []xml.Attr{{Name: xml.Name{Local: "feature"}, Value: "publish"}},
+		},
+	}
+	want := `<error type="cancel"><feature-not-implemented xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></feature-not-implemented>` +
+		`<text xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">&lt;none&gt;</text>` +
+		`<unsupported xmlns="http://jabber.org/protocol/pubsub#errors" feature="publish"></unsupported></error>`
+	if got := e.XML(); got != want {
+		t.Errorf("XML() = %s\nwant %s", got, want)
+	}
+	var ce clientError
+	if err := xml.Unmarshal([]byte(want), &ce); err != nil {
+		t.Fatal(err)
+	}
+	got := ce.stanzaError()
+	if got.Type != e.Type || got.Condition != e.Condition || got.Text != e.Text ||
+		got.AppCondition == nil || got.AppCondition.XMLName != e.AppCondition.XMLName {
+		t.Errorf("parsed %#v", got)
+	}
+	if e.Error() != "stanza error: feature-not-implemented: <none>" {
+		t.Errorf("Error() = %q", e.Error())
+	}
+}
+
+func TestStanzaErrorXMLInjection(t *testing.T) {
+	e := &StanzaError{
+		Type:      "cancel'><x/>",
+		Condition: "'><x/>",
+		Text:      "'><x/>",
+		AppCondition: &XMLElement{
+			XMLName:  xml.Name{Space: "urn:example'><x/>", Local: "app"},
+			Attr:     []xml.Attr{{Name: xml.Name{Local: "a='1'><x/"}, Value: "v"}, {Name: xml.Name{Local: "b"}, Value: "'><x/>"}},
+			InnerXML: "</app><x/><app>",
+		},
+	}
+	want := `<error type="cancel&#39;&gt;&lt;x/&gt;"><undefined-condition xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></undefined-condition>` +
+		`<text xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">&#39;&gt;&lt;x/&gt;</text>` +
+		`<app xmlns="urn:example&#39;&gt;&lt;x/&gt;" b="&#39;&gt;&lt;x/&gt;"></app></error>`
+	if got := e.XML(); got != want {
+		t.Errorf("XML() = %s\nwant %s", got, want)
+	}
+	e.AppCondition.XMLName.Local = "app><x/"
+	if got := e.XML(); strings.Contains(got, "<x/>") || strings.Contains(got, "app") {
+		t.Errorf("XML() = %s", got)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<stream:error xmlns:stream='http://etherx.jabber.org/streams'>` +
+		`<conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>Replaced by new connection</text>` +
+		`<escape-your-data xmlns='http://example.org/ns'/></stream:error>`)
+	c.p = xml.NewDecoder(c.conn)
+	_, err := c.Recv()
+	var serr *StreamError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Recv() error = %v, want *StreamError", err)
+	}
+	if serr.Condition != "conflict" || serr.Text != "Replaced by new connection" || serr.Host != "" ||
+		serr.AppCondition == nil || serr.AppCondition.XMLName.Local != "escape-your-data" {
+		t.Errorf("stream error = %#v", serr)
+	}
+	if !errors.Is(err, &StreamError{Condition: "conflict"}) || errors.Is(err, &StreamError{Condition: "system-shutdown"}) {
+		t.Errorf("errors.Is(%v) mismatch", err)
+	}
+
+	c.conn = tConnect(`<stream:error xmlns:stream='http://etherx.jabber.org/streams'>` +
+		`<see-other-host xmlns='urn:ietf:params:xml:ns:xmpp-streams'>[2001:db8::1]:5222</see-other-host></stream:error>`)
+	c.p = xml.NewDecoder(c.conn)
+	_, err = c.Recv()
+	if !errors.As(err, &serr) || serr.Condition != "see-other-host" || serr.Host != "[2001:db8::1]:5222" {
+		t.Errorf("Recv() error = %#v", err)
+	}
+	// Redirects are not followed from unencrypted connections.
+	if _, err := c.Redirect(serr.Host); err == nil {
+		t.Error("Redirect on an unencrypted connection succeeded")
+	}
+}
+
 func TestEOFError(t *testing.T) {
 	var c Client
 	c.conn = tConnect("")
@@ -305,3 +463,1436 @@ func TestRawOob(t *testing.T) {
 		t.Errorf("Wrong URL: %s", s.Url)
 	}
 }
+
+var smStream = strings.TrimSpace(`
+<message xmlns="jabber:client" from="juliet@capulet.lit/balcony" type="chat"><body>one</body></message>
+<presence xmlns="jabber:client" from="juliet@capulet.lit/balcony"/>
+<r xmlns="urn:xmpp:sm:3"/>
+<a xmlns="urn:xmpp:sm:3" h="2"/>
+<message xmlns="jabber:client" from="juliet@capulet.lit/balcony" type="chat"><body>two</body></message>
+`)
+
+func TestStreamManagement(t *testing.T) {
+	var c Client
+	var out bytes.Buffer
+	c.conn = tConnect(smStream)
+	c.p = xml.NewDecoder(c.conn)
+	c.stanzaWriter = &out
+	c.sm.enabled = true
+
+	for _, text := range []string{"a", "b", "c"} {
+		if _, err := c.Send(Chat{Remote: "juliet@capulet.lit", Type: "chat", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := m.(Chat); !ok || v.Text != "two" {
+		t.Errorf("Recv() = %v; want second message", m)
+	}
+	if out.String() != "<a xmlns='urn:xmpp:sm:3' h='2'/>\n" {
+		t.Errorf("Answer to <r/> = %q", out.String())
+	}
+	state := c.SMState()
+	if state.Inbound != 3 || state.Outbound != 3 {
+		t.Errorf("SMState() counters = %d/%d; want 3/3", state.Inbound, state.Outbound)
+	}
+	if len(state.Unacked) != 1 || !strings.Contains(state.Unacked[0], "<body>c</body>") {
+		t.Errorf("SMState().Unacked = %q; want only the third message", state.Unacked)
+	}
+}
+
+func TestStreamManagementBlockedWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	var c Client
+	c.conn = client
+	c.stanzaWriter = client
+	c.sm.enabled = true
+
+	// The server does not read yet, so both writes block.
+	errs := make(chan error, 2)
+	go func() { errs <- c.RequestAck() }()
+	go func() {
+		_, err := c.Send(Chat{Remote: "juliet@capulet.lit", Type: "chat", Text: "hi"})
+		errs <- err
+	}()
+	state := make(chan SMState)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		state <- c.SMState()
+	}()
+	select {
+	case <-state:
+	case <-time.After(2 * time.Second):
+		t.Fatal("SMState() blocked by a pending write")
+	}
+
+	d := xml.NewDecoder(server)
+	for n := 0; n < 2; {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			if err := d.Skip(); err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := c.SMState(); s.Outbound != 1 || len(s.Unacked) != 1 {
+		t.Errorf("SMState() = %+v; want one unacknowledged stanza", s)
+	}
+}
+
+func TestPolicyBackoff(t *testing.T) {
+	p := Policy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Jitter: -1}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if d := p.backoff(i + 1); d != w {
+			t.Errorf("backoff(%d) = %v; want %v", i+1, d, w)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(2); d < time.Second || d > 3*time.Second {
+			t.Fatalf("backoff(2) with jitter = %v; want between 1s and 3s", d)
+		}
+	}
+}
+
+func TestSendIQ(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	var c Client
+	c.conn = client
+	c.p = xml.NewDecoder(client)
+	c.stanzaWriter = client
+	c.jid = "romeo@montague.lit/orchard"
+	c.domain = "montague.lit"
+
+	go func() {
+		var req struct {
+			ID string `xml:"id,attr"`
+		}
+		if err := xml.NewDecoder(server).Decode(&req); err != nil {
+			return
+		}
+		fmt.Fprintf(server, "<message xmlns='jabber:client' from='juliet@capulet.lit' type='chat'><body>hi</body></message>"+
+			"<iq xmlns='jabber:client' type='result' id='%s' from='juliet@capulet.lit/balcony'>"+
+			"<query xmlns='http://jabber.org/protocol/disco#info'><feature var='urn:xmpp:ping'/></query></iq>", req.ID)
+		if err := xml.NewDecoder(server).Decode(&req); err != nil {
+			return
+		}
+		fmt.Fprintf(server, "<iq xmlns='jabber:client' type='error' id='%s' from='juliet@capulet.lit/balcony'>"+
+			"<x xmlns='jabber:x:oob'><url>https://capulet.lit/file</url></x>"+
+			"<error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>", req.ID)
+		if err := xml.NewDecoder(server).Decode(&req); err != nil {
+			return
+		}
+		// Replies to requests to the own bare JID may lack from.
+		fmt.Fprintf(server, "<iq xmlns='jabber:client' type='result' id='%s'>"+
+			"<query xmlns='jabber:iq:private'><prefs xmlns='urn:example'/></query></iq>", req.ID)
+	}()
+
+	received := make(chan interface{}, 1)
+	go func() {
+		for {
+			m, err := c.Recv()
+			if err != nil {
+				return
+			}
+			received <- m
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.DiscoverInfoContext(ctx, "juliet@capulet.lit/balcony")
+	if err != nil {
+		t.Fatalf("DiscoverInfoContext() = %v", err)
+	}
+	if !reflect.DeepEqual(res.Features, []string{"urn:xmpp:ping"}) {
+		t.Errorf("DiscoverInfoContext().Features = %v", res.Features)
+	}
+	select {
+	case m := <-received:
+		if v, ok := m.(Chat); !ok || v.Text != "hi" {
+			t.Errorf("Recv() = %#v; want unrelated message", m)
+		}
+	case <-ctx.Done():
+		t.Fatal("unrelated message was not delivered by Recv()")
+	}
+
+	// Error replies carry the StanzaError and the extensions like those
+	// returned by Recv.
+	reply, err := c.SendIQ(ctx, IQ{To: "juliet@capulet.lit/balcony", Type: IQTypeGet,
+		Query: []byte("<x xmlns='jabber:x:oob'/>")})
+	if !errors.Is(err, ErrItemNotFound) {
+		t.Fatalf("SendIQ() error = %v", err)
+	}
+	var oob Oob
+	if reply == nil || !errors.Is(reply.StanzaError, ErrItemNotFound) || !reply.Extension(&oob) ||
+		oob.Url != "https://capulet.lit/file" {
+		t.Errorf("SendIQ() = %+v", reply)
+	}
+
+	reply, err = c.RawInformationQueryContext(ctx, "romeo@montague.lit", IQTypeGet, "jabber:iq:private",
+		"<prefs xmlns='urn:example'/>")
+	if err != nil {
+		t.Fatalf("RawInformationQueryContext() = %v", err)
+	}
+	if !strings.Contains(string(reply.Query), "urn:example") {
+		t.Errorf("RawInformationQueryContext().Query = %s", reply.Query)
+	}
+}
+
+func TestMux(t *testing.T) {
+	var out bytes.Buffer
+	c := Client{stanzaWriter: &out}
+	mux := NewMux()
+	var got []string
+	mux.HandleIQ(IQTypeGet, "urn:example:custom", "", func(c *Client, iq IQ) {
+		got = append(got, "iq:"+iq.ID)
+	})
+	mux.HandleMessageExtension("urn:example:ext", func(c *Client, chat Chat) {
+		got = append(got, "ext:"+chat.Text)
+	})
+	mux.HandleMessageExtension(XMPPNS_DELAY, func(c *Client, chat Chat) {
+		got = append(got, "delay:"+chat.Text)
+	})
+	mux.HandleMessage(func(c *Client, chat Chat) {
+		got = append(got, "msg:"+chat.Text)
+	})
+	mux.Handle(PubsubEvent{}, func(c *Client, stanza interface{}) {
+		got = append(got, "event:"+stanza.(PubsubEvent).Node)
+	})
+
+	stanzas := []interface{}{
+		IQ{ID: "1", Type: IQTypeGet, Query: []byte(`<query xmlns="urn:example:custom"/>`)},
+		Chat{Text: "a", OtherElem: []XMLElement{{XMLName: xml.Name{Space: "urn:example:ext", Local: "x"}}}},
+		Chat{Text: "b"},
+		Chat{Text: "c", Extensions: Extensions{&Delay{Stamp: "2002-09-10T23:08:25Z"}}},
+		Chat{Text: "d", Oob: Oob{Url: "https://example.com/a.png"}},
+		PubsubEvent{Node: "n"},
+		Presence{From: "juliet@capulet.lit"},
+	}
+	for _, s := range stanzas {
+		if err := mux.Dispatch(&c, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"iq:1", "ext:a", "msg:b", "delay:c", "msg:d", "event:n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dispatched = %v; want %v", got, want)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	err := mux.Dispatch(&c, IQ{ID: "2", From: "juliet@capulet.lit/balcony", Type: IQTypeSet, Query: []byte(`<query xmlns="urn:example:unknown"/>`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "type=\"error\"") || !strings.Contains(out.String(), "<service-unavailable") {
+		t.Errorf("unhandled IQ answered with %q; want service-unavailable", out.String())
+	}
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	out := []struct{ in, want string }{
+		{"<?xml version='1.0'?><stream:stream from='juliet@example.com' to='example.com' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>\n",
+			"<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' from='juliet@example.com' to='example.com' version='1.0'/>"},
+		{"</stream:stream>", "<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>"},
+		{"<message to='romeo@example.net' type='chat'><body>hi</body></message>\n",
+			"<message xmlns='jabber:client' to='romeo@example.net' type='chat'><body>hi</body></message>"},
+		{"<iq xmlns='jabber:client' type='get' id='1'/>", "<iq xmlns='jabber:client' type='get' id='1'/>"},
+		{"<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>AA==</auth>\n",
+			"<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>AA==</auth>"},
+		{" ", ""},
+	}
+	for _, tt := range out {
+		if got := string(streamToWS([]byte(tt.in))); got != tt.want {
+			t.Errorf("streamToWS(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+
+	in := []struct{ in, want string }{
+		{`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" from="example.com" id="++TR84Sm6A3hnt3Q065SnAbbk3Y=" version="1.0" xml:lang="en"/>`,
+			"<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.com' id='++TR84Sm6A3hnt3Q065SnAbbk3Y=' version='1.0'>"},
+		{`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`, "</stream:stream>"},
+		{`<message xmlns="jabber:client"><body>hi</body></message>`, `<message xmlns="jabber:client"><body>hi</body></message>`},
+	}
+	for _, tt := range in {
+		if got := string(wsToStream([]byte(tt.in))); got != tt.want {
+			t.Errorf("wsToStream(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// countingDialer counts the connections opened through it.
+type countingDialer struct {
+	net.Dialer
+	dials atomic.Int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestWebSocketConnect(t *testing.T) {
+	frames := make(chan string, 16)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		recv := func() string {
+			var s string
+			if err := websocket.Message.Receive(ws, &s); err != nil {
+				return ""
+			}
+			frames <- s
+			return s
+		}
+		send := func(s string) { websocket.Message.Send(ws, s) }
+		open := `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" from="example.com" id="s1" version="1.0"/>`
+		recv()
+		send(open)
+		send(`<stream:features xmlns:stream="http://etherx.jabber.org/streams"><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`)
+		recv()
+		send(`<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`)
+		recv()
+		send(open)
+		send(`<stream:features xmlns:stream="http://etherx.jabber.org/streams"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/></stream:features>`)
+		recv()
+		send(`<iq xmlns="jabber:client" type="result" id="x"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>juliet@example.com/ws</jid></bind></iq>`)
+		recv()
+		send(`<message xmlns="jabber:client" from="romeo@example.net/orchard" type="chat"><body>hi</body></message>`)
+		recv()
+		send(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`)
+	}))
+	defer srv.Close()
+
+	var dialer countingDialer
+	o := Options{
+		WebSocketURL:                 "ws" + strings.TrimPrefix(srv.URL, "http"),
+		User:                         "juliet@example.com",
+		Password:                     "secret",
+		InsecureAllowUnencryptedAuth: true,
+		Dialer:                       &dialer,
+	}
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := dialer.dials.Load(); n != 1 {
+		t.Errorf("WebSocket connection opened %d connections through Options.Dialer; want 1", n)
+	}
+	if c.JID() != "juliet@example.com/ws" {
+		t.Errorf("JID() = %q; want juliet@example.com/ws", c.JID())
+	}
+	stanza, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat, ok := stanza.(Chat); !ok || chat.Text != "hi" {
+		t.Errorf("Recv() = %#v; want chat hi", stanza)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(frames)
+	var got []string
+	for f := range frames {
+		got = append(got, f)
+	}
+	if len(got) != 6 || !strings.HasPrefix(got[0], "<open xmlns='urn:ietf:params:xml:ns:xmpp-framing'") ||
+		!strings.HasPrefix(got[4], "<presence xmlns='jabber:client'") ||
+		got[5] != "<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>" {
+		t.Errorf("unexpected frames %q", got)
+	}
+}
+
+func TestBOSHConnect(t *testing.T) {
+	var mu sync.Mutex
+	var rids []uint64
+	push := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RID     uint64 `xml:"rid,attr"`
+			SID     string `xml:"sid,attr"`
+			Type    string `xml:"type,attr"`
+			Restart string `xml:"urn:xmpp:xbosh restart,attr"`
+			Payload string `xml:",innerxml"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		rids = append(rids, body.RID)
+		mu.Unlock()
+		if body.SID == "" && len(rids) > 1 || body.SID != "" && body.SID != "s1" {
+			http.Error(w, "bad sid", http.StatusNotFound)
+			return
+		}
+		reply := func(attrs, payload string) {
+			fmt.Fprintf(w, `<body xmlns="http://jabber.org/protocol/httpbind" xmlns:stream="http://etherx.jabber.org/streams"%s>%s</body>`, attrs, payload)
+		}
+		switch {
+		case body.SID == "":
+			reply(` sid="s1" requests="2" wait="60" hold="1" from="example.com"`,
+				`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`)
+		case body.Restart == "true":
+			reply("", `<stream:features><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/></stream:features>`)
+		case body.Type == "terminate":
+			reply(` type="terminate"`, "")
+		case strings.HasPrefix(body.Payload, "<auth "):
+			reply("", `<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`)
+		case strings.HasPrefix(body.Payload, "<iq "):
+			reply("", `<iq xmlns="jabber:client" type="result" id="x"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>juliet@example.com/bosh</jid></bind></iq>`)
+		case strings.HasPrefix(body.Payload, "<presence xmlns='jabber:client'"):
+			push <- `<message xmlns="jabber:client" from="romeo@example.net/orchard" type="chat"><body>hi</body></message>`
+			reply("", "")
+		case body.Payload == "":
+			// Hold empty requests until there is something to push.
+			select {
+			case payload := <-push:
+				reply("", payload)
+			case <-time.After(100 * time.Millisecond):
+				reply("", "")
+			}
+		default:
+			http.Error(w, "unexpected payload", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	// The requests are sent through an authenticated HTTP proxy.
+	var proxied atomic.Int32
+	forward := &httputil.ReverseProxy{Rewrite: func(*httputil.ProxyRequest) {}}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Proxy-Authorization"), "Basic "))
+		if string(auth) != "user:secret" || !r.URL.IsAbs() {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		proxied.Add(1)
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	o := Options{
+		BOSHURL:                      srv.URL,
+		User:                         "juliet@example.com",
+		Password:                     "secret",
+		InsecureAllowUnencryptedAuth: true,
+		Proxy:                        proxyURL,
+	}
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.JID() != "juliet@example.com/bosh" {
+		t.Errorf("JID() = %q; want juliet@example.com/bosh", c.JID())
+	}
+	stanza, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat, ok := stanza.(Chat); !ok || chat.Text != "hi" {
+		t.Errorf("Recv() = %#v; want chat hi", stanza)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if proxied.Load() == 0 {
+		t.Error("no BOSH request was sent through Options.Proxy")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(rids)
+	for i := range rids {
+		if rids[i] != rids[0]+uint64(i) {
+			t.Errorf("rids %v are not consecutive", rids)
+			break
+		}
+	}
+}
+
+func TestBOSHDefaultRequests(t *testing.T) {
+	done := make(chan struct{})
+	sent := make(chan string, 1)
+	wake := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SID     string `xml:"sid,attr"`
+			Type    string `xml:"type,attr"`
+			Restart string `xml:"urn:xmpp:xbosh restart,attr"`
+			Payload string `xml:",innerxml"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply := func(attrs, payload string) {
+			fmt.Fprintf(w, `<body xmlns="http://jabber.org/protocol/httpbind" xmlns:stream="http://etherx.jabber.org/streams"%s>%s</body>`, attrs, payload)
+		}
+		if body.Payload != "" || body.Restart != "" {
+			// A new request releases the held one.
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+		switch {
+		case body.SID == "":
+			// No requests attribute.
+			reply(` sid="s1" wait="60" hold="1" from="example.com"`,
+				`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`)
+		case body.Restart == "true":
+			reply("", `<stream:features><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/></stream:features>`)
+		case body.Type == "terminate":
+			reply(` type="terminate"`, "")
+		case strings.HasPrefix(body.Payload, "<auth "):
+			reply("", `<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`)
+		case strings.HasPrefix(body.Payload, "<iq "):
+			reply("", `<iq xmlns="jabber:client" type="result" id="x"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>juliet@example.com/bosh</jid></bind></iq>`)
+		case body.Payload == "":
+			// Hold empty requests like a connection manager with
+			// nothing to push.
+			select {
+			case <-wake:
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+			reply("", "")
+		default:
+			if strings.HasPrefix(body.Payload, "<message") {
+				sent <- body.Payload
+			}
+			reply("", "")
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	c, err := Options{
+		BOSHURL:                      srv.URL,
+		User:                         "juliet@example.com",
+		Password:                     "secret",
+		InsecureAllowUnencryptedAuth: true,
+	}.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	if _, err := c.Send(Chat{Remote: "romeo@example.net", Type: "chat", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	// The message is sent next to the held poll.
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not sent while a poll was held")
+	}
+}
+
+type testResolver map[string][]*net.SRV
+
+func (r testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	addrs, ok := r["_"+service+"._"+proto+"."+name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return "", addrs, nil
+}
+
+func TestLookupTargets(t *testing.T) {
+	r := testResolver{
+		"_xmpp-client._tcp.example.com": {
+			{Target: "b.example.com.", Port: 5222, Priority: 20, Weight: 0},
+			{Target: "a.example.com.", Port: 5222, Priority: 10, Weight: 100},
+		},
+		"_xmpps-client._tcp.example.com": {
+			{Target: "a.example.com.", Port: 5223, Priority: 10, Weight: 0},
+			{Target: "c.example.com.", Port: 443, Priority: 5, Weight: 0},
+		},
+		"_xmpps-client._tcp.example.net": {{Target: ".", Port: 0}},
+	}
+	// The zero weight record at priority 10 is only picked first once in
+	// 101 tries, run often enough to see both orders.
+	orders := make(map[string]bool)
+	for range 2000 {
+		var got []string
+		for _, target := range lookupTargets(context.Background(), r, "example.com", true) {
+			got = append(got, fmt.Sprintf("%s/%t", target.Addr, target.DirectTLS))
+		}
+		orders[strings.Join(got, " ")] = true
+	}
+	want := map[string]bool{
+		"c.example.com:443/true a.example.com:5222/false a.example.com:5223/true b.example.com:5222/false": true,
+		"c.example.com:443/true a.example.com:5223/true a.example.com:5222/false b.example.com:5222/false": true,
+	}
+	if !reflect.DeepEqual(orders, want) {
+		t.Errorf("target orders = %v; want %v", orders, want)
+	}
+
+	if targets := lookupTargets(context.Background(), r, "example.com", false); len(targets) != 2 || targets[0].DirectTLS || targets[1].DirectTLS {
+		t.Errorf("targets without direct TLS = %v", targets)
+	}
+	if targets := lookupTargets(context.Background(), r, "example.net", true); len(targets) != 0 {
+		t.Errorf("targets for unavailable service = %v; want none", targets)
+	}
+}
+
+func TestDialTargets(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downPort := down.Addr().(*net.TCPAddr).Port
+	down.Close()
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	upPort := up.Addr().(*net.TCPAddr).Port
+
+	o := Options{
+		User: "juliet@example.com",
+		Resolver: testResolver{
+			"_xmpp-client._tcp.example.com": {
+				{Target: "127.0.0.1.", Port: uint16(downPort), Priority: 1},
+				{Target: "127.0.0.1.", Port: uint16(upPort), Priority: 2},
+			},
+		},
+		DialTimeout: time.Second,
+	}
+	c, err := o.dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().(*net.TCPAddr).Port != upPort {
+		t.Errorf("connected to %v; want port %d", c.RemoteAddr(), upPort)
+	}
+	if _, ok := c.(*tls.Conn); ok {
+		t.Error("_xmpp-client target connected with direct TLS")
+	}
+}
+
+// serverStep waits for the client to send data containing expect and then
+// answers with reply.
+type serverStep struct {
+	expect, reply string
+}
+
+// runServer plays steps on conn and reports the first mismatch on done.
+func runServer(conn net.Conn, steps []serverStep) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		var buf []byte
+		for _, s := range steps {
+			for !bytes.Contains(buf, []byte(s.expect)) {
+				p := make([]byte, 4096)
+				n, err := conn.Read(p)
+				if err != nil {
+					done <- fmt.Errorf("waiting for %q, got %q: %w", s.expect, buf, err)
+					return
+				}
+				buf = append(buf, p[:n]...)
+			}
+			buf = buf[bytes.Index(buf, []byte(s.expect))+len(s.expect):]
+			if s.reply == "" {
+				continue
+			}
+			if _, err := io.WriteString(conn, s.reply); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	return done
+}
+
+const testStreamHeader = "<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' id='s1' from='example.com' version='1.0'>"
+
+func TestNewClientFromConn(t *testing.T) {
+	client, server := net.Pipe()
+	done := runServer(server, []serverStep{
+		{"<stream:stream", testStreamHeader +
+			"<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"},
+		{"</auth>", "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>"},
+		{"<stream:stream", testStreamHeader +
+			"<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>"},
+		// The resource is escaped.
+		{"<resource>pipe&#39;&gt;&lt;x/&gt;</resource></bind></iq>", "<iq type='result' id='x'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>juliet@example.com/pipe</jid></bind></iq>"},
+		{"</presence>", ""},
+	})
+	c, err := NewClientFromConn(client, Options{
+		User:                         "juliet@example.com",
+		Password:                     "secret",
+		Resource:                     "pipe'><x/>",
+		InsecureAllowUnencryptedAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c.JID() != "juliet@example.com/pipe" {
+		t.Errorf("JID() = %q; want juliet@example.com/pipe", c.JID())
+	}
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		auth, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "Basic "))
+		if err != nil || string(auth) != "user:secret" ||
+			req.Method != http.MethodConnect || req.Host != "xmpp.example.com:5222" {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	}()
+
+	o := Options{Proxy: &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: l.Addr().String()}}
+	c, err := o.connect(context.Background(), "xmpp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("read %q through proxy; want hello", got)
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		read := func(n int) []byte {
+			p := make([]byte, n)
+			io.ReadFull(br, p)
+			return p
+		}
+		// Greeting, offering username/password authentication.
+		methods := read(2)
+		if !bytes.Contains(read(int(methods[1])), []byte{2}) {
+			conn.Write([]byte{5, 0xff})
+			return
+		}
+		conn.Write([]byte{5, 2})
+		// RFC 1929 username/password authentication.
+		user := read(int(read(2)[1]))
+		password := read(int(read(1)[0]))
+		if string(user) != "user" || string(password) != "secret" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		// Connect request for a domain name.
+		req := read(5)
+		host := read(int(req[4]))
+		read(2)
+		if string(host) != "xmpp.example.com" {
+			conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		io.WriteString(conn, "hello")
+	}()
+
+	o := Options{Proxy: &url.URL{Scheme: "socks5", User: url.UserPassword("user", "secret"), Host: l.Addr().String()}}
+	c, err := o.connect(context.Background(), "xmpp.example.com:5222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("read %q through proxy; want hello", got)
+	}
+}
+
+func TestNewClientContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// Accept the connection but never answer.
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewClientContext(ctx, Options{Host: l.Addr().String(), NoTLS: true, User: "juliet@example.com"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("NewClientContext() error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("NewClientContext() returned after %v", d)
+	}
+}
+
+func TestRecvContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	var c Client
+	c.conn = client
+	c.p = xml.NewDecoder(client)
+	c.stanzaWriter = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.RecvContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RecvContext() error = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// The interrupted read delivers the next stanza to the next call.
+	go io.WriteString(server, "<message xmlns='jabber:client' from='juliet@capulet.lit' type='chat'><body>one</body></message>"+
+		"<message xmlns='jabber:client' from='juliet@capulet.lit' type='chat'><body>two</body></message>")
+	for _, want := range []string{"one", "two"} {
+		stanza, err := c.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chat, ok := stanza.(Chat); !ok || chat.Text != want {
+			t.Errorf("Recv() = %#v; want chat %q", stanza, want)
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	var c Client
+	c.conn = client
+	c.stanzaWriter = client
+	c.Options = &Options{}
+	c.startWriter(2)
+
+	// The server does not read, so the writer blocks on the first stanza
+	// and the queue fills up.
+	sent := 0
+	for ; ; sent++ {
+		_, err := c.Send(Chat{Remote: "juliet@capulet.lit", Type: "chat", Text: fmt.Sprint(sent)})
+		if errors.Is(err, ErrSendQueueFull) {
+			break
+		}
+		if err != nil || sent > 3 {
+			t.Fatalf("Send(%d) = %v; want %v", sent, err, ErrSendQueueFull)
+		}
+	}
+	if sent < 2 {
+		t.Fatalf("queue full after %d stanzas", sent)
+	}
+
+	d := xml.NewDecoder(server)
+	for i := range sent {
+		var msg struct {
+			Body string `xml:"body"`
+		}
+		if err := d.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Body != fmt.Sprint(i) {
+			t.Errorf("message %d has body %q", i, msg.Body)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	var c Client
+	c.conn = client
+	c.stanzaWriter = client
+	c.Options = &Options{WriteTimeout: 50 * time.Millisecond}
+
+	_, err := c.Send(Chat{Remote: "juliet@capulet.lit", Type: "chat", Text: "hi"})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Send() to a stalled server = %v; want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestComponent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- <-runServer(conn, []serverStep{
+			{"to='gateway.example.com'>", "<?xml version='1.0'?><stream:stream xmlns='jabber:component:accept' " +
+				"xmlns:stream='http://etherx.jabber.org/streams' from='gateway.example.com' id='3BF96D32'>"},
+			{fmt.Sprintf("<handshake>%x</handshake>", sha1.Sum([]byte("3BF96D32secret"))), "<handshake/>" +
+				"<message from='romeo@example.net/orchard' to='bot@gateway.example.com' type='chat'><body>hi</body></message>"},
+			{"<message from='gateway.example.com' ", ""},
+			{`to="romeo@example.net/orchard"`, ""},
+			{`<presence from="bot@gateway.example.com"`, ""},
+			{`from="alice@gateway.example.com" to="romeo@example.net/orchard"`, ""},
+			{`from="bob@gateway.example.com" to="romeo@example.net/orchard"`, ""},
+		})
+	}()
+
+	c, err := ComponentOptions{Host: l.Addr().String(), Domain: "gateway.example.com", Secret: "secret"}.NewComponent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	stanza, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, ok := stanza.(Chat)
+	if !ok || chat.Text != "hi" || chat.Remote != "romeo@example.net/orchard" {
+		t.Fatalf("Recv() = %#v; want chat hi from romeo@example.net/orchard", stanza)
+	}
+	if _, err := c.Send(Chat{Remote: chat.Remote, Type: "chat", Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SendPresence(Presence{From: "bot@gateway.example.com", To: chat.Remote}); err != nil {
+		t.Fatal(err)
+	}
+	// A gateway sends as its users.
+	for _, from := range []string{"alice@gateway.example.com", "bob@gateway.example.com"} {
+		if _, err := c.Send(Chat{From: from, Remote: chat.Remote, Type: "chat", Text: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsIQReplyFrom(t *testing.T) {
+	c := &Client{jid: "juliet@example.com/balcony", domain: "example.com"}
+	for _, tt := range []struct {
+		to, from string
+		want     bool
+	}{
+		{"romeo@example.net/orchard", "Romeo@Example.NET/orchard", true},
+		{"romeo@example.net/orchard", "romeo@example.net/Orchard", false},
+		{"", "", true},
+		{"", "Juliet@EXAMPLE.com", true},
+		{"", "juliet@example.com/balcony", true},
+		{"", "EXAMPLE.COM.", true},
+		{"", "romeo@example.net", false},
+		{"Juliet@example.com", "", true},
+		{"juliet@example.com/balcony", "", false},
+		{"romeo@example.net", "", false},
+	} {
+		if got := c.isIQReplyFrom(tt.to, tt.from); got != tt.want {
+			t.Errorf("isIQReplyFrom(%q, %q) = %v, want %v", tt.to, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	var out bytes.Buffer
+	c := &Client{jid: "juliet@example.com/balcony", domain: "example.com"}
+	c.stanzaWriter = &out
+	req := IQ{From: "romeo@example.net/orchard", To: c.jid, ID: "v1", Type: IQTypeGet}
+	for _, tt := range []struct {
+		name string
+		send func() error
+		attr map[string]string
+		text string // Character data expected somewhere in the payload.
+	}{
+		{"IqVersionResponse", func() error {
+			_, err := c.IqVersionResponse(req, "bot</name><os>evil", "1 & 2", "")
+			return err
+		}, map[string]string{"id": "v1", "type": "result"}, "bot</name><os>evil"},
+		{"PubsubRequestItem", func() error {
+			return c.PubsubRequestItem(`node' x='1`, "pubsub.example.com", `id"/><x/>`)
+		}, map[string]string{"to": "pubsub.example.com", "type": "get"}, ""},
+		{"RawInformation", func() error {
+			_, err := c.RawInformation(c.jid, "example.com", `a'b<c`, IQTypeGet, "<query xmlns='jabber:iq:version'/>")
+			return err
+		}, map[string]string{"id": `a'b<c`}, ""},
+		{"Send", func() error {
+			_, err := c.Send(Chat{Remote: "romeo@example.net' type='groupchat", Type: "chat", Text: "<b>hi</b>"})
+			return err
+		}, map[string]string{"to": "romeo@example.net' type='groupchat", "type": "chat"}, "<b>hi</b>"},
+		{"Encode", func() error {
+			return c.Encode(&stanza.Message{To: "romeo@example.net", Type: "chat", Body: "]]>&"})
+		}, map[string]string{"to": "romeo@example.net"}, "]]>&"},
+	} {
+		out.Reset()
+		if err := tt.send(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		st, err := ParseStanza(out.String())
+		if err != nil {
+			t.Fatalf("%s sent %q: %v", tt.name, out.String(), err)
+		}
+		for k, v := range tt.attr {
+			if got := st.GetAttr(k); got != v {
+				t.Errorf("%s: %s = %q; want %q", tt.name, k, got, v)
+			}
+		}
+		if tt.text != "" && !strings.Contains(st.InnerXML, xmlEscape(tt.text)) {
+			t.Errorf("%s: payload %q does not contain %q escaped", tt.name, st.InnerXML, tt.text)
+		}
+	}
+
+	var items pubsubRequest
+	out.Reset()
+	c.PubsubRequestItem("n'<", "pubsub.example.com", `i"&`)
+	st, _ := ParseStanza(out.String())
+	if err := xml.Unmarshal([]byte(st.InnerXML), &items); err != nil || items.Items == nil || items.Items.Node != "n'<" ||
+		items.Items.Item == nil || items.Items.Item.ID != `i"&` {
+		t.Errorf("PubsubRequestItem payload %q does not round trip: %v", st.InnerXML, err)
+	}
+
+	c.LimitMaxBytes = 64
+	if err := c.Encode(&stanza.Message{To: "romeo@example.net", Body: strings.Repeat("x", 64)}); err == nil {
+		t.Error("Encode() of a stanza larger than LimitMaxBytes succeeded")
+	}
+}
+
+// chatState is a XEP-0085 chat state, registered for the whole namespace.
+type chatState struct {
+	XMLName xml.Name
+}
+
+// avatarUpdate is a XEP-0153 avatar hash.
+type avatarUpdate struct {
+	Photo string `xml:"photo"`
+}
+
+var registerTestExtensions sync.Once
+
+var extensionStream = `
+<message xmlns='jabber:client' from='juliet@capulet.lit/balcony' type='chat'>
+  <body>hi</body>
+  <composing xmlns='http://jabber.org/protocol/chatstates'/>
+  <delay xmlns='urn:xmpp:delay' from='capulet.lit' stamp='2002-09-10T23:08:25Z'/>
+  <stanza-id xmlns='urn:xmpp:sid:0' id='5f3dbc5e' by='romeo@montague.lit'/>
+  <x xmlns='http://jabber.org/protocol/muc#user'><invite from='crone1@shakespeare.lit'/></x>
+  <x xmlns='jabber:x:oob'><url>https://example.com/a.png</url></x>
+</message>
+<presence xmlns='jabber:client' from='room@muc.example.com/nick'>
+  <x xmlns='vcard-temp:x:update'><photo>01b87fcd</photo></x>
+  <x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='member' role='participant'/></x>
+</presence>
+<iq xmlns='jabber:client' from='juliet@capulet.lit/balcony' id='u1' type='set'>
+  <paused xmlns='http://jabber.org/protocol/chatstates'/>
+</iq>
+<message xmlns='jabber:client' from='pubsub.example.com'>
+  <event xmlns='http://jabber.org/protocol/pubsub#event'>
+    <items node='princely_musings'><item id='ae890ac52d0df67ed7cfdf51b644e901'><entry/></item></items>
+  </event>
+</message>`
+
+func TestExtensions(t *testing.T) {
+	registerTestExtensions.Do(func() {
+		RegisterExtension(xml.Name{Space: "http://jabber.org/protocol/chatstates"}, func() any { return new(chatState) })
+		RegisterExtension(xml.Name{Space: "vcard-temp:x:update", Local: "x"}, func() any { return new(avatarUpdate) })
+	})
+	var c Client
+	c.conn = tConnect(extensionStream)
+	c.p = xml.NewDecoder(c.conn)
+
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := v.(Chat)
+	var state chatState
+	if !chat.Extension(&state) || state.XMLName.Local != "composing" {
+		t.Errorf("chat state = %v; want composing", state.XMLName)
+	}
+	var delay Delay
+	if !chat.Extension(&delay) || delay.Stamp != "2002-09-10T23:08:25Z" ||
+		!chat.Stamp.Equal(time.Date(2002, 9, 10, 23, 8, 25, 0, time.UTC)) {
+		t.Errorf("delay = %+v, Stamp = %v", delay, chat.Stamp)
+	}
+	if chat.StanzaID.ID != "5f3dbc5e" || chat.StanzaID.By != "romeo@montague.lit" {
+		t.Errorf("StanzaID = %+v", chat.StanzaID)
+	}
+	if chat.Oob.Url != "https://example.com/a.png" {
+		t.Errorf("Oob = %+v", chat.Oob)
+	}
+	if len(chat.Extensions) != 4 || len(chat.OtherElem) != 2 || len(chat.Other) != 2 {
+		t.Errorf("got %d extensions and %d other elements; want 4 and 2", len(chat.Extensions), len(chat.OtherElem))
+	}
+	for _, e := range chat.OtherElem {
+		if e.XMLName.Space != "http://jabber.org/protocol/chatstates" && e.XMLName.Space != "http://jabber.org/protocol/muc#user" {
+			t.Errorf("OtherElem has %v", e.XMLName)
+		}
+	}
+
+	v, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := v.(Presence)
+	var update avatarUpdate
+	if !p.Extension(&update) || update.Photo != "01b87fcd" {
+		t.Errorf("avatar update = %+v", update)
+	}
+	if p.Affiliation != "member" || p.Role != "participant" {
+		t.Errorf("MUC item = %q/%q; want member/participant", p.Affiliation, p.Role)
+	}
+
+	v, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iq := v.(IQ)
+	if !iq.Extension(&state) || state.XMLName.Local != "paused" {
+		t.Errorf("IQ payload = %v; want paused", state.XMLName)
+	}
+	if iq.Extension(&delay) {
+		t.Error("IQ has a delay extension")
+	}
+
+	v, err = c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, ok := v.(PubsubEvent)
+	if !ok || event.Node != "princely_musings" || len(event.Items) != 1 ||
+		event.Items[0].ID != "ae890ac52d0df67ed7cfdf51b644e901" || string(event.Items[0].InnerXML) != "<entry/>" {
+		t.Errorf("Recv() = %#v; want pubsub event", v)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	RegisterExtension(xml.Name{Space: XMPPNS_DELAY, Local: "delay"}, func() any { return new(Delay) })
+}
+
+func TestRosterStore(t *testing.T) {
+	path := t.TempDir() + "/roster.json"
+	for _, tt := range []struct {
+		name  string
+		store RosterStore
+	}{
+		{"memory", &MemoryRosterStore{}},
+		{"file", NewFileRosterStore(path)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if ver, items, err := tt.store.Load(); err != nil || ver != "" || items != nil {
+				t.Fatalf("empty store: %q %v %v", ver, items, err)
+			}
+			roster := []RosterItem{
+				{JID: "bob@example.com", Subscription: SubscriptionBoth, Groups: []string{"Friends"}},
+				{JID: "carol@example.com", Subscription: SubscriptionTo},
+			}
+			if err := tt.store.Replace("1", roster); err != nil {
+				t.Fatal(err)
+			}
+			roster[0].Groups[0] = "changed"
+			if err := tt.store.Apply("2", []RosterItem{
+				{JID: "Carol@example.com", Name: "Carol", Subscription: SubscriptionBoth},
+				{JID: "dave@example.com", Subscription: SubscriptionNone},
+				{JID: "bob@example.com", Subscription: SubscriptionRemove},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			want := []RosterItem{
+				{JID: "Carol@example.com", Name: "Carol", Subscription: SubscriptionBoth},
+				{JID: "dave@example.com", Subscription: SubscriptionNone},
+			}
+			ver, items, err := tt.store.Load()
+			if err != nil || ver != "2" || !reflect.DeepEqual(items, want) {
+				t.Errorf("Load() = %q %+v %v; want 2 %+v", ver, items, err, want)
+			}
+		})
+	}
+	// The roster is read back from the file.
+	ver, items, err := NewFileRosterStore(path).Load()
+	if err != nil || ver != "2" || len(items) != 2 {
+		t.Errorf("reloaded roster = %q %+v %v", ver, items, err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewFileRosterStore(path).Load(); err == nil {
+		t.Error("corrupt file loaded without error")
+	}
+}
+
+var presenceStream = `
+<presence xmlns='jabber:client' from='juliet@example.com/balcony'><show>away</show><priority>5</priority></presence>
+<presence xmlns='jabber:client' from='juliet@example.com/chamber'><priority> 5 </priority></presence>
+<presence xmlns='jabber:client' from='juliet@example.com/phone'><show>chat</show><priority>-1</priority></presence>
+<presence xmlns='jabber:client' from='juliet@example.com/chamber' type='unavailable'/>
+<presence xmlns='jabber:client' from='romeo@example.net/orchard'/>
+<presence xmlns='jabber:client' from='romeo@example.net' type='subscribe'/>
+<presence xmlns='jabber:client' from='romeo@example.net' type='error'><error type='cancel'><remote-server-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>
+`
+
+func TestPresenceTracker(t *testing.T) {
+	var changes []PresenceChange
+	tracker := &PresenceTracker{OnChange: func(c PresenceChange) { changes = append(changes, c) }}
+	c := Client{Options: &Options{PresenceTracker: tracker, NoCaps: true}}
+	c.conn = tConnect(presenceStream)
+	c.p = xml.NewDecoder(c.conn)
+	var presences []Presence
+	for {
+		v, err := c.Recv()
+		if err != nil {
+			break
+		}
+		presences = append(presences, v.(Presence))
+	}
+	if len(presences) != 7 || presences[0].Priority != "5" || presences[1].Priority != "5" {
+		t.Fatalf("presences = %+v", presences)
+	}
+
+	if best, ok := tracker.Best("juliet@example.com"); !ok || best.JID != "juliet@example.com/balcony" {
+		t.Errorf("Best() = %+v", best)
+	}
+	resources := tracker.Resources("juliet@example.com/any")
+	if len(resources) != 2 || resources[1].JID != "juliet@example.com/phone" || resources[1].Priority != -1 {
+		t.Errorf("Resources() = %+v", resources)
+	}
+	if !tracker.Online("Juliet@example.com") || tracker.Online("juliet@example.com/chamber") || tracker.Online("romeo@example.net") {
+		t.Error("wrong online state after unavailable and error presence")
+	}
+	if len(changes) != 6 {
+		t.Fatalf("got %d changes; want 6: %+v", len(changes), changes)
+	}
+	if ch := changes[3]; ch.JID != "juliet@example.com/chamber" || ch.Current != nil || ch.Previous == nil {
+		t.Errorf("unavailable change = %+v", ch)
+	}
+	if ch := changes[5]; ch.JID != "romeo@example.net/orchard" || ch.Current != nil ||
+		ch.StanzaError == nil || ch.StanzaError.Condition != "remote-server-not-found" {
+		t.Errorf("error change = %+v", ch)
+	}
+
+	changes = nil
+	tracker.Reset()
+	if len(changes) != 2 || tracker.Online("juliet@example.com") {
+		t.Errorf("Reset() reported %d changes", len(changes))
+	}
+
+	var out bytes.Buffer
+	c.stanzaWriter = &out
+	if _, err := c.SendPresence(Presence{Show: "dnd", Priority: "-5"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "<presence><show>dnd</show><priority>-5</priority></presence>\n" {
+		t.Errorf("SendPresence() wrote %q", got)
+	}
+	if _, err := c.SendPresence(Presence{Priority: "128"}); err == nil {
+		t.Error("SendPresence accepted priority 128")
+	}
+}
+
+func TestCapsVer(t *testing.T) {
+	features := []string{XMPPNS_CAPS, XMPPNS_DISCO_INFO, XMPPNS_DISCO_ITEMS, XMPPNS_MUC}
+	simple := DiscoInfo{
+		Identities: []DiscoIdentity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}},
+		Features:   features,
+	}
+	if ver := CapsVer(simple, sha1.New); ver != "QgayPKawpkPSDYmwT/WM94uAlu0=" {
+		t.Errorf("simple ver = %s", ver)
+	}
+	complex := DiscoInfo{
+		Identities: []DiscoIdentity{
+			{Category: "client", Type: "pc", Lang: "en", Name: "Psi 0.11"},
+			{Category: "client", Type: "pc", Lang: "el", Name: "Ψ 0.11"},
+		},
+		Features: features,
+		Forms: []DiscoX{{Field: []DiscoXField{
+			{Var: "FORM_TYPE", Type: "hidden", Value: []string{"urn:xmpp:dataforms:softwareinfo"}},
+			{Var: "ip_version", Value: []string{"ipv6", "ipv4"}},
+			{Var: "os", Value: []string{"Mac"}},
+			{Var: "os_version", Value: []string{"10.5.1"}},
+			{Var: "software", Value: []string{"Psi"}},
+			{Var: "software_version", Value: []string{"0.11"}},
+		}}},
+	}
+	if ver := CapsVer(complex, sha1.New); ver != "q07IKJEyjvHSyhy//CH0CxmKi8w=" {
+		t.Errorf("complex ver = %s", ver)
+	}
+
+	if !verifyCaps("sha-1.q07IKJEyjvHSyhy//CH0CxmKi8w=", complex, false) {
+		t.Error("complex caps not verified")
+	}
+	key := "sha-256." + Caps2Hash(complex, sha256.New)
+	if !verifyCaps(key, complex, true) || verifyCaps(key, simple, true) {
+		t.Error("ecaps2 verification failed")
+	}
+	// Duplicate features could be used to forge a verification string.
+	forged := simple
+	forged.Features = append(slices.Clone(features), XMPPNS_MUC)
+	if verifyCaps("sha-1."+CapsVer(forged, sha1.New), forged, false) {
+		t.Error("caps with duplicate features verified")
+	}
+}
+
+func TestJoinMUCCaps(t *testing.T) {
+	var out bytes.Buffer
+	c := Client{stanzaWriter: &out}
+	if _, err := c.JoinMUCNoHistory("room@muc.example.net", "romeo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.JoinMUC("room@muc.example.net", "romeo", NoHistory, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	ver := CapsVer(c.discoInfo(), sha1.New)
+	for _, p := range strings.SplitAfter(out.String(), "</presence>")[:2] {
+		if !strings.Contains(p, `<x xmlns="http://jabber.org/protocol/muc">`) || !strings.Contains(p, `ver="`+ver+`"`) {
+			t.Errorf("room presence %s lacks caps", p)
+		}
+	}
+}
+
+var discoStream = `
+<iq xmlns='jabber:client' from='romeo@example.net/orchard' id='info1' type='get'><query xmlns='http://jabber.org/protocol/disco#info'/></iq>
+<iq xmlns='jabber:client' from='romeo@example.net/orchard' id='items1' type='get'><query xmlns='http://jabber.org/protocol/disco#items' node='bots'/></iq>
+<iq xmlns='jabber:client' from='romeo@example.net/orchard' id='info2' type='get'><query xmlns='http://jabber.org/protocol/disco#info' node='unknown'/></iq>
+<iq xmlns='jabber:client' from='romeo@example.net/orchard' id='time1' type='get'><time xmlns='urn:xmpp:time'/></iq>
+<message xmlns='jabber:client' from='room@muc.example.net/romeo' id='muc1' type='groupchat'><body>all</body><request xmlns='urn:xmpp:receipts'/></message>
+<message xmlns='jabber:client' from='romeo@example.net/orchard' id='msg1'><body>hi</body><request xmlns='urn:xmpp:receipts'/></message>
+`
+
+func TestDiscoResponder(t *testing.T) {
+	c := Client{Options: &Options{SoftwareName: "tester", ReportTime: true, SendReceipts: true,
+		Features: []string{"urn:example:feature"}}}
+	info, _ := c.Disco().Info("")
+	for _, f := range []string{XMPPNS_DISCO_INFO, XMPPNS_DISCO_ITEMS, XMPPNS_PING, XMPPNS_CAPS,
+		XMPPNS_TIME, XMPPNS_RECEIPTS, "urn:example:feature"} {
+		if !info.HasFeature(f) {
+			t.Errorf("root node lacks %s", f)
+		}
+	}
+	if info.HasFeature(XMPPNS_IQ_VERSION) || len(info.Identities) != 1 || info.Identities[0].Name != "tester" {
+		t.Errorf("root node = %+v", info)
+	}
+	c.Disco().SetItems("bots", []DiscoItem{{Jid: "bot@example.com", Name: "Bot"}})
+	c.Disco().SetForm("", DiscoX{Field: []DiscoXField{
+		{Var: "FORM_TYPE", Type: "hidden", Value: []string{"urn:example:info"}},
+		{Var: "answer", Value: []string{"42"}},
+	}})
+	c.Disco().RemoveFeatures("", "urn:example:feature")
+
+	var out bytes.Buffer
+	c.stanzaWriter = &out
+	c.conn = tConnect(discoStream)
+	c.p = xml.NewDecoder(c.conn)
+	for _, text := range []string{"all", "hi"} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chat, ok := v.(Chat); !ok || chat.Text != text {
+			t.Errorf("Recv() = %+v", v)
+		}
+	}
+	got := out.String()
+	for _, want := range []string{
+		`<identity category="client" type="bot" name="tester"></identity>`,
+		`<feature var="urn:xmpp:ping"></feature>`,
+		`<field var="answer"><value>42</value></field>`,
+		`type="result"><query xmlns="http://jabber.org/protocol/disco#items" node="bots"><item jid="bot@example.com" name="Bot"></item></query>`,
+		`id="info2" to="romeo@example.net/orchard" type="error"><error type="cancel"><item-not-found`,
+		`type="result"><time xmlns="urn:xmpp:time"><tzo>`,
+		`<received xmlns="urn:xmpp:receipts" id="msg1"></received>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "urn:example:feature") {
+		t.Error("removed feature announced")
+	}
+	if strings.Contains(got, `id="muc1"`) || strings.Contains(got, "room@muc.example.net") {
+		t.Error("receipt sent for groupchat message")
+	}
+}
+
+// TestRosterItemAttributes checks that roster items are decoded from the
+// lowercase attributes of RFC 6121. The field names used to be taken as
+// attribute names, so jid, name and subscription were always empty.
+func TestRosterItemAttributes(t *testing.T) {
+	var q clientQuery
+	err := xml.Unmarshal([]byte("<query xmlns='jabber:iq:roster'>"+
+		"<item jid='juliet@example.com' name='Juliet' subscription='both' ask='subscribe'>"+
+		"<group>Friends</group><group>Lovers</group></item></query>"), &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RosterItem{{JID: "juliet@example.com", Name: "Juliet", Subscription: SubscriptionBoth,
+		Ask: "subscribe", Groups: []string{"Friends", "Lovers"}}}
+	if got := q.rosterItems(); !reflect.DeepEqual(got, want) {
+		t.Errorf("rosterItems() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn adapts a RFC 7395 WebSocket connection to the stream oriented
+// interface used by the rest of the client. Outgoing stream headers are
+// translated to <open/> and <close/> framing elements and incoming framing
+// elements back to a <stream:stream> header and footer, so startStream, init
+// and Recv work unchanged.
+type wsConn struct {
+	*websocket.Conn
+	secure  bool
+	pending []byte
+}
+
+// dialWebSocket opens a WebSocket connection to o.WebSocketURL using the
+// "xmpp" sub-protocol. The TCP connection is opened like for the other
+// transports, through Options.Dialer and Options.Proxy.
+func dialWebSocket(ctx context.Context, o *Options) (net.Conn, error) {
+	u, err := url.Parse(o.WebSocketURL)
+	if err != nil {
+		return nil, err
+	}
+	origin := *u
+	switch u.Scheme {
+	case "wss":
+		origin.Scheme = "https"
+	case "ws":
+		origin.Scheme = "http"
+	default:
+		return nil, fmt.Errorf("websocket: unsupported URL scheme %q", u.Scheme)
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{"xmpp"}
+	addr, port := u.Host, "80"
+	if u.Scheme == "wss" {
+		port = "443"
+		if o.TLSConfig != nil {
+			config.TlsConfig = o.TLSConfig
+		} else {
+			config.TlsConfig = DefaultConfig.Clone()
+			config.TlsConfig.ServerName = u.Hostname()
+		}
+	}
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := o.dialTCP(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, config.TlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: ws, secure: u.Scheme == "wss"}, nil
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		var frame string
+		if err := websocket.Message.Receive(w.Conn, &frame); err != nil {
+			return 0, err
+		}
+		w.pending = wsToStream([]byte(frame))
+	}
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+// Write sends p as a single WebSocket message. Each write must contain one
+// complete top-level element, which holds for everything the client sends.
+func (w *wsConn) Write(p []byte) (int, error) {
+	frame := streamToWS(p)
+	if len(frame) == 0 {
+		// Whitespace keepalives are not allowed on WebSocket connections.
+		return len(p), nil
+	}
+	if err := websocket.Message.Send(w.Conn, string(frame)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// streamToWS translates data written by the client into a RFC 7395 frame.
+func streamToWS(p []byte) []byte {
+	p = trimStreamData(p)
+	switch {
+	case len(p) == 0:
+		return nil
+	case isStreamHeader(p):
+		return fmt.Appendf(nil, "<open xmlns='%s'%s/>", XMPPNS_FRAMING, streamHeaderAttrs(p))
+	case isStreamFooter(p):
+		return fmt.Appendf(nil, "<close xmlns='%s'/>", XMPPNS_FRAMING)
+	}
+	return qualifyStanza(p)
+}
+
+// trimStreamData strips surrounding whitespace and the XML declaration from
+// data written by the client.
+func trimStreamData(p []byte) []byte {
+	p = bytes.TrimSpace(p)
+	if rest, ok := bytes.CutPrefix(p, []byte("<?xml")); ok {
+		if i := bytes.Index(rest, []byte("?>")); i >= 0 {
+			p = bytes.TrimSpace(rest[i+2:])
+		}
+	}
+	return p
+}
+
+func isStreamHeader(p []byte) bool {
+	return bytes.HasPrefix(p, []byte("<stream:stream"))
+}
+
+func isStreamFooter(p []byte) bool {
+	return bytes.Equal(p, []byte("</stream:stream>"))
+}
+
+// streamHeaderAttrs returns the to, from and version attributes of a
+// <stream:stream> header, formatted for reuse in another element.
+func streamHeaderAttrs(p []byte) string {
+	var attrs string
+	t, err := xml.NewDecoder(bytes.NewReader(p)).Token()
+	if err != nil {
+		return ""
+	}
+	if se, ok := t.(xml.StartElement); ok {
+		for _, a := range se.Attr {
+			switch a.Name.Local {
+			case "to", "from", "version":
+				if a.Name.Space == "" {
+					attrs += fmt.Sprintf(" %s='%s'", a.Name.Local, xmlEscape(a.Value))
+				}
+			}
+		}
+	}
+	return attrs
+}
+
+// qualifyStanza declares the jabber:client namespace on a top-level stanza,
+// as it is not inherited from a stream header on framed transports.
+func qualifyStanza(p []byte) []byte {
+	end := bytes.IndexByte(p, '>')
+	if end <= 0 || bytes.Contains(p[:end], []byte("xmlns=")) {
+		return p
+	}
+	for _, name := range []string{"<message", "<presence", "<iq"} {
+		if len(p) > len(name) && bytes.HasPrefix(p, []byte(name)) && bytes.IndexByte([]byte(" \t\r\n/>"), p[len(name)]) >= 0 {
+			stanza := fmt.Appendf(nil, "%s xmlns='%s'", name, XMPPNS_CLIENT)
+			return append(stanza, p[len(name):]...)
+		}
+	}
+	return p
+}
+
+// wsToStream translates a received RFC 7395 frame into stream data.
+func wsToStream(frame []byte) []byte {
+	d := xml.NewDecoder(bytes.NewReader(frame))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return frame
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Space != XMPPNS_FRAMING {
+			return frame
+		}
+		switch se.Name.Local {
+		case "open":
+			var attrs strings.Builder
+			for _, a := range se.Attr {
+				if a.Name.Space == "" && a.Name.Local != "xmlns" {
+					fmt.Fprintf(&attrs, " %s='%s'", a.Name.Local, xmlEscape(a.Value))
+				}
+			}
+			return fmt.Appendf(nil, "<stream:stream xmlns='%s' xmlns:stream='%s'%s>",
+				XMPPNS_CLIENT, XMPPNS_STREAM, attrs.String())
+		case "close":
+			return []byte("</stream:stream>")
+		}
+		return frame
+	}
+}
@@ -0,0 +1,141 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrSendQueueFull is returned instead of blocking if Options.SendQueueSize
+// stanzas are already waiting to be written.
+var ErrSendQueueFull = errors.New("xmpp: send queue full")
+
+// streamWriter serializes all writes to the outbound stream. Each stanza is
+// written with a single call, so stanzas sent from different goroutines never
+// interleave on the wire. If Options.SendQueueSize is set, writes are queued
+// and done by a background goroutine.
+type streamWriter struct {
+	mu      sync.Mutex   // Held while writing to the connection or queueing.
+	stopMu  sync.RWMutex // Guards stopped against concurrent queueing.
+	queue   chan string
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+	err     error // Write error that stopped the queue, set before done is closed.
+}
+
+// writeNow writes data to the connection, applying Options.WriteTimeout.
+// The caller must hold mu, unless it is the goroutine of the send queue, which
+// is the only one writing to the connection while the queue is enabled.
+func (c *Client) writeNow(data string) (int, error) {
+	c.logSend(data)
+	if c.Options != nil && c.Options.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.Options.WriteTimeout))
+	}
+	n, err := io.WriteString(c.stanzaWriter, data)
+	if n > 0 {
+		c.metrics().BytesSent(n)
+	}
+	return n, err
+}
+
+// write writes a stanza. If the send queue is enabled the stanza is queued
+// and ErrSendQueueFull is returned if the queue is full. The caller must hold
+// c.out.mu, so it can keep track of the order in which stanzas are sent.
+func (c *Client) write(data string) (int, error) {
+	return c.enqueue(data, false)
+}
+
+// writef formats and writes a nonza like the stream footer or a stream
+// management answer. If the send queue is enabled it waits for room in the
+// queue, keeping the order with the queued stanzas.
+func (c *Client) writef(format string, a ...interface{}) (int, error) {
+	// Waiting for room in the queue does not hold up the stanzas, which
+	// fail with ErrSendQueueFull instead.
+	if c.out.queue == nil {
+		c.out.mu.Lock()
+		defer c.out.mu.Unlock()
+	}
+	return c.enqueue(fmt.Sprintf(format, a...), true)
+}
+
+func (c *Client) enqueue(data string, block bool) (int, error) {
+	c.out.stopMu.RLock()
+	defer c.out.stopMu.RUnlock()
+	switch {
+	case c.out.queue == nil:
+		return c.writeNow(data)
+	case c.out.stopped:
+		return 0, net.ErrClosed
+	}
+	select {
+	case <-c.out.done:
+		return 0, c.out.err
+	default:
+	}
+	if block {
+		select {
+		case c.out.queue <- data:
+			return len(data), nil
+		case <-c.out.done:
+			return 0, c.out.err
+		}
+	}
+	select {
+	case c.out.queue <- data:
+		return len(data), nil
+	default:
+		return 0, ErrSendQueueFull
+	}
+}
+
+// startWriter enables the send queue with room for size stanzas.
+func (c *Client) startWriter(size int) {
+	c.out.queue = make(chan string, size)
+	c.out.stop = make(chan struct{})
+	c.out.done = make(chan struct{})
+	go c.runWriter()
+}
+
+func (c *Client) runWriter() {
+	defer close(c.out.done)
+	for {
+		select {
+		case data := <-c.out.queue:
+			if _, err := c.writeNow(data); err != nil {
+				c.out.err = err
+				return
+			}
+		case <-c.out.stop:
+			// Write what was queued before stopping.
+			for {
+				select {
+				case data := <-c.out.queue:
+					if _, err := c.writeNow(data); err != nil {
+						c.out.err = err
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stopWriter writes the queued stanzas and stops the send queue. Later
+// writes fail.
+func (c *Client) stopWriter() {
+	c.out.stopMu.Lock()
+	if c.out.queue == nil || c.out.stopped {
+		c.out.stopMu.Unlock()
+		return
+	}
+	c.out.stopped = true
+	c.out.stopMu.Unlock()
+	close(c.out.stop)
+	<-c.out.done
+}
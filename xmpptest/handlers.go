@@ -0,0 +1,202 @@
+package xmpptest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	xmpp "github.com/xmppo/go-xmpp"
+)
+
+// A Handler processes a stanza received from a client.
+type Handler func(sess *Session, st Stanza)
+
+// RosterItem is a contact in the roster of an account.
+type RosterItem struct {
+	JID          string
+	Name         string
+	Subscription string
+	Ask          string
+	Groups       []string
+}
+
+func (item RosterItem) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<item jid='%s'", escape(item.JID))
+	if item.Name != "" {
+		fmt.Fprintf(&b, " name='%s'", escape(item.Name))
+	}
+	if item.Subscription != "" {
+		fmt.Fprintf(&b, " subscription='%s'", escape(item.Subscription))
+	}
+	if item.Ask != "" {
+		fmt.Fprintf(&b, " ask='%s'", escape(item.Ask))
+	}
+	b.WriteString(">")
+	for _, g := range item.Groups {
+		fmt.Fprintf(&b, "<group>%s</group>", escape(g))
+	}
+	b.WriteString("</item>")
+	return b.String()
+}
+
+// Identity is a service discovery identity.
+type Identity struct {
+	Category string
+	Type     string
+	Name     string
+}
+
+// RosterOf returns the roster of the account user.
+func (s *Server) RosterOf(user string) []RosterItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.Roster[user])
+}
+
+// rosterVersion returns the roster version of the account user, or "" if
+// Server.RosterVersioning is off. s.mu must be held.
+func (s *Server) rosterVersion(user string) string {
+	if !s.RosterVersioning {
+		return ""
+	}
+	return strconv.Itoa(s.versions[user])
+}
+
+// verAttr returns the ver attribute of a roster query.
+func verAttr(ver string) string {
+	if ver == "" {
+		return ""
+	}
+	return fmt.Sprintf(" ver='%s'", ver)
+}
+
+// RosterHandler implements RFC 6121 section 2: it returns the roster of the
+// account from Server.Roster, applies roster sets to it and pushes the
+// changes to all clients of the account. With Server.RosterVersioning an
+// up to date roster is answered with an empty result.
+func RosterHandler(sess *Session, st Stanza) {
+	s := sess.server
+	switch st.Type {
+	case "get":
+		var q struct {
+			Ver *string `xml:"ver,attr"`
+		}
+		xml.Unmarshal([]byte(st.Inner), &q)
+		s.mu.Lock()
+		roster, ver := slices.Clone(s.Roster[sess.user]), s.rosterVersion(sess.user)
+		s.mu.Unlock()
+		if ver != "" && q.Ver != nil && *q.Ver == ver {
+			// The roster of the client is up to date.
+			sess.Result(st, "")
+			return
+		}
+		var b strings.Builder
+		for _, item := range roster {
+			b.WriteString(item.String())
+		}
+		sess.Result(st, fmt.Sprintf("<query xmlns='%s'%s>%s</query>", xmpp.XMPPNS_ROSTER, verAttr(ver), b.String()))
+	case "set":
+		var q struct {
+			Item []struct {
+				JID          string   `xml:"jid,attr"`
+				Name         string   `xml:"name,attr"`
+				Subscription string   `xml:"subscription,attr"`
+				Group        []string `xml:"group"`
+			} `xml:"item"`
+		}
+		if err := xml.Unmarshal([]byte(st.Inner), &q); err != nil || len(q.Item) != 1 || q.Item[0].JID == "" {
+			sess.Error(st, "modify", "bad-request")
+			return
+		}
+		set := q.Item[0]
+		if slices.Contains(set.Group, "") {
+			// RFC 6121 section 2.3.3 forbids empty group names.
+			sess.Error(st, "modify", "not-acceptable")
+			return
+		}
+		item := RosterItem{JID: set.JID, Name: set.Name, Groups: set.Group, Subscription: "none"}
+		s.mu.Lock()
+		if s.Roster == nil {
+			s.Roster = make(map[string][]RosterItem)
+		}
+		roster := s.Roster[sess.user]
+		i := slices.IndexFunc(roster, func(r RosterItem) bool { return strings.EqualFold(r.JID, set.JID) })
+		switch {
+		case set.Subscription == "remove":
+			if i >= 0 {
+				roster = slices.Delete(roster, i, i+1)
+			}
+			item = RosterItem{JID: set.JID, Subscription: "remove"}
+		case i >= 0:
+			item.Subscription, item.Ask = roster[i].Subscription, roster[i].Ask
+			roster[i] = item
+		default:
+			roster = append(roster, item)
+		}
+		s.Roster[sess.user] = roster
+		if s.RosterVersioning {
+			if s.versions == nil {
+				s.versions = make(map[string]int)
+			}
+			s.versions[sess.user]++
+		}
+		ver := s.rosterVersion(sess.user)
+		s.mu.Unlock()
+		sess.Result(st, "")
+		for _, r := range s.sessionsFor(sess.Bare()) {
+			r.Send(fmt.Sprintf("<iq type='set' id='push%s' to='%s'><query xmlns='%s'%s>%s</query></iq>",
+				randomID(), escape(r.jid), xmpp.XMPPNS_ROSTER, verAttr(ver), item.String()))
+		}
+	}
+}
+
+// DiscoInfoHandler answers XEP-0030 disco#info queries with
+// Server.Identities and Server.Features.
+func DiscoInfoHandler(sess *Session, st Stanza) {
+	s := sess.server
+	if st.Type != "get" {
+		sess.Error(st, "cancel", "feature-not-implemented")
+		return
+	}
+	var q struct {
+		Node string `xml:"node,attr"`
+	}
+	xml.Unmarshal([]byte(st.Inner), &q)
+	if q.Node != "" {
+		sess.Error(st, "cancel", "item-not-found")
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<query xmlns='%s'>", xmpp.XMPPNS_DISCO_INFO)
+	for _, id := range s.Identities {
+		fmt.Fprintf(&b, "<identity category='%s' type='%s'", escape(id.Category), escape(id.Type))
+		if id.Name != "" {
+			fmt.Fprintf(&b, " name='%s'", escape(id.Name))
+		}
+		b.WriteString("/>")
+	}
+	for _, f := range s.Features {
+		fmt.Fprintf(&b, "<feature var='%s'/>", escape(f))
+	}
+	b.WriteString("</query>")
+	sess.Result(st, b.String())
+}
+
+// PingHandler answers XEP-0199 pings.
+func PingHandler(sess *Session, st Stanza) {
+	sess.Result(st, "")
+}
+
+// Echo is a Handler that sends stanzas back to the client that sent them,
+// e.g. for HandleMessage.
+func Echo(sess *Session, st Stanza) {
+	from := st.To
+	if from == "" {
+		from = sess.server.Domain
+	}
+	st.From, st.To = from, sess.jid
+	sess.Send(st.String())
+}
@@ -0,0 +1,519 @@
+package xmpptest
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"time"
+
+	xmpp "github.com/xmppo/go-xmpp"
+)
+
+type saslAuth struct {
+	Mechanism string `xml:"mechanism,attr"`
+	Text      string `xml:",chardata"`
+}
+
+type sasl2Authenticate struct {
+	Mechanism       string `xml:"mechanism,attr"`
+	InitialResponse string `xml:"initial-response"`
+	Bind            *struct {
+		Tag string `xml:"tag"`
+	} `xml:"urn:xmpp:bind:0 bind"`
+	RequestToken *struct {
+		Mechanism string `xml:"mechanism,attr"`
+	} `xml:"urn:xmpp:fast:0 request-token"`
+	Fast *struct {
+		Invalidate string `xml:"invalidate,attr"`
+	} `xml:"urn:xmpp:fast:0 fast"`
+	Upgrade []string `xml:"urn:xmpp:sasl:upgrade:0 upgrade"`
+}
+
+type sasl2Next struct {
+	Task string `xml:"task,attr"`
+}
+
+type sasl2TaskData struct {
+	Hash string `xml:"urn:xmpp:scram-upgrade:0 hash"`
+}
+
+type saslResponse struct {
+	Text string `xml:",chardata"`
+}
+
+// saslError is a SASL failure with its defined condition.
+type saslError struct {
+	condition string
+	text      string
+}
+
+func (e *saslError) Error() string {
+	if e.text == "" {
+		return e.condition
+	}
+	return e.condition + ": " + e.text
+}
+
+func notAuthorized(text string) error {
+	return &saslError{"not-authorized", text}
+}
+
+// failure sends a SASL failure for err in the namespace ns.
+func (sess *Session) failure(ns string, err error) error {
+	var e *saslError
+	if !errors.As(err, &e) {
+		if errors.Is(err, errAborted) {
+			e = &saslError{condition: "aborted"}
+		} else {
+			e = &saslError{"malformed-request", err.Error()}
+		}
+	}
+	var text string
+	if e.text != "" {
+		text = "<text>" + escape(e.text) + "</text>"
+	}
+	return sess.Send(fmt.Sprintf("<failure xmlns='%s'><%s xmlns='%s'/>%s</failure>",
+		ns, e.condition, xmpp.XMPPNS_XMPP_SASL, text))
+}
+
+// authSASL handles a SASL exchange as described in RFC 6120 section 6.
+func (sess *Session) authSASL(a saslAuth) (restart bool, err error) {
+	ns := xmpp.XMPPNS_XMPP_SASL
+	var initial []byte
+	if a.Text != "=" {
+		if initial, err = base64.StdEncoding.DecodeString(strings.TrimSpace(a.Text)); err != nil {
+			return false, sess.failure(ns, &saslError{"incorrect-encoding", ""})
+		}
+	}
+	user, data, err := sess.authenticate(a.Mechanism, initial, ns)
+	if err != nil {
+		return false, sess.failure(ns, err)
+	}
+	sess.user = user
+	if err := sess.Send(fmt.Sprintf("<success xmlns='%s'>%s</success>",
+		ns, base64.StdEncoding.EncodeToString(data))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// authSASL2 handles an exchange as described in XEP-0388: Extensible SASL
+// Profile, including the inline Bind 2 and FAST requests.
+func (sess *Session) authSASL2(a sasl2Authenticate) error {
+	s := sess.server
+	ns := xmpp.XMPPNS_SASL_2
+	initial, err := base64.StdEncoding.DecodeString(strings.TrimSpace(a.InitialResponse))
+	if err != nil {
+		return sess.failure(ns, &saslError{"incorrect-encoding", ""})
+	}
+	var user string
+	var data []byte
+	if strings.HasPrefix(a.Mechanism, "HT-") {
+		var invalidate bool
+		if a.Fast != nil {
+			invalidate = a.Fast.Invalidate == "true" || a.Fast.Invalidate == "1"
+		}
+		user, data, err = sess.fast(a.Mechanism, initial, invalidate)
+	} else {
+		user, data, err = sess.authenticate(a.Mechanism, initial, ns)
+	}
+	if err != nil {
+		return sess.failure(ns, err)
+	}
+	if i := slices.IndexFunc(a.Upgrade, func(u string) bool { return slices.Contains(s.Upgrades, u) }); i >= 0 &&
+		!strings.HasPrefix(a.Mechanism, "HT-") {
+		// The additional data of the mechanism is sent with the continue.
+		if err := sess.saslUpgrade(user, a.Upgrade[i], data); err != nil {
+			return sess.failure(ns, err)
+		}
+		data = nil
+	}
+	sess.user = user
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<success xmlns='%s'>", ns)
+	if data != nil {
+		fmt.Fprintf(&b, "<additional-data>%s</additional-data>", base64.StdEncoding.EncodeToString(data))
+	}
+	if a.Bind != nil && s.Bind2 {
+		resource := a.Bind.Tag
+		if resource == "" {
+			resource = "xmpptest"
+		}
+		sess.jid = sess.Bare() + "/" + resource + "." + randomID()
+		fmt.Fprintf(&b, "<authorization-identifier>%s</authorization-identifier><bound xmlns='%s'/>",
+			escape(sess.jid), xmpp.XMPPNS_BIND_0)
+	} else {
+		fmt.Fprintf(&b, "<authorization-identifier>%s</authorization-identifier>", escape(sess.Bare()))
+	}
+	if a.RequestToken != nil && slices.Contains(s.FAST, a.RequestToken.Mechanism) {
+		token := fastToken{
+			value:     base64.RawURLEncoding.EncodeToString([]byte(randomID() + randomID())),
+			mechanism: a.RequestToken.Mechanism,
+			expiry:    time.Now().Add(s.TokenLifetime).UTC().Truncate(time.Second),
+		}
+		s.mu.Lock()
+		s.tokens[user] = token
+		s.mu.Unlock()
+		fmt.Fprintf(&b, "<token xmlns='%s' token='%s' expiry='%s'/>",
+			xmpp.XMPPNS_FAST_0, token.value, token.expiry.Format(time.RFC3339))
+	}
+	b.WriteString("</success>")
+	// The stream is not restarted, the client waits for the new features.
+	if err := sess.Send(b.String() + sess.features()); err != nil {
+		return err
+	}
+	if sess.jid != "" {
+		s.bound(sess)
+	}
+	return nil
+}
+
+// saslUpgrade runs the XEP-0480 upgrade task after the authentication of
+// user succeeded with the additional data data. The SCRAM upgrades make the
+// client send its salted password for the hash of the task.
+func (sess *Session) saslUpgrade(user, task string, data []byte) error {
+	s := sess.server
+	var newHash func() hash.Hash
+	switch task {
+	case xmpp.UPGR_SCRAM_SHA_256:
+		newHash = sha256.New
+	case xmpp.UPGR_SCRAM_SHA_512:
+		newHash = sha512.New
+	default:
+		return &saslError{"malformed-request", "unknown task " + task}
+	}
+	ns := xmpp.XMPPNS_SASL_2
+	var additional string
+	if data != nil {
+		additional = "<additional-data>" + base64.StdEncoding.EncodeToString(data) + "</additional-data>"
+	}
+	if err := sess.Send(fmt.Sprintf("<continue xmlns='%s'>%s<tasks><task>%s</task></tasks></continue>",
+		ns, additional, task)); err != nil {
+		return err
+	}
+	var next sasl2Next
+	if err := sess.expect(ns, "next", &next); err != nil {
+		return err
+	}
+	if next.Task != task {
+		return &saslError{"malformed-request", "unexpected task " + next.Task}
+	}
+	salt := s.salt(user)
+	if err := sess.Send(fmt.Sprintf("<task-data xmlns='%s'><salt xmlns='%s' iterations='%d'>%s</salt></task-data>",
+		ns, xmpp.XMPPNS_SCRAM_UPGRADE_0, s.Iterations, base64.StdEncoding.EncodeToString(salt))); err != nil {
+		return err
+	}
+	var td sasl2TaskData
+	if err := sess.expect(ns, "task-data", &td); err != nil {
+		return err
+	}
+	got, err := base64.StdEncoding.DecodeString(strings.TrimSpace(td.Hash))
+	if err != nil {
+		return &saslError{"incorrect-encoding", ""}
+	}
+	want, err := pbkdf2.Key(newHash, s.Users[user], salt, s.Iterations, newHash().Size())
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(got, want) {
+		return notAuthorized("wrong salted password for " + task)
+	}
+	s.mu.Lock()
+	s.upgraded[user] = append(s.upgraded[user], task)
+	s.mu.Unlock()
+	return nil
+}
+
+// expect decodes the next element, which must be local in the namespace
+// ns, into v.
+func (sess *Session) expect(ns, local string, v any) error {
+	se, err := sess.nextStart()
+	if err != nil {
+		return err
+	}
+	if se.Name.Space == ns && se.Name.Local == "abort" {
+		sess.dec.Skip()
+		return errAborted
+	}
+	if se.Name.Space != ns || se.Name.Local != local {
+		sess.dec.Skip()
+		return &saslError{"malformed-request", "expected <" + local + ">, got <" + se.Name.Local + ">"}
+	}
+	return sess.dec.DecodeElement(v, &se)
+}
+
+// authenticate verifies the credentials sent with mechanism and returns the
+// authenticated user and the additional data of the success.
+func (sess *Session) authenticate(mechanism string, initial []byte, ns string) (user string, data []byte, err error) {
+	s := sess.server
+	if !slices.Contains(s.Mechanisms, mechanism) ||
+		strings.HasSuffix(mechanism, "-PLUS") && !sess.isTLS() {
+		return "", nil, &saslError{"invalid-mechanism", mechanism}
+	}
+	if mechanism == "PLAIN" {
+		parts := strings.Split(string(initial), "\x00")
+		if len(parts) != 3 {
+			return "", nil, &saslError{"malformed-request", ""}
+		}
+		if password, ok := s.Users[parts[1]]; !ok || password != parts[2] {
+			return "", nil, notAuthorized("")
+		}
+		return parts[1], nil, nil
+	}
+	return sess.scram(mechanism, initial, ns)
+}
+
+// scram is the server side of RFC 5802: Salted Challenge Response
+// Authentication Mechanism, with channel binding for the -PLUS variants.
+func (sess *Session) scram(mechanism string, clientFirst []byte, ns string) (string, []byte, error) {
+	s := sess.server
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(mechanism, "-PLUS") {
+	case xmpp.SCRAM_SHA_1:
+		newHash = sha1.New
+	case xmpp.SCRAM_SHA_256:
+		newHash = sha256.New
+	case xmpp.SCRAM_SHA_512:
+		newHash = sha512.New
+	default:
+		return "", nil, &saslError{"invalid-mechanism", mechanism}
+	}
+	plus := strings.HasSuffix(mechanism, "-PLUS")
+
+	parts := strings.SplitN(string(clientFirst), ",", 3)
+	if len(parts) != 3 {
+		return "", nil, &saslError{"malformed-request", ""}
+	}
+	gs2Header := parts[0] + "," + parts[1] + ","
+	clientFirstBare := parts[2]
+	var cbData []byte
+	switch cbType, ok := strings.CutPrefix(parts[0], "p="); {
+	case ok && plus:
+		if !slices.Contains(s.ChannelBindings, cbType) {
+			return "", nil, notAuthorized("unsupported channel binding " + cbType)
+		}
+		var err error
+		if cbData, err = sess.channelBinding(cbType); err != nil {
+			return "", nil, notAuthorized(err.Error())
+		}
+	case ok || plus:
+		return "", nil, notAuthorized("channel binding mismatch")
+	case parts[0] != "n" && parts[0] != "y":
+		return "", nil, &saslError{"malformed-request", ""}
+	}
+
+	attrs := scramAttrs(clientFirstBare)
+	user, clientNonce := attrs["n"], attrs["r"]
+	password, ok := s.Users[user]
+	if !ok || clientNonce == "" {
+		return "", nil, notAuthorized("")
+	}
+	salt := s.salt(user)
+	nonce := clientNonce + randomID()
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), s.Iterations)
+
+	clientFinal, err := sess.challenge(ns, []byte(serverFirst))
+	if err != nil {
+		return "", nil, err
+	}
+	i := strings.LastIndex(string(clientFinal), ",p=")
+	if i < 0 {
+		return "", nil, &saslError{"malformed-request", ""}
+	}
+	clientFinalBare := string(clientFinal[:i])
+	proof, err := base64.StdEncoding.DecodeString(string(clientFinal[i+3:]))
+	if err != nil {
+		return "", nil, &saslError{"incorrect-encoding", ""}
+	}
+	attrs = scramAttrs(clientFinalBare)
+	if attrs["r"] != nonce {
+		return "", nil, notAuthorized("nonce mismatch")
+	}
+	cb, err := base64.StdEncoding.DecodeString(attrs["c"])
+	if err != nil || string(cb) != gs2Header+string(cbData) {
+		return "", nil, notAuthorized("channel binding mismatch")
+	}
+
+	saltedPassword, err := pbkdf2.Key(newHash, password, salt, s.Iterations, newHash().Size())
+	if err != nil {
+		return "", nil, err
+	}
+	clientKey := hmacSum(newHash, saltedPassword, "Client Key")
+	h := newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalBare
+	clientSignature := hmacSum(newHash, storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return "", nil, notAuthorized("")
+	}
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	h.Reset()
+	h.Write(proof)
+	if !hmac.Equal(h.Sum(nil), storedKey) {
+		return "", nil, notAuthorized("")
+	}
+	serverKey := hmacSum(newHash, saltedPassword, "Server Key")
+	serverSignature := hmacSum(newHash, serverKey, authMessage)
+	return user, []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// challenge sends a SASL challenge and returns the response of the client.
+func (sess *Session) challenge(ns string, data []byte) ([]byte, error) {
+	err := sess.Send(fmt.Sprintf("<challenge xmlns='%s'>%s</challenge>",
+		ns, base64.StdEncoding.EncodeToString(data)))
+	if err != nil {
+		return nil, err
+	}
+	se, err := sess.nextStart()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case se.Name.Space != ns:
+	case se.Name.Local == "abort":
+		sess.dec.Skip()
+		return nil, errAborted
+	case se.Name.Local == "response":
+		var r saslResponse
+		if err := sess.dec.DecodeElement(&r, &se); err != nil {
+			return nil, err
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(r.Text))
+		if err != nil {
+			return nil, &saslError{"incorrect-encoding", ""}
+		}
+		return b, nil
+	}
+	sess.dec.Skip()
+	return nil, &saslError{"malformed-request", "expected <response>, got <" + se.Name.Local + ">"}
+}
+
+// fast verifies a FAST token as described in XEP-0484: Fast Authentication
+// Streamlining Tokens and returns the user and the responder hash.
+func (sess *Session) fast(mechanism string, initial []byte, invalidate bool) (string, []byte, error) {
+	s := sess.server
+	if !slices.Contains(s.FAST, mechanism) {
+		return "", nil, &saslError{"invalid-mechanism", mechanism}
+	}
+	user, initiator, ok := strings.Cut(string(initial), "\x00")
+	if !ok {
+		return "", nil, &saslError{"malformed-request", ""}
+	}
+	s.mu.Lock()
+	token, ok := s.tokens[user]
+	if ok && invalidate {
+		delete(s.tokens, user)
+	}
+	s.mu.Unlock()
+	if !ok || time.Now().After(token.expiry) {
+		return "", nil, &saslError{"credentials-expired", ""}
+	}
+	var cbType string
+	switch mechanism {
+	case xmpp.HT_SHA_256_EXPR:
+		cbType = "tls-exporter"
+	case xmpp.HT_SHA_256_UNIQ:
+		cbType = "tls-unique"
+	case xmpp.HT_SHA_256_ENDP:
+		cbType = "tls-server-end-point"
+	case xmpp.HT_SHA_256_NONE:
+	default:
+		return "", nil, &saslError{"invalid-mechanism", mechanism}
+	}
+	var cbData []byte
+	if cbType != "" {
+		var err error
+		if cbData, err = sess.channelBinding(cbType); err != nil {
+			return "", nil, notAuthorized(err.Error())
+		}
+	}
+	expected := hmacSum(sha256.New, []byte(token.value), "Initiator"+string(cbData))
+	if !hmac.Equal([]byte(initiator), expected) {
+		return "", nil, notAuthorized("")
+	}
+	return user, hmacSum(sha256.New, []byte(token.value), "Responder"+string(cbData)), nil
+}
+
+// channelBinding returns the channel binding data of the given type for
+// the TLS connection of the session.
+func (sess *Session) channelBinding(cbType string) ([]byte, error) {
+	sess.mu.Lock()
+	tc, ok := sess.conn.(*tls.Conn)
+	sess.mu.Unlock()
+	if !ok {
+		return nil, errors.New("channel binding requires TLS")
+	}
+	state := tc.ConnectionState()
+	switch cbType {
+	case "tls-exporter":
+		if state.Version != tls.VersionTLS13 {
+			return nil, errors.New("tls-exporter requires TLS 1.3")
+		}
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-unique":
+		if len(state.TLSUnique) == 0 {
+			return nil, errors.New("tls-unique is not available")
+		}
+		return state.TLSUnique, nil
+	case "tls-server-end-point":
+		// RFC 5929 section 4.1: the hash of the signature, but at least
+		// SHA-256.
+		var h hash.Hash
+		switch sess.server.cert.Leaf.SignatureAlgorithm {
+		case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+			h = sha512.New384()
+		case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+			h = sha512.New()
+		default:
+			h = sha256.New()
+		}
+		h.Write(sess.server.cert.Leaf.Raw)
+		return h.Sum(nil), nil
+	}
+	return nil, errors.New("unknown channel binding " + cbType)
+}
+
+// salt returns the SCRAM salt of user, which is created on first use.
+func (s *Server) salt(user string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	salt, ok := s.salts[user]
+	if !ok {
+		salt = make([]byte, 16)
+		rand.Read(salt)
+		s.salts[user] = salt
+	}
+	return salt
+}
+
+// scramAttrs parses the comma separated attributes of a SCRAM message.
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(a, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func hmacSum(newHash func() hash.Hash, key []byte, data string) []byte {
+	h := hmac.New(newHash, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
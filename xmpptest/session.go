@@ -0,0 +1,374 @@
+package xmpptest
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	xmpp "github.com/xmppo/go-xmpp"
+)
+
+const nsStream = "http://etherx.jabber.org/streams"
+
+// Session is the server side of a client connection. Handlers run on the
+// goroutine reading from the client, so they must not wait for its replies.
+type Session struct {
+	server *Server
+	dec    *xml.Decoder
+
+	mu     sync.Mutex // Held while writing, guards conn and closed.
+	conn   net.Conn
+	closed bool
+
+	user string     // Local part of the authenticated account.
+	jid  string     // Bound full JID.
+	sm   *smSession // Stream management state, guarded by server.mu.
+}
+
+// JID returns the full JID bound by the client.
+func (sess *Session) JID() string {
+	return sess.jid
+}
+
+// Bare returns the bare JID of the client.
+func (sess *Session) Bare() string {
+	if sess.user == "" {
+		return ""
+	}
+	return sess.user + "@" + sess.server.Domain
+}
+
+// Send writes raw XML, e.g. a stanza, to the client.
+func (sess *Session) Send(data string) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return errClosed
+	}
+	_, err := io.WriteString(sess.conn, data)
+	return err
+}
+
+// Result answers the IQ req with a result containing payload.
+func (sess *Session) Result(req Stanza, payload string) error {
+	return sess.Send(fmt.Sprintf("<iq type='result' id='%s'%s>%s</iq>",
+		escape(req.ID), replyAddrs(req), payload))
+}
+
+// Error answers req with a stanza error of the given type, e.g. "cancel",
+// and defined condition, e.g. "item-not-found".
+func (sess *Session) Error(req Stanza, typ, condition string) error {
+	return sess.Send(fmt.Sprintf("<%s type='error' id='%s'%s><error type='%s'><%s xmlns='%s'/></error></%s>",
+		req.XMLName.Local, escape(req.ID), replyAddrs(req), escape(typ), condition,
+		xmpp.XMPPNS_XMPP_STANZAS, req.XMLName.Local))
+}
+
+// replyAddrs returns the from and to attributes of a reply to req.
+func replyAddrs(req Stanza) string {
+	var attrs string
+	if req.To != "" {
+		attrs += fmt.Sprintf(" from='%s'", escape(req.To))
+	}
+	if req.From != "" {
+		attrs += fmt.Sprintf(" to='%s'", escape(req.From))
+	}
+	return attrs
+}
+
+// StreamError sends a stream error with the given condition, e.g.
+// "conflict", and closes the connection.
+func (sess *Session) StreamError(condition string) error {
+	sess.Send(fmt.Sprintf("<stream:error><%s xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>", condition))
+	return sess.Close()
+}
+
+// Close ends the stream and closes the connection.
+func (sess *Session) Close() error {
+	sess.Send("</stream:stream>")
+	return sess.closeConn()
+}
+
+// upgrade performs the TLS handshake on the connection.
+func (sess *Session) upgrade() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	tc := tls.Server(sess.conn, sess.server.tlsConf)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	sess.conn = tc
+	return nil
+}
+
+func (sess *Session) isTLS() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	_, ok := sess.conn.(*tls.Conn)
+	return ok
+}
+
+func (sess *Session) serve() {
+	defer sess.Close()
+	s := sess.server
+	if s.DirectTLS && !s.NoTLS {
+		if err := sess.upgrade(); err != nil {
+			return
+		}
+	}
+	for {
+		restart, err := sess.stream()
+		if err != nil || !restart {
+			return
+		}
+	}
+}
+
+// stream handles a stream until it is closed or has to be restarted after
+// STARTTLS or SASL.
+func (sess *Session) stream() (restart bool, err error) {
+	sess.dec = xml.NewDecoder(sess.conn)
+	se, err := sess.nextStart()
+	if err != nil {
+		return false, err
+	}
+	if se.Name.Space != nsStream || se.Name.Local != "stream" {
+		sess.StreamError("invalid-namespace")
+		return false, fmt.Errorf("expected <stream>, got <%s> in %s", se.Name.Local, se.Name.Space)
+	}
+	err = sess.Send(fmt.Sprintf("<?xml version='1.0'?>"+
+		"<stream:stream xmlns='%s' xmlns:stream='%s' id='%s' from='%s' version='1.0'>%s",
+		xmpp.XMPPNS_CLIENT, nsStream, randomID(), escape(sess.server.Domain), sess.features()))
+	if err != nil {
+		return false, err
+	}
+	for {
+		t, err := sess.dec.Token()
+		if err != nil {
+			return false, err
+		}
+		switch t := t.(type) {
+		case xml.EndElement:
+			return false, nil
+		case xml.StartElement:
+			restart, err := sess.element(t)
+			if err != nil || restart {
+				return restart, err
+			}
+		}
+	}
+}
+
+// nextStart returns the next start element read from the client.
+func (sess *Session) nextStart() (xml.StartElement, error) {
+	for {
+		t, err := sess.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+// features returns the stream features for the state of the session.
+func (sess *Session) features() string {
+	s := sess.server
+	isTLS := sess.isTLS()
+	var b strings.Builder
+	b.WriteString("<stream:features>")
+	switch {
+	case !isTLS && !s.NoTLS:
+		fmt.Fprintf(&b, "<starttls xmlns='%s'><required/></starttls>", xmpp.XMPPNS_XMPP_TLS)
+	case sess.user == "":
+		var mechanisms []string
+		for _, m := range s.Mechanisms {
+			if isTLS || !strings.HasSuffix(m, "-PLUS") {
+				mechanisms = append(mechanisms, m)
+			}
+		}
+		fmt.Fprintf(&b, "<mechanisms xmlns='%s'>", xmpp.XMPPNS_XMPP_SASL)
+		for _, m := range mechanisms {
+			fmt.Fprintf(&b, "<mechanism>%s</mechanism>", m)
+		}
+		b.WriteString("</mechanisms>")
+		if isTLS && len(s.ChannelBindings) > 0 {
+			fmt.Fprintf(&b, "<sasl-channel-binding xmlns='%s'>", xmpp.XMPPNS_SASL_CB_0)
+			for _, cb := range s.ChannelBindings {
+				fmt.Fprintf(&b, "<channel-binding type='%s'/>", cb)
+			}
+			b.WriteString("</sasl-channel-binding>")
+		}
+		if s.SASL2 {
+			fmt.Fprintf(&b, "<authentication xmlns='%s'>", xmpp.XMPPNS_SASL_2)
+			for _, m := range mechanisms {
+				fmt.Fprintf(&b, "<mechanism>%s</mechanism>", m)
+			}
+			b.WriteString("<inline>")
+			if s.Bind2 {
+				fmt.Fprintf(&b, "<bind xmlns='%s'/>", xmpp.XMPPNS_BIND_0)
+			}
+			if len(s.FAST) > 0 {
+				fmt.Fprintf(&b, "<fast xmlns='%s'>", xmpp.XMPPNS_FAST_0)
+				for _, m := range s.FAST {
+					fmt.Fprintf(&b, "<mechanism>%s</mechanism>", m)
+				}
+				b.WriteString("</fast>")
+			}
+			b.WriteString("</inline>")
+			for _, u := range s.Upgrades {
+				fmt.Fprintf(&b, "<upgrade xmlns='%s'>%s</upgrade>", xmpp.XMPPNS_SASL_UPGRADE_0, u)
+			}
+			b.WriteString("</authentication>")
+		}
+	case sess.jid == "":
+		fmt.Fprintf(&b, "<bind xmlns='%s'/>", xmpp.XMPPNS_XMPP_BIND)
+		if s.StreamManagement {
+			fmt.Fprintf(&b, "<sm xmlns='%s'/>", xmpp.XMPPNS_SM_3)
+		}
+	}
+	if sess.user != "" && s.RosterVersioning {
+		fmt.Fprintf(&b, "<ver xmlns='%s'/>", xmpp.XMPPNS_ROSTERVER)
+	}
+	b.WriteString("</stream:features>")
+	return b.String()
+}
+
+// element handles a top-level element sent by the client.
+func (sess *Session) element(se xml.StartElement) (restart bool, err error) {
+	switch se.Name {
+	case xml.Name{Space: xmpp.XMPPNS_XMPP_TLS, Local: "starttls"}:
+		if err := sess.dec.Skip(); err != nil {
+			return false, err
+		}
+		if sess.isTLS() || sess.server.NoTLS {
+			sess.Send(fmt.Sprintf("<failure xmlns='%s'/>", xmpp.XMPPNS_XMPP_TLS))
+			return false, sess.Close()
+		}
+		if err := sess.Send(fmt.Sprintf("<proceed xmlns='%s'/>", xmpp.XMPPNS_XMPP_TLS)); err != nil {
+			return false, err
+		}
+		return true, sess.upgrade()
+	case xml.Name{Space: xmpp.XMPPNS_XMPP_SASL, Local: "auth"}:
+		var a saslAuth
+		if err := sess.dec.DecodeElement(&a, &se); err != nil {
+			return false, err
+		}
+		return sess.authSASL(a)
+	case xml.Name{Space: xmpp.XMPPNS_SASL_2, Local: "authenticate"}:
+		var a sasl2Authenticate
+		if err := sess.dec.DecodeElement(&a, &se); err != nil {
+			return false, err
+		}
+		return false, sess.authSASL2(a)
+	}
+	if se.Name.Space == xmpp.XMPPNS_SM_3 {
+		return false, sess.smElement(se)
+	}
+	switch se.Name.Local {
+	case "message", "presence", "iq":
+		if se.Name.Space != xmpp.XMPPNS_CLIENT {
+			break
+		}
+		var st Stanza
+		if err := sess.dec.DecodeElement(&st, &se); err != nil {
+			return false, err
+		}
+		if sess.user == "" {
+			return false, sess.StreamError("not-authorized")
+		}
+		sess.smHandled()
+		sess.stanza(st)
+		return false, nil
+	}
+	return false, sess.dec.Skip()
+}
+
+// stanza records a stanza and passes it to its recipient or handler.
+func (sess *Session) stanza(st Stanza) {
+	s := sess.server
+	if sess.jid == "" {
+		if st.XMLName.Local == "iq" && st.Type == "set" &&
+			st.Payload() == (xml.Name{Space: xmpp.XMPPNS_XMPP_BIND, Local: "bind"}) {
+			sess.bind(st)
+			return
+		}
+		sess.StreamError("not-authorized")
+		return
+	}
+	st.From = sess.jid
+	s.record(st)
+
+	toServer := st.To == "" || strings.EqualFold(st.To, s.Domain)
+	if st.XMLName.Local == "iq" {
+		if st.Type != "get" && st.Type != "set" {
+			sess.route(st)
+			return
+		}
+		if toServer || strings.EqualFold(st.To, sess.Bare()) {
+			if h := s.handler("iq " + st.Payload().Space); h != nil {
+				h(sess, st)
+				return
+			}
+		} else if sess.route(st) {
+			return
+		}
+		sess.Error(st, "cancel", "service-unavailable")
+		return
+	}
+	if !toServer && sess.route(st) {
+		return
+	}
+	if h := s.handler(st.XMLName.Local); h != nil {
+		h(sess, st)
+	}
+}
+
+// route delivers st to the connected clients it is addressed to. It
+// reports whether there were any.
+func (sess *Session) route(st Stanza) bool {
+	if st.To == "" {
+		return false
+	}
+	recipients := sess.server.sessionsFor(st.To)
+	for _, r := range recipients {
+		r.Send(st.String())
+	}
+	return len(recipients) > 0
+}
+
+// bind binds the resource requested by the client as described in RFC 6120
+// section 7.
+func (sess *Session) bind(st Stanza) {
+	var b struct {
+		Resource string `xml:"resource"`
+	}
+	xml.Unmarshal([]byte(st.Inner), &b)
+	if b.Resource == "" {
+		b.Resource = randomID()
+	}
+	sess.jid = sess.Bare() + "/" + b.Resource
+	sess.Result(st, fmt.Sprintf("<bind xmlns='%s'><jid>%s</jid></bind>",
+		xmpp.XMPPNS_XMPP_BIND, escape(sess.jid)))
+	sess.server.bound(sess)
+}
+
+// randomID returns a random identifier.
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// errAborted is returned if the client aborted the SASL exchange.
+var errAborted = errors.New("xmpptest: authentication aborted")
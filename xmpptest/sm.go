@@ -0,0 +1,155 @@
+package xmpptest
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	xmpp "github.com/xmppo/go-xmpp"
+)
+
+// smSession is the state of a XEP-0198 Stream Management session. It is
+// guarded by the mutex of the server.
+type smSession struct {
+	id      string
+	user    string
+	jid     string
+	handled uint32   // Stanzas received from the client.
+	acked   uint32   // Last h sent to the client in an <a/>.
+	sess    *Session // Connection the session is attached to, if any.
+}
+
+type smEnable struct {
+	Resume string `xml:"resume,attr"`
+}
+
+type smResume struct {
+	PrevID string `xml:"previd,attr"`
+	H      string `xml:"h,attr"`
+}
+
+// smElement handles the stream management nonza se.
+func (sess *Session) smElement(se xml.StartElement) error {
+	switch se.Name.Local {
+	case "enable":
+		var e smEnable
+		if err := sess.dec.DecodeElement(&e, &se); err != nil {
+			return err
+		}
+		return sess.smEnable(e.Resume == "true" || e.Resume == "1")
+	case "resume":
+		var r smResume
+		if err := sess.dec.DecodeElement(&r, &se); err != nil {
+			return err
+		}
+		return sess.smResume(r.PrevID)
+	case "r":
+		if err := sess.dec.Skip(); err != nil {
+			return err
+		}
+		s := sess.server
+		s.mu.Lock()
+		sm := sess.sm
+		var h uint32
+		if sm != nil {
+			sm.acked = sm.handled
+			h = sm.handled
+		}
+		s.mu.Unlock()
+		if sm == nil {
+			return sess.smFailed("unexpected-request")
+		}
+		return sess.Send(fmt.Sprintf("<a xmlns='%s' h='%d'/>", xmpp.XMPPNS_SM_3, h))
+	}
+	// Acknowledgements of the client are ignored, the server does not
+	// resend its own stanzas.
+	return sess.dec.Skip()
+}
+
+// smEnable enables stream management after resource binding.
+func (sess *Session) smEnable(resume bool) error {
+	s := sess.server
+	if !s.StreamManagement || sess.jid == "" {
+		return sess.smFailed("unexpected-request")
+	}
+	sm := &smSession{id: randomID(), user: sess.user, jid: sess.jid, sess: sess}
+	s.mu.Lock()
+	sess.sm = sm
+	if resume {
+		s.resumable[sm.id] = sm
+	}
+	s.mu.Unlock()
+	if !resume {
+		return sess.Send(fmt.Sprintf("<enabled xmlns='%s'/>", xmpp.XMPPNS_SM_3))
+	}
+	return sess.Send(fmt.Sprintf("<enabled xmlns='%s' id='%s' resume='true'/>", xmpp.XMPPNS_SM_3, sm.id))
+}
+
+// smResume attaches the session previd of the same account to this
+// connection instead of binding a resource, closing the connection it was
+// attached to.
+func (sess *Session) smResume(previd string) error {
+	s := sess.server
+	s.mu.Lock()
+	sm := s.resumable[previd]
+	if sm == nil || sess.user == "" || sm.user != sess.user || sess.jid != "" {
+		s.mu.Unlock()
+		return sess.smFailed("item-not-found")
+	}
+	old := sm.sess
+	sm.sess = sess
+	sess.sm = sm
+	sess.jid = sm.jid
+	h := sm.handled
+	s.mu.Unlock()
+	if old != nil {
+		old.closeConn()
+	}
+	if err := sess.Send(fmt.Sprintf("<resumed xmlns='%s' previd='%s' h='%d'/>",
+		xmpp.XMPPNS_SM_3, escape(previd), h)); err != nil {
+		return err
+	}
+	s.bound(sess)
+	return nil
+}
+
+// smFailed sends a <failed/> with the stanza error condition.
+func (sess *Session) smFailed(condition string) error {
+	return sess.Send(fmt.Sprintf("<failed xmlns='%s'><%s xmlns='%s'/></failed>",
+		xmpp.XMPPNS_SM_3, condition, xmpp.XMPPNS_XMPP_STANZAS))
+}
+
+// smHandled counts a stanza received from the client.
+func (sess *Session) smHandled() {
+	s := sess.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sm := sess.sm; sm != nil && sm.sess == sess {
+		sm.handled++
+	}
+}
+
+// Kill closes the connection without ending the stream, as if the network
+// failed. With stream management the session can be resumed, but the
+// stanzas received since the last <a/> sent to the client are forgotten, so
+// the client has to send them again.
+func (sess *Session) Kill() error {
+	s := sess.server
+	s.mu.Lock()
+	if sm := sess.sm; sm != nil && sm.sess == sess {
+		sm.handled = sm.acked
+		sm.sess = nil
+	}
+	s.mu.Unlock()
+	return sess.closeConn()
+}
+
+// closeConn closes the connection without ending the stream.
+func (sess *Session) closeConn() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return nil
+	}
+	sess.closed = true
+	return sess.conn.Close()
+}
@@ -0,0 +1,598 @@
+// Package xmpptest provides an in-process XMPP server for testing XMPP
+// clients, in the spirit of net/http/httptest.
+//
+// The server negotiates STARTTLS or direct TLS, authenticates with SASL or
+// SASL2 (XEP-0388) using SCRAM, SCRAM-PLUS or PLAIN, supports Bind 2
+// (XEP-0386) and SASL upgrade tasks (XEP-0480), issues FAST (XEP-0484)
+// tokens and offers Stream Management (XEP-0198). Every stanza sent by a
+// client is recorded, so tests can wait for it with the Expect methods, and
+// passed to the registered handlers, which script the replies.
+//
+//	s := &xmpptest.Server{Users: map[string]string{"alice": "secret"}}
+//	if err := s.Start(); err != nil {
+//		t.Fatal(err)
+//	}
+//	defer s.Close()
+//	s.HandleMessage(xmpptest.Echo)
+//	c, err := s.ClientOptions("alice", "secret").NewClient()
+package xmpptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xmpp "github.com/xmppo/go-xmpp"
+)
+
+// Server is an XMPP server listening on a loopback address. The fields must
+// be set before calling Start or Pipe and not be changed afterwards.
+type Server struct {
+	// Addr is the address the server listens on, set by Start.
+	Addr string
+
+	// Domain is the domain served, "localhost" by default.
+	Domain string
+
+	// Users maps the local part of the accounts to their passwords.
+	Users map[string]string
+
+	// Mechanisms are the SASL mechanisms offered. By default the SCRAM
+	// mechanisms and PLAIN are offered, the -PLUS variants only on TLS
+	// connections.
+	Mechanisms []string
+
+	// ChannelBindings are the channel binding types advertised as
+	// described in XEP-0440: SASL Channel-Binding Type Capability. By
+	// default tls-exporter, tls-server-end-point and tls-unique.
+	ChannelBindings []string
+
+	// Iterations is the SCRAM iteration count, 4096 by default.
+	Iterations int
+
+	// DirectTLS makes clients negotiate TLS right after connecting as
+	// described in XEP-0368. Otherwise STARTTLS is required.
+	DirectTLS bool
+
+	// NoTLS disables TLS, clients authenticate over the plain connection.
+	NoTLS bool
+
+	// TLSConfig is the base of the server TLS configuration. A self-signed
+	// certificate for Domain is added if it has no certificates.
+	TLSConfig *tls.Config
+
+	// SASL2 offers XEP-0388: Extensible SASL Profile on TLS connections.
+	SASL2 bool
+
+	// Bind2 offers XEP-0386: Bind 2 inline with SASL2.
+	Bind2 bool
+
+	// FAST are the XEP-0484: Fast Authentication Streamlining Tokens
+	// mechanisms offered inline with SASL2, e.g. xmpp.HT_SHA_256_NONE.
+	FAST []string
+
+	// Upgrades are the XEP-0480: SASL Upgrade Tasks offered with SASL2,
+	// e.g. xmpp.UPGR_SCRAM_SHA_256. The server verifies the salted password
+	// sent by the client, see Upgraded.
+	Upgrades []string
+
+	// StreamManagement offers XEP-0198: Stream Management. Sessions can
+	// be resumed, the server acknowledges the stanzas of the client but
+	// does not request acknowledgements itself. See Session.Kill.
+	StreamManagement bool
+
+	// TokenLifetime is the validity of issued FAST tokens, 24 hours by
+	// default.
+	TokenLifetime time.Duration
+
+	// Roster maps the local part of the accounts to their roster.
+	Roster map[string][]RosterItem
+
+	// RosterVersioning offers XEP-0237: Roster Versioning. The version is
+	// a counter of the changes of the roster of an account.
+	RosterVersioning bool
+
+	// Identities and Features are returned for disco#info queries to the
+	// server domain. By default the server is an "im" server supporting
+	// disco#info and ping.
+	Identities []Identity
+	Features   []string
+
+	// Timeout limits how long the Expect methods wait, 5 seconds by
+	// default.
+	Timeout time.Duration
+
+	initOnce sync.Once
+	initErr  error
+	cert     tls.Certificate
+	tlsConf  *tls.Config
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	sessions  []*Session
+	conns     map[net.Conn]struct{}
+	received  []Stanza
+	consumed  []bool
+	changed   chan struct{}
+	handlers  map[string]Handler
+	salts     map[string][]byte
+	tokens    map[string]fastToken
+	upgraded  map[string][]string   // Completed upgrade tasks by account.
+	resumable map[string]*smSession // Stream management sessions by id.
+	versions  map[string]int        // Roster versions by account.
+}
+
+// fastToken is a FAST token issued for an account.
+type fastToken struct {
+	value     string
+	mechanism string
+	expiry    time.Time
+}
+
+// init applies the defaults and creates the TLS configuration.
+func (s *Server) init() error {
+	s.initOnce.Do(func() {
+		if s.Domain == "" {
+			s.Domain = "localhost"
+		}
+		if s.Iterations == 0 {
+			s.Iterations = 4096
+		}
+		if s.TokenLifetime == 0 {
+			s.TokenLifetime = 24 * time.Hour
+		}
+		if s.Timeout == 0 {
+			s.Timeout = 5 * time.Second
+		}
+		if s.Mechanisms == nil {
+			s.Mechanisms = []string{
+				xmpp.SCRAM_SHA_512_PLUS, xmpp.SCRAM_SHA_256_PLUS, xmpp.SCRAM_SHA_1_PLUS,
+				xmpp.SCRAM_SHA_512, xmpp.SCRAM_SHA_256, xmpp.SCRAM_SHA_1, "PLAIN",
+			}
+		}
+		if s.ChannelBindings == nil {
+			s.ChannelBindings = []string{"tls-exporter", "tls-server-end-point", "tls-unique"}
+		}
+		if s.Identities == nil {
+			s.Identities = []Identity{{Category: "server", Type: "im"}}
+		}
+		if s.Features == nil {
+			s.Features = []string{xmpp.XMPPNS_DISCO_INFO, xmpp.XMPPNS_PING}
+		}
+		s.changed = make(chan struct{})
+		s.conns = make(map[net.Conn]struct{})
+		s.salts = make(map[string][]byte)
+		s.tokens = make(map[string]fastToken)
+		s.upgraded = make(map[string][]string)
+		s.resumable = make(map[string]*smSession)
+		if s.handlers == nil {
+			s.handlers = make(map[string]Handler)
+		}
+		for space, h := range map[string]Handler{
+			xmpp.XMPPNS_ROSTER:     RosterHandler,
+			xmpp.XMPPNS_DISCO_INFO: DiscoInfoHandler,
+			xmpp.XMPPNS_PING:       PingHandler,
+		} {
+			if _, ok := s.handlers["iq "+space]; !ok {
+				s.handlers["iq "+space] = h
+			}
+		}
+
+		if s.TLSConfig != nil {
+			s.tlsConf = s.TLSConfig.Clone()
+		} else {
+			s.tlsConf = new(tls.Config)
+		}
+		if len(s.tlsConf.Certificates) == 0 {
+			cert, err := selfSigned(s.Domain)
+			if err != nil {
+				s.initErr = err
+				return
+			}
+			s.tlsConf.Certificates = []tls.Certificate{cert}
+		}
+		s.cert = s.tlsConf.Certificates[0]
+		if s.cert.Leaf == nil {
+			s.cert.Leaf, s.initErr = x509.ParseCertificate(s.cert.Certificate[0])
+		}
+	})
+	return s.initErr
+}
+
+// selfSigned creates a certificate for domain and the loopback addresses.
+func selfSigned(domain string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Start listens on a random loopback port and serves clients until Close is
+// called.
+func (s *Server) Start() error {
+	if err := s.init(); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	s.Addr = l.Addr().String()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Pipe serves a client over an in-memory connection and returns the client
+// end, e.g. for xmpp.NewClientFromConn.
+func (s *Server) Pipe() (net.Conn, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	s.serve(server)
+	return client, nil
+}
+
+func (s *Server) serve(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go func() {
+		defer s.wg.Done()
+		sess := &Session{server: s, conn: conn}
+		sess.serve()
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.sessions = slices.DeleteFunc(s.sessions, func(o *Session) bool { return o == sess })
+		s.mu.Unlock()
+	}()
+}
+
+// Close stops listening, closes all connections and waits for their
+// goroutines to finish.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// ClientTLSConfig returns a TLS configuration trusting the server
+// certificate.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	if err := s.init(); err != nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert.Leaf)
+	return &tls.Config{RootCAs: pool, ServerName: s.Domain}
+}
+
+// ClientOptions returns the options for an xmpp.Client to log in to the
+// server as the account user.
+func (s *Server) ClientOptions(user, password string) xmpp.Options {
+	return xmpp.Options{
+		Host:                         s.Addr,
+		User:                         user + "@" + s.Domain,
+		Password:                     password,
+		TLSConfig:                    s.ClientTLSConfig(),
+		NoTLS:                        !s.DirectTLS,
+		InsecureAllowUnencryptedAuth: s.NoTLS,
+	}
+}
+
+// HandleIQ registers h for get and set IQs addressed to the server or the
+// account with a payload in the namespace space, replacing the built-in
+// handler for that namespace.
+func (s *Server) HandleIQ(space string, h Handler) {
+	s.handle("iq "+space, h)
+}
+
+// HandleMessage registers h for messages that are not addressed to a
+// connected client.
+func (s *Server) HandleMessage(h Handler) {
+	s.handle("message", h)
+}
+
+// HandlePresence registers h for presences that are not addressed to a
+// connected client.
+func (s *Server) HandlePresence(h Handler) {
+	s.handle("presence", h)
+}
+
+func (s *Server) handle(key string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers == nil {
+		s.handlers = make(map[string]Handler)
+	}
+	s.handlers[key] = h
+}
+
+func (s *Server) handler(key string) Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handlers[key]
+}
+
+// FASTToken returns the FAST token currently issued for the account user.
+func (s *Server) FASTToken(user string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[user].value
+}
+
+// Upgraded returns the XEP-0480 upgrade tasks completed by the account user.
+func (s *Server) Upgraded(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.upgraded[user])
+}
+
+// Sessions returns the sessions of the clients that bound a resource.
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.sessions)
+}
+
+// sessionsFor returns the sessions a stanza to jid is delivered to: the
+// session with that full JID or all sessions of a bare JID.
+func (s *Server) sessionsFor(jid string) []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []*Session
+	for _, sess := range s.sessions {
+		if strings.EqualFold(sess.jid, jid) || strings.EqualFold(sess.Bare(), jid) {
+			r = append(r, sess)
+		}
+	}
+	return r
+}
+
+func (s *Server) bound(sess *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = append(s.sessions, sess)
+	s.notify()
+}
+
+func (s *Server) record(st Stanza) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, st)
+	s.consumed = append(s.consumed, false)
+	s.notify()
+}
+
+// notify wakes up the goroutines waiting in Expect or WaitSession. s.mu
+// must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Received returns all stanzas received from clients so far.
+func (s *Server) Received() []Stanza {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.received)
+}
+
+// WaitSession waits until a client bound a resource and returns its
+// session. t fails if no client did within the timeout.
+func (s *Server) WaitSession(t testing.TB) *Session {
+	t.Helper()
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		if len(s.sessions) > 0 {
+			sess := s.sessions[0]
+			s.mu.Unlock()
+			return sess
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			t.Fatalf("xmpptest: no client bound a resource within %v", s.Timeout)
+			return nil
+		}
+	}
+}
+
+// Expect waits for a received stanza for which match returns true and
+// returns it. Each stanza is returned only once, so repeated calls return
+// the following matches. t fails if no stanza matched within the timeout.
+func (s *Server) Expect(t testing.TB, match func(Stanza) bool) Stanza {
+	t.Helper()
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	next := 0
+	for {
+		s.mu.Lock()
+		for ; next < len(s.received); next++ {
+			if !s.consumed[next] && match(s.received[next]) {
+				s.consumed[next] = true
+				st := s.received[next]
+				s.mu.Unlock()
+				return st
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			t.Fatalf("xmpptest: no matching stanza received within %v", s.Timeout)
+			return Stanza{}
+		}
+	}
+}
+
+// ExpectMessage waits for a message with the given body, see Expect.
+func (s *Server) ExpectMessage(t testing.TB, body string) Stanza {
+	t.Helper()
+	return s.Expect(t, func(st Stanza) bool {
+		return st.XMLName.Local == "message" && st.Body() == body
+	})
+}
+
+// ExpectPresence waits for a presence of the given type, "" for available,
+// see Expect.
+func (s *Server) ExpectPresence(t testing.TB, typ string) Stanza {
+	t.Helper()
+	return s.Expect(t, func(st Stanza) bool {
+		return st.XMLName.Local == "presence" && st.Type == typ
+	})
+}
+
+// ExpectIQ waits for an IQ of the given type with a payload in the
+// namespace space, see Expect.
+func (s *Server) ExpectIQ(t testing.TB, typ, space string) Stanza {
+	t.Helper()
+	return s.Expect(t, func(st Stanza) bool {
+		return st.XMLName.Local == "iq" && st.Type == typ && st.Payload().Space == space
+	})
+}
+
+// Stanza is a message, presence or iq stanza received from a client. From
+// is set to the full JID of the client if it was missing.
+type Stanza struct {
+	XMLName xml.Name
+	From    string     `xml:"from,attr"`
+	To      string     `xml:"to,attr"`
+	ID      string     `xml:"id,attr"`
+	Type    string     `xml:"type,attr"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// Payload returns the name of the first child element.
+func (st Stanza) Payload() xml.Name {
+	d := xml.NewDecoder(strings.NewReader(st.Inner))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name
+		}
+	}
+}
+
+// Body returns the text of the body element of a message.
+func (st Stanza) Body() string {
+	var v struct {
+		Body string `xml:"body"`
+	}
+	xml.Unmarshal([]byte("<s>"+st.Inner+"</s>"), &v)
+	return v.Body
+}
+
+// String returns the XML of the stanza.
+func (st Stanza) String() string {
+	var b strings.Builder
+	b.WriteString("<" + st.XMLName.Local)
+	for _, a := range []xml.Attr{
+		{Name: xml.Name{Local: "from"}, Value: st.From},
+		{Name: xml.Name{Local: "to"}, Value: st.To},
+		{Name: xml.Name{Local: "id"}, Value: st.ID},
+		{Name: xml.Name{Local: "type"}, Value: st.Type},
+	} {
+		if a.Value != "" {
+			fmt.Fprintf(&b, " %s='%s'", a.Name.Local, escape(a.Value))
+		}
+	}
+	for _, a := range st.Attrs {
+		switch {
+		case a.Name.Space == "xmlns" || a.Name.Local == "xmlns" && a.Name.Space == "":
+			// Namespace declarations of the client stream.
+		case a.Name.Space == "http://www.w3.org/XML/1998/namespace":
+			fmt.Fprintf(&b, " xml:%s='%s'", a.Name.Local, escape(a.Value))
+		case a.Name.Space == "":
+			fmt.Fprintf(&b, " %s='%s'", a.Name.Local, escape(a.Value))
+		}
+	}
+	b.WriteString(">" + st.Inner + "</" + st.XMLName.Local + ">")
+	return b.String()
+}
+
+// escape escapes s for use in XML text and attribute values.
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// errClosed is returned when sending on a closed session.
+var errClosed = errors.New("xmpptest: session closed")
@@ -0,0 +1,1126 @@
+package xmpptest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	xmpp "github.com/xmppo/go-xmpp"
+	"github.com/xmppo/go-xmpp/xmpptest"
+)
+
+func startServer(t *testing.T, s *xmpptest.Server) *xmpptest.Server {
+	t.Helper()
+	if s.Users == nil {
+		s.Users = map[string]string{"alice": "secret", "bob": "hunter2"}
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// connect logs in and receives stanzas in the background, so IQ requests
+// are answered. The client is disconnected when the server is closed.
+func connect(t *testing.T, o xmpp.Options) (*xmpp.Client, <-chan interface{}) {
+	t.Helper()
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzas := make(chan interface{}, 16)
+	go func() {
+		defer close(stanzas)
+		for {
+			v, err := c.Recv()
+			if err != nil {
+				return
+			}
+			stanzas <- v
+		}
+	}()
+	return c, stanzas
+}
+
+func TestSCRAM(t *testing.T) {
+	for _, tt := range []struct {
+		mechanism       string
+		channelBindings []string
+		maxVersion      uint16
+		directTLS       bool
+	}{
+		{mechanism: xmpp.SCRAM_SHA_1},
+		{mechanism: xmpp.SCRAM_SHA_256, directTLS: true},
+		{mechanism: xmpp.SCRAM_SHA_512},
+		{mechanism: xmpp.SCRAM_SHA_1_PLUS, directTLS: true},
+		{mechanism: xmpp.SCRAM_SHA_256_PLUS, channelBindings: []string{"tls-server-end-point"}},
+		{mechanism: xmpp.SCRAM_SHA_512_PLUS, maxVersion: tls.VersionTLS12},
+	} {
+		t.Run(tt.mechanism, func(t *testing.T) {
+			s := startServer(t, &xmpptest.Server{
+				Mechanisms:      []string{tt.mechanism},
+				ChannelBindings: tt.channelBindings,
+				DirectTLS:       tt.directTLS,
+				TLSConfig:       &tls.Config{MaxVersion: tt.maxVersion},
+			})
+			c, _ := connect(t, s.ClientOptions("alice", "secret"))
+			if c.Mechanism != tt.mechanism {
+				t.Errorf("mechanism = %q, want %q", c.Mechanism, tt.mechanism)
+			}
+			if !strings.HasPrefix(c.JID(), "alice@localhost/") {
+				t.Errorf("JID = %q", c.JID())
+			}
+			s.ExpectPresence(t, "")
+		})
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{})
+	o := s.ClientOptions("alice", "wrong")
+	if _, err := o.NewClient(); err == nil || !strings.Contains(err.Error(), "not-authorized") {
+		t.Fatalf("NewClient with a wrong password: %v", err)
+	}
+	o = s.ClientOptions("alice", "secret")
+	o.Mechanism = "PLAIN"
+	connect(t, o)
+}
+
+func TestSASL2(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{
+		DirectTLS: true,
+		SASL2:     true,
+		Bind2:     true,
+		FAST:      []string{xmpp.HT_SHA_256_NONE},
+	})
+	o := s.ClientOptions("alice", "secret")
+	o.Fast = true
+	o.UserAgentID = "d4565fa7-4d72-4749-b3d3-740edbf87770"
+	c, _ := connect(t, o)
+	if !strings.HasPrefix(c.JID(), "alice@localhost/go-xmpp.") {
+		t.Errorf("JID bound with bind2 = %q", c.JID())
+	}
+	if s.WaitSession(t).JID() != c.JID() {
+		t.Errorf("session JID = %q, want %q", s.WaitSession(t).JID(), c.JID())
+	}
+	if c.Fast.Token == "" || c.Fast.Token != s.FASTToken("alice") {
+		t.Fatalf("FAST token = %q, server issued %q", c.Fast.Token, s.FASTToken("alice"))
+	}
+
+	o.Password = ""
+	o.FastToken = c.Fast.Token
+	o.FastMechanism = c.Fast.Mechanism
+	c, _ = connect(t, o)
+	if c.Mechanism != xmpp.HT_SHA_256_NONE {
+		t.Errorf("mechanism = %q, want %q", c.Mechanism, xmpp.HT_SHA_256_NONE)
+	}
+
+	o.FastToken = "invalid"
+	if _, err := o.NewClient(); err == nil {
+		t.Error("NewClient with an invalid FAST token succeeded")
+	}
+}
+
+func TestSASLUpgrade(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{
+		Mechanisms: []string{xmpp.SCRAM_SHA_1},
+		SASL2:      true,
+		Upgrades:   []string{xmpp.UPGR_SCRAM_SHA_256, xmpp.UPGR_SCRAM_SHA_512},
+	})
+	o := s.ClientOptions("alice", "secret")
+	c, _ := connect(t, o)
+	if c.Mechanism != xmpp.SCRAM_SHA_1 {
+		t.Errorf("mechanism = %q, want %q", c.Mechanism, xmpp.SCRAM_SHA_1)
+	}
+	if got := s.Upgraded("alice"); !slices.Equal(got, []string{xmpp.UPGR_SCRAM_SHA_512}) {
+		t.Errorf("upgrades = %q", got)
+	}
+	s.ExpectPresence(t, "")
+
+	o.NoSASLUpgrade = true
+	connect(t, o)
+	s.ExpectPresence(t, "")
+	if got := s.Upgraded("alice"); len(got) != 1 {
+		t.Errorf("upgrades with NoSASLUpgrade = %q", got)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{
+		DirectTLS: true,
+		Roster: map[string][]xmpptest.RosterItem{
+			"alice": {{JID: "bob@localhost", Name: "Bob", Subscription: "both", Groups: []string{"Friends"}}},
+		},
+		Features: []string{xmpp.XMPPNS_DISCO_INFO, "urn:example:feature"},
+	})
+	s.HandleMessage(xmpptest.Echo)
+	s.HandleIQ("urn:example:time", func(sess *xmpptest.Session, st xmpptest.Stanza) {
+		sess.Result(st, "<time xmlns='urn:example:time'>12:00</time>")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, stanzas := connect(t, s.ClientOptions("alice", "secret"))
+
+	roster, err := c.RosterContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roster) != 1 || roster[0].Remote != "bob@localhost" || roster[0].Name != "Bob" {
+		t.Errorf("roster = %+v", roster)
+	}
+	info, err := c.DiscoverInfoContext(ctx, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Features) != 2 || info.Features[1] != "urn:example:feature" {
+		t.Errorf("features = %v", info.Features)
+	}
+	if err := c.PingC2SContext(ctx, "", ""); err != nil {
+		t.Error(err)
+	}
+	iq, err := c.SendIQ(ctx, xmpp.IQ{Type: xmpp.IQTypeGet, Query: []byte("<time xmlns='urn:example:time'/>")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(iq.Query), "12:00") {
+		t.Errorf("scripted reply = %s", iq.Query)
+	}
+	if _, err := c.SendIQ(ctx, xmpp.IQ{Type: xmpp.IQTypeGet, Query: []byte("<query xmlns='urn:example:unknown'/>")}); !errors.Is(err, xmpp.ErrServiceUnavailable) {
+		t.Errorf("unhandled IQ returned %v, want service-unavailable", err)
+	}
+	s.ExpectIQ(t, xmpp.IQTypeGet, "urn:example:unknown")
+
+	if _, err := c.Send(xmpp.Chat{Remote: "localhost", Type: "chat", Text: "hello <world>"}); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.ExpectMessage(t, "hello <world>"); st.From != c.JID() {
+		t.Errorf("message from %q, want %q", st.From, c.JID())
+	}
+	for v := range stanzas {
+		if chat, ok := v.(xmpp.Chat); ok {
+			if chat.Text != "hello <world>" || chat.Remote != "localhost" {
+				t.Errorf("echo = %+v", chat)
+			}
+			break
+		}
+	}
+}
+
+func TestRoster(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{
+		Roster: map[string][]xmpptest.RosterItem{
+			"alice": {{JID: "bob@localhost", Name: "Bob", Subscription: "to", Ask: "subscribe"}},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, stanzas := connect(t, s.ClientOptions("alice", "secret"))
+	next := func() xmpp.RosterEvent {
+		t.Helper()
+		for v := range stanzas {
+			if ev, ok := v.(xmpp.RosterEvent); ok {
+				return ev
+			}
+		}
+		t.Fatal("connection closed before roster event")
+		return xmpp.RosterEvent{}
+	}
+
+	if err := c.Roster(); err != nil {
+		t.Fatal(err)
+	}
+	ev := next()
+	if ev.Push || len(ev.Items) != 1 || ev.Items[0].JID != "bob@localhost" ||
+		ev.Items[0].Subscription != xmpp.SubscriptionTo || ev.Items[0].Ask != "subscribe" {
+		t.Errorf("roster = %+v", ev)
+	}
+
+	// The subscription of added items is controlled by the server.
+	carol := xmpp.RosterItem{JID: "carol@localhost", Name: "Carol", Subscription: xmpp.SubscriptionBoth, Groups: []string{"Work"}}
+	if err := c.RosterAddContext(ctx, carol); err != nil {
+		t.Fatal(err)
+	}
+	ev = next()
+	if !ev.Push || len(ev.Items) != 1 || ev.Items[0].Name != "Carol" ||
+		ev.Items[0].Subscription != xmpp.SubscriptionNone || !slices.Equal(ev.Items[0].Groups, carol.Groups) {
+		t.Errorf("push = %+v", ev)
+	}
+	s.Expect(t, func(st xmpptest.Stanza) bool {
+		return st.XMLName.Local == "iq" && st.Type == xmpp.IQTypeResult && strings.HasPrefix(st.ID, "push")
+	})
+
+	if _, err := c.RosterUpdate(xmpp.RosterItem{JID: "carol@localhost", Name: "Caroline"}); err != nil {
+		t.Fatal(err)
+	}
+	if ev = next(); len(ev.Items) != 1 || ev.Items[0].Name != "Caroline" || ev.Items[0].Groups != nil {
+		t.Errorf("push = %+v", ev)
+	}
+
+	// Refused changes are reported with the error of the reply.
+	bad := xmpp.RosterItem{JID: "dave@localhost", Groups: []string{""}}
+	if err := c.RosterAddContext(ctx, bad); !errors.Is(err, xmpp.ErrNotAcceptable) {
+		t.Errorf("RosterAddContext() = %v; want not-acceptable", err)
+	}
+	id, err := c.RosterAdd(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v := range stanzas {
+		if iq, ok := v.(xmpp.IQ); ok && iq.ID == id {
+			if !errors.Is(iq.StanzaError, xmpp.ErrNotAcceptable) {
+				t.Errorf("reply = %+v", iq)
+			}
+			break
+		}
+	}
+
+	if err := c.RosterRemoveContext(ctx, "bob@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ev = next(); len(ev.Items) != 1 || ev.Items[0].JID != "bob@localhost" || ev.Items[0].Subscription != xmpp.SubscriptionRemove {
+		t.Errorf("push = %+v", ev)
+	}
+	if roster := s.RosterOf("alice"); len(roster) != 1 || roster[0].Name != "Caroline" {
+		t.Errorf("server roster = %+v", roster)
+	}
+
+	// Pushes from other entities are ignored and not acknowledged.
+	s.WaitSession(t).Send("<iq type='set' id='spoofed' from='mallory@localhost'><query xmlns='jabber:iq:roster'><item jid='eve@localhost'/></query></iq>")
+	items, err := c.RosterItemsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].JID != "carol@localhost" {
+		t.Errorf("roster = %+v", items)
+	}
+	if err := c.Roster(); err != nil {
+		t.Fatal(err)
+	}
+	if ev = next(); ev.Push {
+		t.Errorf("spoofed push returned: %+v", ev)
+	}
+	for _, st := range s.Received() {
+		if st.ID == "spoofed" {
+			t.Errorf("spoofed push acknowledged: %+v", st)
+		}
+	}
+}
+
+// countingStore counts the complete rosters stored.
+type countingStore struct {
+	xmpp.RosterStore
+	replaced atomic.Int32
+}
+
+func (s *countingStore) Replace(ver string, items []xmpp.RosterItem) error {
+	s.replaced.Add(1)
+	return s.RosterStore.Replace(ver, items)
+}
+
+func TestRosterVersioning(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{
+		RosterVersioning: true,
+		Roster: map[string][]xmpptest.RosterItem{
+			"alice": {{JID: "bob@localhost", Name: "Bob", Subscription: "both"}},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "roster.json")
+	store := &countingStore{RosterStore: xmpp.NewFileRosterStore(path)}
+	o := s.ClientOptions("alice", "secret")
+	o.RosterStore = store
+
+	c, stanzas := connect(t, o)
+	items, err := c.RosterItemsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || store.replaced.Load() != 1 {
+		t.Fatalf("roster = %+v, stored %d times", items, store.replaced.Load())
+	}
+	if st := s.ExpectIQ(t, xmpp.IQTypeGet, xmpp.XMPPNS_ROSTER); !strings.Contains(st.Inner, `ver=""`) {
+		t.Errorf("first request %s, want empty ver", st.Inner)
+	}
+	if err := c.RosterAddContext(ctx, xmpp.RosterItem{JID: "carol@localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	for v := range stanzas {
+		if ev, ok := v.(xmpp.RosterEvent); ok {
+			if !ev.Push || ev.Ver != "1" {
+				t.Errorf("push = %+v", ev)
+			}
+			break
+		}
+	}
+
+	// A second client of the account sharing the store receives no items,
+	// as the roster did not change since.
+	c, _ = connect(t, o)
+	items, err = c.RosterItemsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].JID != "carol@localhost" || store.replaced.Load() != 1 {
+		t.Errorf("roster = %+v, stored %d times", items, store.replaced.Load())
+	}
+	if st := s.ExpectIQ(t, xmpp.IQTypeGet, xmpp.XMPPNS_ROSTER); !strings.Contains(st.Inner, `ver="1"`) {
+		t.Errorf("second request %s, want ver 1", st.Inner)
+	}
+	if snapshot, err := c.RosterSnapshot(); err != nil || !slices.EqualFunc(snapshot, items, func(a, b xmpp.RosterItem) bool { return a.JID == b.JID }) {
+		t.Errorf("snapshot = %+v, %v", snapshot, err)
+	}
+
+	ver, items, err := xmpp.NewFileRosterStore(path).Load()
+	if err != nil || ver != "1" || len(items) != 2 {
+		t.Errorf("file = %q %+v %v", ver, items, err)
+	}
+}
+
+func TestCaps(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{})
+	ao := s.ClientOptions("alice", "secret")
+	ao.CapsCache = &xmpp.MemoryCapsCache{}
+	alice, stanzas := connect(t, ao)
+	bo := s.ClientOptions("bob", "hunter2")
+	bo.Features = []string{"urn:xmpp:receipts"}
+	bob, _ := connect(t, bo)
+
+	// Alice resolves the caps of the presence with a disco#info query,
+	// which bob's client answers.
+	if _, err := bob.SendPresence(xmpp.Presence{To: alice.JID()}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	info, ok := alice.Capabilities(bob.JID())
+	for ; !ok && time.Now().Before(deadline); info, ok = alice.Capabilities(bob.JID()) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ok || !info.HasFeature("urn:xmpp:receipts") || !info.HasFeature(xmpp.XMPPNS_PING) ||
+		len(info.Identities) != 1 || info.Identities[0].Name != "go-xmpp" {
+		t.Fatalf("Capabilities() = %+v, %v", info, ok)
+	}
+	query := s.Expect(t, func(st xmpptest.Stanza) bool {
+		return st.Type == xmpp.IQTypeGet && st.To == bob.JID()
+	})
+	if !strings.Contains(query.Inner, xmpp.XMPPNS_ECAPS2+"#sha-256.") {
+		t.Errorf("disco#info query %s", query.Inner)
+	}
+
+	// Known caps are not resolved again. The message sent after the
+	// presence makes sure alice has processed it.
+	if _, err := bob.SendPresence(xmpp.Presence{To: alice.JID(), Show: "away"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Send(xmpp.Chat{Remote: alice.JID(), Type: "chat", Text: "done"}); err != nil {
+		t.Fatal(err)
+	}
+	for v := range stanzas {
+		if p, ok := v.(xmpp.Presence); ok {
+			var caps xmpp.Caps
+			if !p.Extension(&caps) || caps.Node != xmpp.DefaultCapsNode || caps.Hash != "sha-1" {
+				t.Errorf("caps = %+v", caps)
+			}
+		}
+		if _, ok := v.(xmpp.Chat); ok {
+			break
+		}
+	}
+	queries := 0
+	for _, st := range s.Received() {
+		if st.Type == xmpp.IQTypeGet && st.To == bob.JID() {
+			queries++
+		}
+	}
+	if queries != 1 {
+		t.Errorf("sent %d disco#info queries, want 1", queries)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{NoTLS: true})
+	alice, _ := connect(t, s.ClientOptions("alice", "secret"))
+
+	conn, err := s.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := s.ClientOptions("bob", "hunter2")
+	o.Resource = "phone"
+	bob, err := xmpp.NewClientFromConn(conn, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if bob.JID() != "bob@localhost/phone" {
+		t.Fatalf("JID = %q", bob.JID())
+	}
+	if _, err := alice.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "hi bob"}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		v, err := bob.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chat, ok := v.(xmpp.Chat); ok {
+			if chat.Text != "hi bob" || chat.Remote != alice.JID() {
+				t.Errorf("chat = %+v", chat)
+			}
+			break
+		}
+	}
+}
+
+// seeOtherHost sends a see-other-host stream error to the client of s.
+func seeOtherHost(t *testing.T, s *xmpptest.Server, host string) {
+	t.Helper()
+	sess := s.WaitSession(t)
+	sess.Send("<stream:error><see-other-host xmlns='urn:ietf:params:xml:ns:xmpp-streams'>" +
+		host + "</see-other-host></stream:error>")
+	sess.Close()
+}
+
+func TestRedirect(t *testing.T) {
+	a := startServer(t, &xmpptest.Server{})
+	b := startServer(t, &xmpptest.Server{})
+	o := a.ClientOptions("alice", "secret")
+	// The servers have different self-signed certificates.
+	o.TLSConfig.InsecureSkipVerify = true
+
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeOtherHost(t, a, b.Addr)
+	var serr *xmpp.StreamError
+	if _, err := c.Recv(); !errors.As(err, &serr) || serr.Condition != "see-other-host" || serr.Host != b.Addr {
+		t.Fatalf("Recv() error = %v, want see-other-host %s", err, b.Addr)
+	}
+	if c, err = c.Redirect(serr.Host); err != nil {
+		t.Fatal(err)
+	}
+	if sess := b.WaitSession(t); sess.JID() != c.JID() {
+		t.Errorf("session JID = %q, want %q", sess.JID(), c.JID())
+	}
+	seeOtherHost(t, b, b.Addr)
+	if _, err := c.Recv(); !errors.As(err, &serr) {
+		t.Fatalf("Recv() error = %v, want see-other-host", err)
+	}
+	if _, err := c.Redirect(serr.Host); err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("redirect loop: %v", err)
+	}
+
+	connected := make(chan struct{}, 2)
+	m := xmpp.NewManagedClient(o, xmpp.Policy{
+		FollowRedirects: true,
+		InitialBackoff:  time.Hour,
+		OnStateChange: func(sc xmpp.StateChange) {
+			if sc.State == xmpp.StateConnected {
+				connected <- struct{}{}
+			}
+		},
+	})
+	if _, err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+	seeOtherHost(t, a, b.Addr)
+	go m.Recv()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("managed client was not redirected")
+	}
+	if c := m.Client(); c == nil || !strings.HasPrefix(c.JID(), "alice@localhost/") {
+		t.Errorf("managed client = %v", c)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written by the receiving
+// goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestLogger(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{Mechanisms: []string{"PLAIN"}})
+	var buf syncBuffer
+	o := s.ClientOptions("alice", "secret")
+	o.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c, _ := connect(t, o)
+	s.ExpectPresence(t, "")
+	if _, err := c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "logged"}); err != nil {
+		t.Fatal(err)
+	}
+	s.ExpectMessage(t, "logged")
+
+	out := buf.String()
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	if strings.Contains(out, plain) || strings.Contains(out, "secret") {
+		t.Errorf("credentials were logged:\n%s", out)
+	}
+	for _, want := range []string{
+		"msg=connected",
+		"msg=\"starttls completed\"",
+		"msg=\"session established\" jid=" + c.JID(),
+		"dir=send kind=auth stanza=\"<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>[redacted]</auth>\"",
+		"dir=recv kind=success",
+		"dir=recv kind=features",
+		"dir=send kind=message id=",
+		"type=chat stanza=",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log does not contain %s:\n%s", want, out)
+		}
+	}
+
+	// Debug writes each stanza as a single line.
+	buf.Reset()
+	o.Logger = nil
+	o.Debug = true
+	o.DebugWriter = &buf
+	connect(t, o)
+	s.ExpectPresence(t, "")
+	for line := range strings.Lines(buf.String()) {
+		if !strings.HasPrefix(line, "SEND <") && !strings.HasPrefix(line, "RECV <") &&
+			!strings.HasPrefix(line, "xmpp: ") {
+			t.Errorf("unexpected debug line %q", line)
+		}
+	}
+	if !strings.Contains(buf.String(), "SEND <presence") {
+		t.Errorf("presence is missing in debug output:\n%s", buf.String())
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{})
+	var mu sync.Mutex
+	var audit []string
+	o := s.ClientOptions("alice", "secret")
+	o.OutboundInterceptors = []xmpp.Interceptor{func(next xmpp.StanzaHandler) xmpp.StanzaHandler {
+		return func(st *xmpp.Stanza) error {
+			if st.To() == "spam@localhost" {
+				return nil
+			}
+			if st.Name() == "message" {
+				st.InnerXML += "<header xmlns='urn:example:headers'>1</header>"
+			}
+			mu.Lock()
+			audit = append(audit, st.Name()+" "+st.Type())
+			mu.Unlock()
+			return next(st)
+		}
+	}}
+	c, stanzas := connect(t, o)
+	sess := s.WaitSession(t)
+	c.UseInbound(func(next xmpp.StanzaHandler) xmpp.StanzaHandler {
+		return func(st *xmpp.Stanza) error {
+			switch {
+			case strings.Contains(st.InnerXML, "drop"):
+				return nil
+			case strings.Contains(st.InnerXML, "twice"):
+				if err := next(st); err != nil {
+					return err
+				}
+			}
+			st.SetAttr("from", "intercepted@localhost")
+			return next(st)
+		}
+	})
+
+	c.Send(xmpp.Chat{Remote: "spam@localhost", Type: "chat", Text: "spam"})
+	c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "hi"})
+	if st := s.ExpectMessage(t, "hi"); !strings.Contains(st.Inner, "urn:example:headers") {
+		t.Errorf("header was not added: %s", st)
+	}
+	for _, st := range s.Received() {
+		if st.To == "spam@localhost" {
+			t.Errorf("dropped stanza was sent: %s", st)
+		}
+	}
+
+	sess.Send("<message type='chat' from='bob@localhost'><body>drop</body></message>")
+	sess.Send("<message type='chat' from='bob@localhost'><body>twice</body></message>")
+	sess.Send("<iq type='get' id='ping1' from='localhost'><ping xmlns='urn:xmpp:ping'/></iq>")
+	s.ExpectIQ(t, xmpp.IQTypeResult, "")
+	var got []string
+	for v := range stanzas {
+		if chat, ok := v.(xmpp.Chat); ok {
+			got = append(got, chat.Remote+" "+chat.Text)
+			if len(got) == 2 {
+				break
+			}
+		}
+	}
+	want := []string{"bob@localhost twice", "intercepted@localhost twice"}
+	if !slices.Equal(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(audit, []string{"iq set", "presence ", "message chat", "iq result"}) {
+		t.Errorf("audit = %q", audit)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{})
+	m := new(xmpp.MemoryMetrics)
+	o := s.ClientOptions("alice", "secret")
+	o.Mechanism = xmpp.SCRAM_SHA_256
+	o.Metrics = m
+	o.PeriodicServerPings = true
+	o.PeriodicServerPingsPeriod = 20
+	c, stanzas := connect(t, o)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.PingC2SContext(ctx, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "counted"})
+	s.ExpectMessage(t, "counted")
+	for m.Snapshot().PingRoundTrips.Count == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("no periodic ping was answered")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	s.WaitSession(t).StreamError("system-shutdown")
+	for range stanzas {
+	}
+
+	snap := m.Snapshot()
+	if snap.BytesReceived == 0 || snap.BytesSent == 0 {
+		t.Errorf("bytes received %d, sent %d", snap.BytesReceived, snap.BytesSent)
+	}
+	if snap.StanzasOut["message"] != 1 || snap.StanzasOut["presence"] != 1 || snap.StanzasOut["iq"] < 2 {
+		t.Errorf("stanzas sent = %v", snap.StanzasOut)
+	}
+	if snap.StanzasIn["iq"] < 2 {
+		t.Errorf("stanzas received = %v", snap.StanzasIn)
+	}
+	if snap.IQRoundTrips.Count != 1 || snap.IQRoundTrips.Mean() <= 0 {
+		t.Errorf("IQ round trips = %+v", snap.IQRoundTrips)
+	}
+	if snap.Mechanisms[xmpp.SCRAM_SHA_256] != 1 || snap.StreamErrors["system-shutdown"] != 1 {
+		t.Errorf("mechanisms = %v, stream errors = %v", snap.Mechanisms, snap.StreamErrors)
+	}
+	if v := m.Var().String(); !strings.Contains(v, `"StreamErrors":{"system-shutdown":1}`) {
+		t.Errorf("expvar = %s", v)
+	}
+}
+
+// kill drops the connection of the session of the client as if the network
+// failed and waits until the client noticed.
+func kill(t *testing.T, s *xmpptest.Server, stanzas <-chan interface{}) {
+	t.Helper()
+	s.WaitSession(t).Kill()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-stanzas:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("client did not notice the lost connection")
+		}
+	}
+}
+
+func TestStreamManagement(t *testing.T) {
+	t.Run("ack", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{StreamManagement: true})
+		o := s.ClientOptions("alice", "secret")
+		o.StreamManagement = true
+		c, _ := connect(t, o)
+		if !c.StreamManagementEnabled() {
+			t.Fatal("stream management not enabled")
+		}
+		c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "one"})
+		s.ExpectMessage(t, "one")
+		if n := len(c.SMState().Unacked); n != 2 {
+			t.Errorf("%d unacked stanzas, want presence and message", n)
+		}
+		if err := c.RequestAck(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(c.SMState().Unacked) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if state := c.SMState(); len(state.Unacked) > 0 || state.Outbound != 2 {
+			t.Errorf("state after ack = %+v", state)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{StreamManagement: true})
+		s.HandlePresence(func(*xmpptest.Session, xmpptest.Stanza) {})
+		o := s.ClientOptions("alice", "secret")
+		o.StreamManagement = true
+		c, stanzas := connect(t, o)
+		s.ExpectPresence(t, "")
+		c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "acked"})
+		s.ExpectMessage(t, "acked")
+		c.RequestAck()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(c.SMState().Unacked) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "unacked"})
+		s.ExpectMessage(t, "unacked")
+		kill(t, s, stanzas)
+
+		r, err := c.Resume()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Resumed() || r.JID() != c.JID() {
+			t.Errorf("Resumed() = %v, JID() = %q, want %q", r.Resumed(), r.JID(), c.JID())
+		}
+		// Only the stanza the server forgot is sent again, without a new
+		// initial presence.
+		s.ExpectMessage(t, "unacked")
+		r.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "after"})
+		s.ExpectMessage(t, "after")
+		if n := len(s.Received()); n != 5 {
+			t.Errorf("server received %d stanzas, want 5", n)
+		}
+		if state := r.SMState(); state.Outbound != 4 || len(state.Unacked) != 2 {
+			t.Errorf("state after resume = %+v", state)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{StreamManagement: true})
+		o := s.ClientOptions("alice", "secret")
+		o.StreamManagement = true
+		c, stanzas := connect(t, o)
+		c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "lost"})
+		s.ExpectMessage(t, "lost")
+		kill(t, s, stanzas)
+
+		// Another server does not know the session.
+		other := startServer(t, &xmpptest.Server{StreamManagement: true})
+		o = other.ClientOptions("alice", "secret")
+		o.TLSConfig.InsecureSkipVerify = true
+		r, err := o.Resume(c.SMState())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Resumed() || !r.StreamManagementEnabled() {
+			t.Errorf("Resumed() = %v, StreamManagementEnabled() = %v", r.Resumed(), r.StreamManagementEnabled())
+		}
+		other.ExpectPresence(t, "")
+		lost := r.LostStanzas()
+		if len(lost) != 2 || !strings.HasPrefix(lost[0], "<presence") || !strings.Contains(lost[1], "<body>lost</body>") {
+			t.Errorf("LostStanzas() = %q", lost)
+		}
+	})
+}
+
+func TestPeriodicPings(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{StreamManagement: true})
+	m := new(xmpp.MemoryMetrics)
+	o := s.ClientOptions("alice", "secret")
+	o.Metrics = m
+	o.StreamManagement = true
+	o.PeriodicServerPings = true
+	o.PeriodicServerPingsPeriod = 5
+	// The next ping is sent after the timeout of the previous one.
+	o.PeriodicServerPingsTimeout = 100
+	c, stanzas := connect(t, o)
+	for i := range 3 {
+		s.ExpectIQ(t, "get", xmpp.XMPPNS_PING)
+		c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: strconv.Itoa(i)})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Snapshot().PingRoundTrips.Count < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.Snapshot().PingRoundTrips.Count; n < 3 {
+		t.Errorf("%d periodic pings answered, want 3", n)
+	}
+
+	// The resumed client takes over pinging the server.
+	kill(t, s, stanzas)
+	r, err := c.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := r.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+	s.ExpectIQ(t, "get", xmpp.XMPPNS_PING)
+	s.WaitSession(t).StreamError("system-shutdown")
+}
+
+// managed creates a managed client receiving in the background. The state
+// changes are sent to the returned channel.
+func managed(t *testing.T, o xmpp.Options, p xmpp.Policy) (*xmpp.ManagedClient, <-chan xmpp.StateChange) {
+	t.Helper()
+	states := make(chan xmpp.StateChange, 64)
+	p.OnStateChange = func(sc xmpp.StateChange) { states <- sc }
+	return xmpp.NewManagedClient(o, p), states
+}
+
+// expectStates waits for the state changes want.
+func expectStates(t *testing.T, states <-chan xmpp.StateChange, want ...xmpp.ConnState) []xmpp.StateChange {
+	t.Helper()
+	var got []xmpp.StateChange
+	for _, w := range want {
+		select {
+		case sc := <-states:
+			got = append(got, sc)
+			if sc.State != w {
+				t.Fatalf("state changes %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("state changes %v, want %v", got, want)
+		}
+	}
+	return got
+}
+
+// receive calls m.Recv until it fails and sends the error to the returned
+// channel.
+func receive(m *xmpp.ManagedClient) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := m.Recv(); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return errc
+}
+
+func TestManagedClient(t *testing.T) {
+	hello := func(c *xmpp.Client) error {
+		_, err := c.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "hello"})
+		return err
+	}
+
+	t.Run("redial", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{})
+		m, states := managed(t, s.ClientOptions("alice", "secret"), xmpp.Policy{InitialBackoff: time.Millisecond})
+		m.OnConnect(hello)
+		errc := receive(m)
+		expectStates(t, states, xmpp.StateConnecting, xmpp.StateConnected)
+		s.ExpectMessage(t, "hello")
+
+		s.WaitSession(t).Kill()
+		got := expectStates(t, states, xmpp.StateDisconnected, xmpp.StateConnecting, xmpp.StateConnected)
+		if got[0].Err == nil || got[2].Resumed || got[2].Attempt != 1 {
+			t.Errorf("state changes %+v", got)
+		}
+		// The actions are replayed on the new session.
+		s.ExpectMessage(t, "hello")
+		if c := m.Client(); c == nil || !strings.HasPrefix(c.JID(), "alice@localhost/") {
+			t.Errorf("Client() = %v", c)
+		}
+
+		m.Close()
+		if err := <-errc; !errors.Is(err, xmpp.ErrManagedClientClosed) {
+			t.Errorf("Recv() error = %v", err)
+		}
+		expectStates(t, states, xmpp.StateClosed)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{StreamManagement: true})
+		o := s.ClientOptions("alice", "secret")
+		o.StreamManagement = true
+		m, states := managed(t, o, xmpp.Policy{InitialBackoff: time.Millisecond})
+		m.OnConnect(hello)
+		errc := receive(m)
+		expectStates(t, states, xmpp.StateConnecting, xmpp.StateConnected)
+		s.ExpectMessage(t, "hello")
+		c := m.Client()
+		c.RequestAck()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(c.SMState().Unacked) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		s.WaitSession(t).Kill()
+		got := expectStates(t, states, xmpp.StateDisconnected, xmpp.StateConnecting, xmpp.StateConnected)
+		if !got[2].Resumed {
+			t.Errorf("state changes %+v, want resumed", got)
+		}
+		// The actions are not run again on the resumed session.
+		m.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "after"})
+		s.ExpectMessage(t, "after")
+		var n int
+		for _, st := range s.Received() {
+			if st.Body() == "hello" {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("action run %d times, want once", n)
+		}
+
+		m.Close()
+		<-errc
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{})
+		m, states := managed(t, s.ClientOptions("alice", "wrong"), xmpp.Policy{
+			InitialBackoff: time.Millisecond,
+			MaxAttempts:    3,
+		})
+		if _, err := m.Connect(); err == nil {
+			t.Fatal("Connect() succeeded with a wrong password")
+		}
+		got := expectStates(t, states,
+			xmpp.StateConnecting, xmpp.StateDisconnected,
+			xmpp.StateConnecting, xmpp.StateDisconnected,
+			xmpp.StateConnecting, xmpp.StateDisconnected)
+		if got[5].Attempt != 3 || got[5].Err == nil {
+			t.Errorf("last state change %+v", got[5])
+		}
+		select {
+		case sc := <-states:
+			t.Errorf("unexpected state change %+v", sc)
+		default:
+		}
+	})
+
+	t.Run("close during backoff", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{})
+		m, states := managed(t, s.ClientOptions("alice", "wrong"), xmpp.Policy{InitialBackoff: time.Hour})
+		errc := make(chan error, 1)
+		go func() {
+			_, err := m.Connect()
+			errc <- err
+		}()
+		expectStates(t, states, xmpp.StateConnecting, xmpp.StateDisconnected)
+		m.Close()
+		select {
+		case err := <-errc:
+			if !errors.Is(err, xmpp.ErrManagedClientClosed) {
+				t.Errorf("Connect() error = %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Connect() did not return after Close")
+		}
+		expectStates(t, states, xmpp.StateClosed)
+	})
+
+	t.Run("single flight", func(t *testing.T) {
+		s := startServer(t, &xmpptest.Server{})
+		metrics := new(xmpp.MemoryMetrics)
+		o := s.ClientOptions("alice", "secret")
+		o.Metrics = metrics
+		m, _ := managed(t, o, xmpp.Policy{})
+		clients := make(chan *xmpp.Client, 4)
+		for range cap(clients) {
+			go func() {
+				c, _ := m.Connect()
+				clients <- c
+			}()
+		}
+		first := <-clients
+		for range cap(clients) - 1 {
+			if c := <-clients; c != first || c == nil {
+				t.Errorf("Connect() = %p, want %p", c, first)
+			}
+		}
+		if n := metrics.Snapshot().Mechanisms[first.Mechanism]; n != 1 {
+			t.Errorf("%d authentications, want 1", n)
+		}
+		m.Close()
+	})
+}
+
+func TestInterceptorsReconnect(t *testing.T) {
+	s := startServer(t, &xmpptest.Server{StreamManagement: true})
+	var audited atomic.Int32
+	o := s.ClientOptions("alice", "secret")
+	o.StreamManagement = true
+	o.OutboundInterceptors = []xmpp.Interceptor{func(next xmpp.StanzaHandler) xmpp.StanzaHandler {
+		return func(st *xmpp.Stanza) error {
+			if st.Name() == "message" {
+				audited.Add(1)
+				st.InnerXML += "<header xmlns='urn:example:headers'>1</header>"
+			}
+			return next(st)
+		}
+	}}
+	m, states := managed(t, o, xmpp.Policy{InitialBackoff: time.Millisecond})
+	errc := receive(m)
+	expectStates(t, states, xmpp.StateConnecting, xmpp.StateConnected)
+	var added atomic.Int32
+	m.Client().UseOutbound(func(next xmpp.StanzaHandler) xmpp.StanzaHandler {
+		return func(st *xmpp.Stanza) error {
+			added.Add(1)
+			return next(st)
+		}
+	})
+	m.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "unacked"})
+	s.ExpectMessage(t, "unacked")
+
+	s.WaitSession(t).Kill()
+	if got := expectStates(t, states, xmpp.StateDisconnected, xmpp.StateConnecting, xmpp.StateConnected); !got[2].Resumed {
+		t.Fatalf("state changes %+v, want resumed", got)
+	}
+	// The resent stanza is not intercepted again.
+	if st := s.ExpectMessage(t, "unacked"); strings.Count(st.Inner, "urn:example:headers") != 1 {
+		t.Errorf("resent message = %s", st)
+	}
+	m.Send(xmpp.Chat{Remote: "bob@localhost", Type: "chat", Text: "after"})
+	if st := s.ExpectMessage(t, "after"); !strings.Contains(st.Inner, "urn:example:headers") {
+		t.Errorf("message after reconnect was not intercepted: %s", st)
+	}
+	if n := audited.Load(); n != 2 {
+		t.Errorf("%d messages intercepted, want 2", n)
+	}
+	// The interceptor added to the first client is kept as well.
+	if n := added.Load(); n != 2 {
+		t.Errorf("%d stanzas intercepted by UseOutbound, want 2", n)
+	}
+	m.Close()
+	<-errc
+}